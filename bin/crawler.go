@@ -2,12 +2,20 @@ package main
 
 import (
 	"../crawler"
+	"../logging"
+	"../scope"
+	"context"
 	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tpjg/goriakpbc"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 const (
@@ -20,14 +28,68 @@ const (
 func main() {
 	ipaddr := flag.String("ip", "127.0.0.1", "IP address of exchange")
 	port := flag.Int("port", 9000, "Port of exchange")
+	maxDepth := flag.Int("max-depth", 0, "Maximum number of links followed from a seed (0 means unlimited)")
+	maxHops := flag.Int("max-hops", 0, "Maximum number of consecutive links followed off a seed's host (0 means unlimited)")
+	scopeFile := flag.String("scope", "", "Path to a JSON file of crawl scope rules")
+	legacy := flag.Bool("legacy", false, "Speak the legacy line protocol to the exchange")
+	id := flag.String("id", "", "Identity of the crawler, which keeps its hosts across restarts (random if empty)")
+	weight := flag.Float64("weight", 1, "Capacity of the crawler, which it takes a share of hosts in proportion to")
+	adminPort := flag.Int("admin-port", 0, "Port number to serve the HTTP admin API on (0 to disable)")
+	metricsPort := flag.Int("metrics-port", 0, "Port number to serve Prometheus metrics on at /metrics (0 to disable)")
+	logLevel := flag.String("log-level", "info", "Lowest level of messages logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Format of messages logged: text or json")
+	crawlLogFile := flag.String("crawl-log", "", "Path to append a JSON line to for every fetch attempt (none if empty)")
+	maxAttempts := flag.Int("max-attempts", crawler.DefaultRetryPolicy.MaxAttempts, "Times a URL is attempted in all when it fails for a transient reason (1 to never retry)")
+	retryDelay := flag.Duration("retry-delay", crawler.DefaultRetryPolicy.BaseDelay, "Wait before retrying a failed URL, doubled for every next attempt")
+	maxRetryDelay := flag.Duration("max-retry-delay", crawler.DefaultRetryPolicy.MaxDelay, "Longest wait before retrying a failed URL, even if its server asks for longer")
+	maxHostDelay := flag.Duration("max-host-delay", crawler.DefaultHealthPolicy.MaxDelay, "Widest delay between the URLs of a host which fails or slows down")
+	circuitFailures := flag.Int("circuit-failures", crawler.DefaultHealthPolicy.MaxFailures, "Failures in a row which pause a host")
+	circuitOpen := flag.Duration("circuit-open", crawler.DefaultHealthPolicy.OpenDuration, "How long a failing host is paused at first, doubled while it keeps failing")
+	bodyTimeout := flag.Duration("body-timeout", crawler.DefaultBodyTimeout, "Longest time reading a page may take once its server has answered (0 means unlimited)")
+	deadLetterFile := flag.String("dead-letter-log", "", "Path to append a JSON line to for every URL given up on after failing every attempt (none if empty)")
 	flag.Parse()
 
+	if err := logging.Setup(os.Stderr, *logLevel, *logFormat); err != nil {
+		log.Fatalf("Invalid -log-level %s or -log-format %s: %v", *logLevel, *logFormat, err)
+	}
+
+	var crawlLog *crawler.CrawlLog
+	if *crawlLogFile != "" {
+		var err error
+		crawlLog, err = crawler.OpenCrawlLog(*crawlLogFile)
+		if err != nil {
+			log.Fatalf("Failed to open crawl log: %v", err)
+		}
+		defer crawlLog.Close()
+	}
+
+	var deadLetterLog *crawler.CrawlLog
+	if *deadLetterFile != "" {
+		var err error
+		deadLetterLog, err = crawler.OpenCrawlLog(*deadLetterFile)
+		if err != nil {
+			log.Fatalf("Failed to open dead letter log: %v", err)
+		}
+		defer deadLetterLog.Close()
+	}
+	retryPolicy := crawler.RetryPolicy{
+		MaxAttempts: *maxAttempts,
+		BaseDelay:   *retryDelay,
+		MaxDelay:    *maxRetryDelay}
+	healthPolicy := crawler.DefaultHealthPolicy
+	healthPolicy.MaxDelay = *maxHostDelay
+	healthPolicy.MaxFailures = *circuitFailures
+	healthPolicy.OpenDuration = *circuitOpen
+
 	riakClient := riak.New(RIAK_HOST)
 	err := riakClient.Connect()
 	if err != nil {
 		log.Fatalf("Failed to connect to Riak")
 	}
 
+	limits := crawler.Limits{
+		MaxDepth: *maxDepth,
+		MaxHops:  *maxHops}
 	exchange := crawler.Exchange{
 		*ipaddr,
 		*port}
@@ -37,7 +99,57 @@ func main() {
 		RIAK_BUCKET,
 		USER_AGENT,
 		CRAWLER_NAME)
-	go crawler.Start()
+	crawler.SetLimits(limits)
+	crawler.SetLegacy(*legacy)
+	if *id != "" {
+		crawler.SetId(*id)
+	}
+	crawler.SetWeight(*weight)
+	if crawlLog != nil {
+		crawler.SetCrawlLog(crawlLog)
+	}
+	crawler.SetRetryPolicy(retryPolicy)
+	crawler.SetBodyTimeout(*bodyTimeout)
+	crawler.SetHealthPolicy(healthPolicy)
+	if deadLetterLog != nil {
+		crawler.SetDeadLetterLog(deadLetterLog)
+	}
+	if *scopeFile != "" {
+		crawlScope, err := scope.Load(*scopeFile)
+		if err != nil {
+			log.Fatalf("Failed to load scope: %v", err)
+		}
+
+		squit := make(chan bool)
+		defer close(squit)
+		go crawlScope.Watch(10*time.Second, squit)
+		crawler.SetScope(crawlScope)
+	}
+	if *metricsPort != 0 {
+		prometheus.MustRegister(crawler.Collector())
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			addr := fmt.Sprintf(":%d", *metricsPort)
+			log.Printf("Serving metrics on %s", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Fatalf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+	if *adminPort != 0 {
+		go func() {
+			addr := fmt.Sprintf(":%d", *adminPort)
+			log.Printf("Serving admin API on %s", addr)
+			if err := http.ListenAndServe(addr, crawler.AdminHandler()); err != nil {
+				log.Fatalf("Failed to serve admin API: %v", err)
+			}
+		}()
+	}
+	if err := crawler.Start(); err != nil {
+		log.Fatalf("Failed to join exchange: %v", err)
+	}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
@@ -45,6 +157,14 @@ func main() {
 	select {
 	case <-stop:
 		log.Printf("Process is shutting down...")
-		crawler.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := crawler.Stop(ctx); err != nil {
+			log.Printf("Failed to stop gracefully: %v", err)
+		}
+
+		for _, trap := range crawler.TrapReport() {
+			log.Printf("Spider trap: %s %s (%s, flagged at %s)", trap.Host, trap.Pattern, trap.Reason, trap.FlaggedAt)
+		}
 	}
 }
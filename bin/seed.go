@@ -0,0 +1,163 @@
+package main
+
+import (
+	"../protocol"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	urlparse "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	seedBatchSize = 100
+	ackTimeout    = 30 * time.Second
+)
+
+// parseSeed parses a line of a seed file, which is a URL optionally followed
+// by scope=<any|host|domain|prefix> and priority=<n>.
+func parseSeed(line string, scope string, priority int) (*protocol.Link, error) {
+	fields := strings.Fields(line)
+
+	url, err := urlparse.Parse(fields[0])
+	if err != nil {
+		return nil, err
+	} else if url.Scheme != "http" && url.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %s", url.Scheme)
+	}
+
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option: %s", field)
+		}
+
+		switch kv[0] {
+		case "scope":
+			scope = kv[1]
+		case "priority":
+			if priority, err = strconv.Atoi(kv[1]); err != nil {
+				return nil, fmt.Errorf("invalid priority: %s", kv[1])
+			}
+		default:
+			return nil, fmt.Errorf("unknown option: %s", kv[0])
+		}
+	}
+
+	if scope == "any" {
+		scope = protocol.ScopeAny
+	}
+	if !protocol.ValidScope(scope) {
+		return nil, protocol.InvalidScope
+	}
+
+	seed := protocol.NewSeed(url)
+	seed.Scope = scope
+	seed.Priority = priority
+	return seed, nil
+}
+
+func main() {
+	ipaddr := flag.String("ip", "127.0.0.1", "IP address of exchange")
+	port := flag.Int("port", 9000, "Port of exchange")
+	file := flag.String("file", "-", "File to read seeds from, one per line (- for stdin)")
+	scope := flag.String("scope", "any", "Default scope of seeds: any, host, domain or prefix")
+	priority := flag.Int("priority", 0, "Default priority of seeds")
+	legacy := flag.Bool("legacy", false, "Speak the legacy line protocol to the exchange")
+	flag.Parse()
+
+	var input io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *file, err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	client, err := net.Dial("tcp", net.JoinHostPort(*ipaddr, strconv.Itoa(*port)))
+	if err != nil {
+		log.Fatalf("Failed to connect to exchange: %v", err)
+	}
+
+	var conn protocol.Conn
+	if *legacy {
+		conn = protocol.NewLegacyConn(client)
+	} else {
+		conn = protocol.NewFramedConn(client)
+	}
+	defer conn.Close()
+
+	hello := &protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleSeeder}
+	if err := conn.Write(hello); err != nil {
+		log.Fatalf("Failed to say hello: %v", err)
+	}
+
+	var id uint64
+	seeds := make([]*protocol.Link, 0, seedBatchSize)
+	send := func() {
+		if len(seeds) == 0 {
+			return
+		}
+
+		id++
+		if err := conn.Write(&protocol.Message{Type: protocol.Seeds, ID: id, Links: seeds}); err != nil {
+			log.Fatalf("Failed to send seeds: %v", err)
+		}
+		seeds = seeds[:0]
+	}
+
+	scanner := bufio.NewScanner(input)
+
+	count := 0
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		seed, err := parseSeed(line, *scope, *priority)
+		if err != nil {
+			log.Printf("Skipped line %d: %v", lineno, err)
+			continue
+		}
+
+		seeds = append(seeds, seed)
+		if len(seeds) == seedBatchSize {
+			send()
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Failed to read seeds: %v", err)
+	}
+	send()
+
+	if err := conn.Write(&protocol.Message{Type: protocol.Quit}); err != nil {
+		log.Fatalf("Failed to send quitting message: %v", err)
+	}
+
+	// wait for the exchange to take the last batch
+	if conn.Framed() && id > 0 {
+		conn.SetReadDeadline(time.Now().Add(ackTimeout))
+		for {
+			m, err := conn.Read()
+			if err != nil {
+				log.Fatalf("Failed to receive acknowledgement: %v", err)
+			} else if m.Type == protocol.Error {
+				log.Printf("Got an error from exchange: %s", m.Error)
+			} else if m.Type == protocol.Ack && m.ID == id {
+				break
+			}
+		}
+	}
+
+	log.Printf("Submitted %d seeds", count)
+}
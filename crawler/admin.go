@@ -0,0 +1,283 @@
+package crawler
+
+import (
+	"../logging"
+	"../protocol"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	urlparse "net/url"
+	"time"
+)
+
+// The admin API of the crawler is served over HTTP in JSON:
+//
+//	GET    /status                  whether crawling is paused, and blocked hosts
+//	GET    /queue[?host=HOST]       the crawl queue by netloc, with the URLs of HOST
+//	GET    /downloads               the URLs being downloaded
+//	GET    /errors                  recent failures to crawl URLs
+//	GET    /robots                  the robots.txt of hosts kept in memory
+//	GET    /health                  hosts backed off from, and their circuits
+//	POST   /pause                   stop taking URLs from the crawl queue
+//	POST   /resume                  start taking them again
+//	POST   /hosts/{host}/block      never crawl a host, and purge its queue
+//	DELETE /hosts/{host}/block      crawl a host again
+//	POST   /hosts/{host}/purge      drop the queued URLs of a host
+//	POST   /fetch?url=URL           fetch a URL now, for debugging
+//
+// Hosts are given with their port if they have one, as in URLs.
+
+// Status tells what the crawler is doing.
+type Status struct {
+	ID         string   `json:"id"`
+	Paused     bool     `json:"paused"`
+	Blocked    []string `json:"blocked"`
+	QueueURLs  int      `json:"queue_urls"`
+	QueueHosts int      `json:"queue_hosts"`
+	Retrying   int      `json:"retrying"` // URLs waiting to be retried
+}
+
+// FetchResult tells how a forced fetch went.
+type FetchResult struct {
+	URL         string   `json:"url"`
+	Status      int      `json:"status,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Bytes       int      `json:"bytes"`
+	Redirects   []string `json:"redirects,omitempty"`
+	Links       []string `json:"links,omitempty"`
+	Duration    string   `json:"duration"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// Pause stops the downloader from taking URLs from the crawl queue. The
+// download in progress is finished.
+func (c *Crawler) Pause() {
+	if !c.paused.Swap(true) {
+		c.logger.Info("Paused crawling")
+	}
+}
+
+// Resume lets the downloader take URLs again.
+func (c *Crawler) Resume() {
+	if c.paused.Swap(false) {
+		c.logger.Info("Resumed crawling")
+	}
+	select {
+	case c.resumed <- struct{}{}:
+	default:
+	}
+}
+
+// Paused reports whether crawling has been paused.
+func (c *Crawler) Paused() bool {
+	return c.paused.Load()
+}
+
+// Block makes the URLs of host skipped, and purges the ones queued. It
+// returns the number of URLs purged.
+func (c *Crawler) Block(host string) int {
+	if c.blocked.Add(host) {
+		c.logger.Info("Blocked host", logging.Host, host)
+	}
+	return c.Purge(host)
+}
+
+// Unblock lets the URLs of host be crawled again.
+func (c *Crawler) Unblock(host string) {
+	if c.blocked.Remove(host) {
+		c.logger.Info("Unblocked host", logging.Host, host)
+	}
+}
+
+// Purge drops the queued URLs of host, including the ones waiting to be
+// retried, which are told to the exchange as finished, and returns the
+// number of them.
+func (c *Crawler) Purge(host string) int {
+	links := c.cqueue.Purge(host)
+	c.attempts.Forget(links)
+	if len(links) > 0 {
+		c.logger.Info("Purged queued URLs", logging.Host, host, "count", len(links))
+	}
+
+	c.Lock()
+	running := c.running
+	c.Unlock()
+	if running != nil {
+		go c.finish(running, links)
+	}
+	return len(links)
+}
+
+// finish tells the exchange that links are done with, unless ctx is done
+// first.
+func (c *Crawler) finish(ctx context.Context, links []*protocol.Link) {
+	for _, link := range links {
+		select {
+		case c.dqueue <- link:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Fetch downloads rawurl regardless of the crawl queue, robots.txt and
+// blocked hosts. The page is neither stored nor are its links sent to the
+// exchange.
+func (c *Crawler) Fetch(rawurl string) (*FetchResult, error) {
+	url, err := urlparse.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	} else if url.Scheme != "http" && url.Scheme != "https" {
+		return nil, protocol.InvalidLink
+	}
+
+	finished := c.inflight.Start(rawurl)
+	start := time.Now()
+	page, redirectChain, err := c.download(url)
+	finished()
+
+	result := &FetchResult{URL: rawurl, Duration: time.Since(start).String()}
+	for _, redirect := range redirectChain {
+		result.Redirects = append(result.Redirects, redirect.RedirectTo)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	result.Status = page.State.LastStatusCode
+	result.ContentType = page.ContentType
+	result.Bytes = len(page.Body)
+	if links, err := c.detectURLs(protocol.NewSeed(url), page); err == nil {
+		for _, link := range links {
+			result.Links = append(result.Links, link.URL.String())
+		}
+	}
+	return result, nil
+}
+
+type adminServer struct {
+	c *Crawler
+}
+
+// AdminHandler returns the handler of the admin API of c.
+func (c *Crawler) AdminHandler() http.Handler {
+	s := &adminServer{c}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.getStatus)
+	mux.HandleFunc("GET /queue", s.getQueue)
+	mux.HandleFunc("GET /downloads", s.getDownloads)
+	mux.HandleFunc("GET /errors", s.getErrors)
+	mux.HandleFunc("GET /robots", s.getRobots)
+	mux.HandleFunc("GET /health", s.getHealth)
+	mux.HandleFunc("POST /pause", s.pause)
+	mux.HandleFunc("POST /resume", s.resume)
+	mux.HandleFunc("POST /hosts/{host}/block", s.blockHost)
+	mux.HandleFunc("DELETE /hosts/{host}/block", s.unblockHost)
+	mux.HandleFunc("POST /hosts/{host}/purge", s.purgeHost)
+	mux.HandleFunc("POST /fetch", s.fetch)
+	return mux
+}
+
+func (s *adminServer) getStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &Status{
+		ID:         s.c.GetId(),
+		Paused:     s.c.Paused(),
+		Blocked:    s.c.blocked.List(),
+		QueueURLs:  s.c.cqueue.Count(),
+		QueueHosts: s.c.cqueue.Hosts(),
+		Retrying:   s.c.cqueue.Delayed()})
+}
+
+func (s *adminServer) getQueue(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	hosts := s.c.cqueue.Snapshot(host != "")
+	if host == "" {
+		writeJSON(w, http.StatusOK, hosts)
+		return
+	}
+
+	matched := make([]QueuedHost, 0)
+	for _, queued := range hosts {
+		if queued.Host == host {
+			matched = append(matched, queued)
+		}
+	}
+	writeJSON(w, http.StatusOK, matched)
+}
+
+func (s *adminServer) getDownloads(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.c.inflight.List())
+}
+
+func (s *adminServer) getErrors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.c.failures.Recent())
+}
+
+func (s *adminServer) getRobots(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.c.robots.States())
+}
+
+func (s *adminServer) getHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.c.health.Hosts())
+}
+
+func (s *adminServer) pause(w http.ResponseWriter, r *http.Request) {
+	s.c.Pause()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) resume(w http.ResponseWriter, r *http.Request) {
+	s.c.Resume()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) blockHost(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &purgeResponse{s.c.Block(r.PathValue("host"))})
+}
+
+func (s *adminServer) unblockHost(w http.ResponseWriter, r *http.Request) {
+	s.c.Unblock(r.PathValue("host"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) purgeHost(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &purgeResponse{s.c.Purge(r.PathValue("host"))})
+}
+
+func (s *adminServer) fetch(w http.ResponseWriter, r *http.Request) {
+	rawurl := r.URL.Query().Get("url")
+	if rawurl == "" {
+		writeError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+
+	result, err := s.c.Fetch(rawurl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write admin response", logging.Error, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &adminError{message})
+}
@@ -0,0 +1,143 @@
+package crawler
+
+import (
+	"../protocol"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAdminQueue(t *testing.T) {
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	server := httptest.NewServer(c.AdminHandler())
+	defer server.Close()
+
+	for _, rawurl := range []string{"http://a.example.com/1", "http://a.example.com/2", "http://b.example.com/"} {
+		u, _ := url.Parse(rawurl)
+		c.cqueue.Push(protocol.NewSeed(u))
+	}
+
+	resp, err := http.Get(server.URL + "/queue")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	hosts := make([]QueuedHost, 0)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&hosts))
+	resp.Body.Close()
+	assert.Equal(t, len(hosts), 2)
+
+	resp, err = http.Get(server.URL + "/queue?host=a.example.com")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&hosts))
+	resp.Body.Close()
+	if assert.Equal(t, len(hosts), 1) {
+		assert.Equal(t, hosts[0].URLs, []string{"http://a.example.com/1", "http://a.example.com/2"})
+	}
+
+	resp, err = http.Post(server.URL+"/hosts/a.example.com/purge", "", nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	purged := new(purgeResponse)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(purged))
+	resp.Body.Close()
+	assert.Equal(t, purged.Purged, 2)
+
+	// a blocked host is purged too, and skipped until it is unblocked
+	resp, err = http.Post(server.URL+"/hosts/b.example.com/block", "", nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(purged))
+	resp.Body.Close()
+	assert.Equal(t, purged.Purged, 1)
+
+	resp, err = http.Get(server.URL + "/status")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	status := new(Status)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(status))
+	resp.Body.Close()
+	assert.Equal(t, status.Blocked, []string{"b.example.com"})
+	assert.Equal(t, status.QueueURLs, 0)
+	assert.True(t, c.blocked.Contains("b.example.com"))
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/hosts/b.example.com/block", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	assert.False(t, c.blocked.Contains("b.example.com"))
+}
+
+func TestAdminPause(t *testing.T) {
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	server := httptest.NewServer(c.AdminHandler())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/pause", "", nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	assert.True(t, c.Paused())
+
+	resp, err = http.Post(server.URL+"/resume", "", nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	assert.False(t, c.Paused())
+}
+
+func TestAdminFetch(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><a href="/next">next</a></html>`))
+	}))
+	defer site.Close()
+
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	server := httptest.NewServer(c.AdminHandler())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/fetch?url="+url.QueryEscape(site.URL+"/old"), "", nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	result := new(FetchResult)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(result))
+	resp.Body.Close()
+	assert.Equal(t, result.Status, http.StatusOK)
+	assert.Equal(t, result.Redirects, []string{site.URL + "/"})
+	assert.Equal(t, result.Links, []string{site.URL + "/next"})
+	assert.Equal(t, result.Error, "")
+
+	for _, query := range []string{"?url=" + url.QueryEscape("ftp://example.com/"), ""} {
+		resp, err = http.Post(server.URL+"/fetch"+query, "", nil)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	}
+}
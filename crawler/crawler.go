@@ -1,268 +1,601 @@
 package crawler
 
 import (
-	"bufio"
+	"../logging"
+	"../protocol"
+	"../scope"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/nu7hatch/gouuid"
 	"github.com/tpjg/goriakpbc"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	urlparse "net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	maxBatchSize = 100             // URLs sent to the exchange in a message
+	politeness   = 5 * time.Second // between the URLs of a healthy netloc
+
+	// The crawler grants the exchange credits to keep about creditWindow
+	// URLs queued or on the way, checking every creditInterval.
+	creditWindow   = 1000
+	creditInterval = time.Second
+)
+
+var (
+	AlreadyStarted = errors.New("Crawler has already been started")
+	NotStarted     = errors.New("Crawler has not been started")
+)
+
 type Exchange struct {
 	IPAddr string
 	Port   int
 }
 
+// Limits bounds how far a crawl may wander from its seeds. Zero means
+// unlimited.
+type Limits struct {
+	MaxDepth int // links followed from the seed
+	MaxHops  int // consecutive links followed off the seed's host
+}
+
 type Crawler struct {
-	exchange    Exchange
-	cqueue      *CrawlQueue        // Crawl queue
-	wqueue      chan *urlparse.URL // Send to exchange queue
-	pagestore   *PageStore
-	quit        chan bool
-	userAgent   string
-	crawlerName string
+	id            string  // identity presented to the exchange
+	weight        float64 // capacity relative to a crawler of 1
+	exchange      Exchange
+	limits        Limits
+	scope         *scope.Scope
+	traps         *TrapDetector
+	cqueue        *CrawlQueue         // Crawl queue
+	wqueue        chan *protocol.Link // Send to exchange queue
+	outbox        *protocol.Outbox    // Sent to exchange but not acknowledged
+	dqueue        chan *protocol.Link // Finished, to be told to exchange
+	granted       atomic.Int64        // Credits the exchange has not used yet
+	pagestore     *PageStore
+	userAgent     string
+	crawlerName   string
+	legacy        bool
+	logger        *slog.Logger
+	crawlLog      *CrawlLog // where fetch attempts are recorded, if anywhere
+	retryPolicy   RetryPolicy
+	bodyTimeout   time.Duration  // how long reading a page may take, if limited
+	attempts      *attempts      // failed attempts of URLs being retried
+	deadLetterLog *CrawlLog      // where URLs given up on are recorded, if anywhere
+	health        *healthTracker // backs off from hosts which fail or slow down
+	robots        *robotsCache   // robots.txt of hosts crawled lately
+	blocked       *hostSet       // hosts which are never crawled
+	inflight      *downloads     // URLs being downloaded
+	failures      *errorLog      // recent failures to crawl URLs
+	paused        atomic.Bool    // keeps the downloader from taking URLs
+	resumed       chan struct{}  // signaled when crawling is resumed
+
+	// Set while running. Stop cancels the downloader first and the session
+	// with the exchange next, and abort tears down whatever is left, which
+	// makes running done.
+	running        context.Context
+	abort          context.CancelFunc
+	stopDownloader context.CancelFunc
+	stopSession    context.CancelFunc
+	downloaderDone chan struct{}
+	sessionDone    chan struct{}
+	sync.Mutex
 }
 
 func NewCrawler(exchange Exchange, riakClient *riak.Client, bucket, userAgent, crawlerName string) *Crawler {
+	id, _ := uuid.NewV4()
 	crawler := &Crawler{
-		exchange,
-		NewCrawlQueue(5 * time.Second), // sleep crawling to same netloc for 5 seconds
-		make(chan *urlparse.URL, 20),
-		NewPageStore(riakClient, bucket),
-		make(chan bool, 2),
-		userAgent,
-		crawlerName}
+		id:          id.String(),
+		weight:      1,
+		exchange:    exchange,
+		limits:      Limits{},
+		scope:       nil,
+		traps:       NewTrapDetector(DefaultTrapConfig),
+		cqueue:      NewCrawlQueue(politeness),
+		wqueue:      make(chan *protocol.Link, 20),
+		outbox:      protocol.NewOutbox(),
+		dqueue:      make(chan *protocol.Link, 20),
+		pagestore:   NewPageStore(riakClient, bucket),
+		userAgent:   userAgent,
+		crawlerName: crawlerName,
+		logger:      slog.Default().With(logging.CrawlerID, id.String()),
+		robots:      newRobotsCache(),
+		blocked:     newHostSet(),
+		inflight:    newDownloads(),
+		failures:    newErrorLog(),
+		retryPolicy: DefaultRetryPolicy,
+		bodyTimeout: DefaultBodyTimeout,
+		attempts:    newAttempts(),
+		health:      newHealthTracker(DefaultHealthPolicy, politeness),
+		resumed:     make(chan struct{}, 1)}
 
 	return crawler
 }
 
-func (c *Crawler) joinExchange(quit chan bool) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", c.exchange.IPAddr, c.exchange.Port))
-	if err != nil {
-		quit <- true
-		return
-	}
-	defer conn.Close()
+// SetId sets the identity which the crawler presents to the exchange. The
+// exchange keeps the hosts of a crawler with it across reconnects, and
+// rejects a second crawler of the same identity. It is random by default.
+func (c *Crawler) SetId(id string) {
+	c.id = id
+	c.logger = slog.Default().With(logging.CrawlerID, id)
+}
+
+func (c *Crawler) GetId() string {
+	return c.id
+}
+
+// SetWeight sets the capacity of the crawler which the exchange shares out
+// hosts in proportion to. A crawler of 2 takes about twice as many hosts as
+// one of 1.
+func (c *Crawler) SetWeight(weight float64) {
+	c.weight = weight
+}
 
-	rquit := make(chan bool, 2)
-	go c.reader(conn, rquit)
-	defer close(rquit)
-
-	wquit := make(chan bool, 2)
-	go c.writer(conn, wquit)
-	defer close(wquit)
-
-	select {
-	case <-quit:
-		log.Printf("Stopping reader")
-		rquit <- true
-		time.Sleep(1 * time.Second)
-		<-rquit
-
-		log.Printf("Stopping writer")
-		wquit <- true
-		time.Sleep(1 * time.Second)
-		<-wquit
-	case <-rquit:
-		log.Printf("Stopping writer")
-		wquit <- true
-		time.Sleep(1 * time.Second)
-		<-wquit
-	case <-wquit:
-		log.Printf("Stopping reader")
-		rquit <- true
-		time.Sleep(1 * time.Second)
-		<-rquit
+// SetLegacy makes the crawler speak the legacy line protocol instead of the
+// framed one.
+func (c *Crawler) SetLegacy(legacy bool) {
+	c.legacy = legacy
+}
 
+func (c *Crawler) SetLimits(limits Limits) {
+	c.limits = limits
+}
+
+// SetRetryPolicy sets how URLs which failed for a transient reason are tried
+// again.
+func (c *Crawler) SetRetryPolicy(policy RetryPolicy) {
+	c.retryPolicy = policy
+}
+
+// SetBodyTimeout sets how long reading a page may take once its server has
+// answered, which is unlimited when d is 0.
+func (c *Crawler) SetBodyTimeout(d time.Duration) {
+	c.bodyTimeout = d
+}
+
+// SetHealthPolicy sets how the crawler backs off from hosts which fail or
+// slow down.
+func (c *Crawler) SetHealthPolicy(policy HealthPolicy) {
+	c.health.SetPolicy(policy)
+}
+
+// SetDeadLetterLog makes the URLs which failed every attempt recorded in l.
+func (c *Crawler) SetDeadLetterLog(l *CrawlLog) {
+	c.deadLetterLog = l
+}
+
+// SetCrawlLog makes every fetch attempt recorded in l.
+func (c *Crawler) SetCrawlLog(l *CrawlLog) {
+	c.crawlLog = l
+}
+
+// SetScope restricts the URLs sent to the exchange to those allowed by s.
+func (c *Crawler) SetScope(s *scope.Scope) {
+	c.scope = s
+}
+
+// TrapReport returns the hosts which have been flagged as spider traps.
+func (c *Crawler) TrapReport() []TrapHost {
+	return c.traps.Report()
+}
+
+func (c *Crawler) withinLimits(link *protocol.Link) bool {
+	if c.limits.MaxDepth > 0 && link.Depth > c.limits.MaxDepth {
+		return false
 	}
+	if c.limits.MaxHops > 0 && link.Hops > c.limits.MaxHops {
+		return false
+	}
+	return true
+}
 
-	quit <- true
-	log.Printf("Shut down connection with exchange")
+func (c *Crawler) dial() (net.Conn, error) {
+	return net.Dial("tcp", fmt.Sprintf("%s:%d", c.exchange.IPAddr, c.exchange.Port))
 }
 
-func (c *Crawler) reader(conn net.Conn, quit chan bool) {
-	urlchan := make(chan string, 20)
+// Start joins the exchange and starts crawling in the background. It fails
+// when the exchange cannot be reached; later disconnections are retried
+// until Stop is called.
+func (c *Crawler) Start() error {
+	c.Lock()
+	defer c.Unlock()
 
-	pushURL := func(urlString string) error {
-		url, err := urlparse.Parse(urlString)
-		if err != nil {
-			log.Printf("URL parsing error: %v", err)
-			return err
-		}
+	if c.abort != nil {
+		return AlreadyStarted
+	}
 
-		c.cqueue.Push(url)
-		return nil
+	conn, err := c.dial()
+	if err != nil {
+		return err
 	}
 
-	_quit := make(chan bool, 1)
+	root, abort := context.WithCancel(context.Background())
+	dctx, stopDownloader := context.WithCancel(root)
+	sctx, stopSession := context.WithCancel(root)
+
+	c.running = root
+	c.abort = abort
+	c.stopDownloader = stopDownloader
+	c.stopSession = stopSession
+	c.downloaderDone = make(chan struct{})
+	c.sessionDone = make(chan struct{})
+
 	go func() {
-		var urlString string
-		var err error
+		defer close(c.downloaderDone)
+		c.startDownloader(dctx, root)
+	}()
+	go func() {
+		defer close(c.sessionDone)
+		c.keepSession(sctx, root, conn)
+	}()
 
-		defer func() {
-			if err := recover(); err != nil {
-				// residual URL
-				if url, err := urlparse.Parse(urlString); err == nil {
-					c.wqueue <- url
-				}
+	return nil
+}
 
-				log.Printf("Recovered panic: %v", err)
-			}
-		}()
-
-		reader := bufio.NewReader(conn)
-		for {
-			urlString, err = reader.ReadString('\n')
-			if err == io.EOF {
-				log.Printf("Connection closed by exchange")
-				break
-			} else if err != nil {
-				log.Printf("An error occurred: %v", err)
-				break
-			}
+// Stop lets the in-flight download finish, leaves the exchange, which takes
+// the queued URLs back, and waits for every goroutine to exit. When ctx expires
+// first, the remaining work is abandoned and ctx's error is returned.
+func (c *Crawler) Stop(ctx context.Context) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.abort == nil {
+		return NotStarted
+	}
 
-			urlchan <- urlString[:len(urlString)-1]
+	wait := func(done chan struct{}) error {
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
 
-		_quit <- true
-	}()
+	c.logger.Info("Stopping downloader")
+	c.stopDownloader()
+	err := wait(c.downloaderDone)
+
+	if err == nil {
+		c.logger.Info("Leaving exchange")
+		c.stopSession()
+		err = wait(c.sessionDone)
+	}
+
+	c.abort()
+	<-c.downloaderDone
+	<-c.sessionDone
+	c.abort = nil
+	c.running = nil
+
+	for _, link := range c.outbox.Drain() {
+		c.logger.Warn("Flushed residual URL", logging.URL, link.URL.String())
+	}
+	for len(c.wqueue) > 0 {
+		c.logger.Warn("Flushed residual URL", logging.URL, (<-c.wqueue).URL.String())
+	}
+	for len(c.dqueue) > 0 {
+		<-c.dqueue
+	}
+	for _, link := range c.cqueue.Flush() {
+		c.logger.Warn("Flushed residual URL", logging.URL, link.URL.String())
+	}
+	c.attempts.Reset()
 
-loop:
+	return err
+}
+
+// keepSession talks to the exchange over conn, and rejoins whenever the
+// connection is lost until ctx is done.
+func (c *Crawler) keepSession(ctx context.Context, abort context.Context, conn net.Conn) {
 	for {
+		if conn != nil {
+			c.session(ctx, abort, conn)
+			c.logger.Info("Shut down connection with exchange")
+		}
+
 		select {
-		case <-_quit:
-			break loop
-		case <-quit:
-			break loop
-		case urlString := <-urlchan:
-			pushURL(urlString)
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
+
+		c.logger.Info("Rejoining exchange")
+		var err error
+		if conn, err = c.dial(); err != nil {
+			c.logger.Warn("Failed to join exchange", logging.Error, err)
 		}
 	}
+}
 
-	close(urlchan)
-	for urlString := range urlchan {
-		pushURL(urlString)
+func (c *Crawler) session(ctx context.Context, abort context.Context, client net.Conn) {
+	var conn protocol.Conn
+	if c.legacy {
+		conn = protocol.NewLegacyConn(client)
+	} else {
+		conn = protocol.NewFramedConn(client)
 	}
 
-	quit <- true
-	log.Printf("Stopeed reader")
+	defer conn.Close()
+	stop := context.AfterFunc(abort, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	quitting := make(chan struct{})
+	acked := make(chan struct{}, 1)
+	negotiated := make(chan int, 1)
+	rdone := make(chan struct{})
+	go func() {
+		defer close(rdone)
+		c.reader(conn, quitting, acked, negotiated)
+	}()
+
+	c.writer(ctx, conn, quitting, acked, negotiated, rdone)
+	conn.Close()
+	<-rdone
 }
 
-func (c *Crawler) writer(conn net.Conn, quit chan bool) {
-	writer := func(body []byte) error {
-		for wrote := 0; wrote < len(body); {
-			if _wrote, err := conn.Write(body[wrote:]); err == nil {
-				wrote += _wrote
-			} else {
-				return err
-			}
+// reader takes URLs from the exchange until the connection is lost. Once
+// quitting is closed, URLs are left unacknowledged for the exchange to route
+// them to another crawler. The version the exchange speaks is passed to
+// negotiated.
+func (c *Crawler) reader(conn protocol.Conn, quitting <-chan struct{}, acked chan<- struct{}, negotiated chan<- int) {
+	defer c.logger.Debug("Stopped reader")
+
+	for {
+		if conn.Framed() {
+			conn.SetReadDeadline(time.Now().Add(3 * protocol.HeartbeatInterval))
 		}
-		return nil
-	}
 
-	writeURL := func(url *urlparse.URL) error {
-		err := writer([]byte(url.String() + "\n"))
-		if err != nil {
-			log.Printf("Got error while writing URL: %v", err)
+		m, err := conn.Read()
+		if err == io.EOF {
+			c.logger.Info("Connection closed by exchange")
+			return
+		} else if err == protocol.InvalidMessage {
+			c.logger.Warn("Invalid message from exchange")
+			conn.Write(&protocol.Message{Type: protocol.Error, Error: err.Error()})
+			continue
+		} else if err != nil {
+			c.logger.Warn("Failed to read from exchange", logging.Error, err)
+			return
 		}
-		return err
-	}
 
-loop:
-	for {
-		select {
-		case url := <-c.wqueue:
-			if writeURL(url) != nil {
-				c.wqueue <- url
-				break loop
+		switch m.Type {
+		case protocol.Hello:
+			c.logger.Info("Joined exchange", "version", m.Version)
+			select {
+			case negotiated <- m.Version:
+			default:
 			}
-		case <-quit:
-			if err := writer([]byte("QUIT\n")); err == nil {
-				log.Printf("Sent quitting message")
-			} else {
-				log.Printf("Error occurred during sending quitting message: %v", err)
-				break loop
+		case protocol.URLs:
+			c.granted.Add(-int64(len(m.Links)))
+			select {
+			case <-quitting:
+				continue
+			default:
 			}
 
-		childLoop:
-			for {
+			for _, link := range m.Links {
+				if c.cqueue.Push(link) != CrawledLately {
+					continue
+				}
+				// it is done with already, which the exchange waits to hear
 				select {
-				case url := <-c.wqueue:
-					if writeURL(url) != nil {
-						c.wqueue <- url
-						break childLoop
-					}
-				case <-time.After(1 * time.Second):
-					// c.wqueue is empty
-					break childLoop
+				case c.dqueue <- link:
+				case <-quitting:
 				}
 			}
+			if conn.Framed() {
+				conn.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+			}
+		case protocol.Ack:
+			c.outbox.Ack(m.ID)
+			select {
+			case acked <- struct{}{}:
+			default:
+			}
+		case protocol.Quit:
+			c.logger.Info("Exchange is leaving")
+			return
+		case protocol.Heartbeat:
+		case protocol.Error:
+			c.logger.Warn("Got an error from exchange", logging.Error, m.Error)
+		default:
+			conn.Write(&protocol.Message{Type: protocol.Error, Error: "unknown message type " + m.Type})
+		}
+	}
+}
 
-			for _, url := range c.cqueue.Flush() {
-				if writeURL(url) != nil {
-					c.cqueue.Push(url)
-					break
-				}
+// writer sends discovered and finished URLs to the exchange until the reader
+// stops or ctx is done, in which case it leaves the exchange and waits for
+// it to acknowledge every URL. URLs which have not been acknowledged are
+// sent again on the next connection. The crawl queue is handed back over
+// the legacy protocol, and otherwise left to the exchange, which knows what
+// it has assigned to us. An exchange speaking flow control is granted
+// credits as the crawl queue drains.
+func (c *Crawler) writer(ctx context.Context, conn protocol.Conn, quitting chan<- struct{}, acked <-chan struct{}, negotiated <-chan int, rdone <-chan struct{}) {
+	writeURLs := func(links []*protocol.Link) error {
+		id := c.outbox.Add(links)
+		if err := conn.Write(&protocol.Message{Type: protocol.URLs, ID: id, Links: links}); err != nil {
+			c.logger.Warn("Failed to write URLs", logging.Error, err)
+			return err
+		}
+
+		if !conn.Framed() {
+			// nothing is acknowledged in the legacy protocol
+			c.outbox.Ack(id)
+		}
+		return nil
+	}
+
+	// writeAll sends links in batches, and keeps the ones which failed to
+	// be sent in c.outbox
+	writeAll := func(links []*protocol.Link) error {
+		for i := 0; i < len(links); i += maxBatchSize {
+			end := i + maxBatchSize
+			if end > len(links) {
+				end = len(links)
 			}
 
-			break loop
+			if err := writeURLs(links[i:end]); err != nil {
+				if end < len(links) {
+					c.outbox.Add(links[end:])
+				}
+				return err
+			}
 		}
+		return nil
 	}
 
-	quit <- true
-	log.Printf("Stopped writer")
-}
+	// batch takes as many URLs as are ready in queue after first
+	batch := func(first *protocol.Link, queue chan *protocol.Link) []*protocol.Link {
+		links := []*protocol.Link{first}
+		for len(links) < maxBatchSize {
+			select {
+			case link := <-queue:
+				links = append(links, link)
+			default:
+				return links
+			}
+		}
+		return links
+	}
 
-func (c *Crawler) Start() {
-	equit := make(chan bool, 2)
-	defer close(equit)
+	writeDone := func(links []*protocol.Link) error {
+		err := conn.Write(&protocol.Message{Type: protocol.Done, Links: links})
+		if err != nil {
+			c.logger.Warn("Failed to write finished URLs", logging.Error, err)
+		}
+		return err
+	}
 
-	dquit := make(chan bool, 1)
-	defer close(dquit)
+	flowControl := false
 
-	go c.joinExchange(equit)
-	go c.startDownloader(dquit)
+	// grant tops the credits up to the room left in the window, once there
+	// is enough of it to be worth a message
+	grant := func() error {
+		if !flowControl {
+			return nil
+		}
 
-loop:
-	for {
-		select {
-		case <-c.quit:
-			log.Printf("Stopping downloader")
-			dquit <- true
-			time.Sleep(1 * time.Second)
-			<-dquit
-
-			log.Printf("Leaving from exchange")
-			equit <- true
-			time.Sleep(1 * time.Second)
-			<-equit
-
-			break loop
-		case <-equit:
-			log.Printf("connection with exchange is down")
-			time.Sleep(1 * time.Second)
-			log.Printf("Rejoin to exchange")
-			go c.joinExchange(equit)
+		n := creditWindow - c.cqueue.Count() - int(c.granted.Load())
+		if n < creditWindow/4 {
+			return nil
+		}
+		c.granted.Add(int64(n))
+		err := conn.Write(&protocol.Message{Type: protocol.Credit, Credits: n})
+		if err != nil {
+			c.logger.Warn("Failed to write credits", logging.Error, err)
 		}
+		return err
 	}
 
-	c.quit <- true
-}
+	defer c.logger.Debug("Stopped writer")
 
-func (c *Crawler) Stop() {
-	c.quit <- true
-	time.Sleep(1 * time.Second)
-	<-c.quit
+	// the exchange uses the credits only if it speaks flow control
+	credits := creditWindow - c.cqueue.Count()
+	if credits < 1 {
+		credits = 1
+	}
+	c.granted.Store(int64(credits))
 
-	close(c.wqueue)
-	for url := range c.wqueue {
-		log.Printf("Flush residual URL: %s", url.String())
+	hello := &protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleCrawler, Crawler: c.id, Weight: c.weight, Credits: credits}
+	if err := conn.Write(hello); err != nil {
+		c.logger.Warn("Failed to write joining message", logging.Error, err)
+		return
 	}
 
-	for _, url := range c.cqueue.Flush() {
-		log.Printf("Flush residual URL: %s", url.String())
+	if links := c.outbox.Drain(); len(links) > 0 {
+		c.logger.Info("Resending unacknowledged URLs", "count", len(links))
+		if writeAll(links) != nil {
+			return
+		}
+	}
+
+	var heartbeats, refills <-chan time.Time
+	if conn.Framed() {
+		ticker := time.NewTicker(protocol.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+
+		refill := time.NewTicker(creditInterval)
+		defer refill.Stop()
+		refills = refill.C
+	}
+
+	for {
+		select {
+		case link := <-c.wqueue:
+			if writeURLs(batch(link, c.wqueue)) != nil {
+				return
+			}
+		case link := <-c.dqueue:
+			if writeDone(batch(link, c.dqueue)) != nil || grant() != nil {
+				return
+			}
+		case version := <-negotiated:
+			flowControl = version >= protocol.FlowControlVersion
+		case <-refills:
+			if grant() != nil {
+				return
+			}
+		case <-heartbeats:
+			if c.outbox.Overdue(protocol.AckTimeout) {
+				c.logger.Warn("Exchange timed out acknowledging URLs")
+				return
+			}
+			if err := conn.Write(&protocol.Message{Type: protocol.Heartbeat}); err != nil {
+				c.logger.Warn("Failed to write heartbeat", logging.Error, err)
+				return
+			}
+		case <-rdone:
+			return
+		case <-ctx.Done():
+			// the downloader has stopped, so c.wqueue and c.dqueue no longer
+			// grow
+			for len(c.dqueue) > 0 {
+				if writeDone(batch(<-c.dqueue, c.dqueue)) != nil {
+					return
+				}
+			}
+
+			close(quitting)
+			if err := conn.Write(&protocol.Message{Type: protocol.Quit}); err == nil {
+				c.logger.Info("Sent quitting message")
+			} else {
+				c.logger.Warn("Failed to write quitting message", logging.Error, err)
+				return
+			}
+
+			for len(c.wqueue) > 0 {
+				if writeURLs(batch(<-c.wqueue, c.wqueue)) != nil {
+					return
+				}
+			}
+
+			if conn.Framed() {
+				// the exchange routes the URLs it has assigned to us and
+				// we have not finished to another crawler
+				if links := c.cqueue.Flush(); len(links) > 0 {
+					c.logger.Info("Left queued URLs to exchange", "count", len(links))
+				}
+			} else if writeAll(c.cqueue.Flush()) != nil {
+				return
+			}
+
+			for c.outbox.Len() > 0 {
+				select {
+				case <-acked:
+				case <-rdone:
+					return
+				}
+			}
+			return
+		}
 	}
 }
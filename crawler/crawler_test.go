@@ -0,0 +1,399 @@
+package crawler
+
+import (
+	"../protocol"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/url"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeExchange accepts crawlers and records the messages they send. URLs
+// are acknowledged unless silent is set.
+type fakeExchange struct {
+	listener net.Listener
+	messages chan *protocol.Message
+	conns    []net.Conn
+	legacy   bool
+	silent   bool
+	sync.Mutex
+}
+
+func newFakeExchange(t *testing.T, legacy bool) *fakeExchange {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &fakeExchange{
+		listener: listener,
+		messages: make(chan *protocol.Message, 100),
+		conns:    make([]net.Conn, 0),
+		legacy:   legacy}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			e.Lock()
+			e.conns = append(e.conns, conn)
+			e.Unlock()
+
+			go func() {
+				var client protocol.Conn
+				if e.legacy {
+					client = protocol.NewLegacyConn(conn)
+				} else {
+					client = protocol.NewFramedConn(conn)
+				}
+
+				for {
+					m, err := client.Read()
+					if err != nil {
+						return
+					}
+					if m.Type == protocol.Heartbeat {
+						continue
+					}
+
+					e.Lock()
+					silent := e.silent
+					e.Unlock()
+					if m.Type == protocol.URLs && client.Framed() && !silent {
+						client.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+					}
+					e.messages <- m
+				}
+			}()
+		}
+	}()
+
+	return e
+}
+
+func (e *fakeExchange) address() Exchange {
+	addr := e.listener.Addr().(*net.TCPAddr)
+	return Exchange{IPAddr: addr.IP.String(), Port: addr.Port}
+}
+
+func (e *fakeExchange) expect(t *testing.T, expected string) *protocol.Message {
+	select {
+	case m := <-e.messages:
+		if !assert.Equal(t, m.Type, expected) {
+			t.FailNow()
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %s", expected)
+	}
+	return nil
+}
+
+// disconnect closes every connection from the exchange side.
+func (e *fakeExchange) disconnect() {
+	e.Lock()
+	defer e.Unlock()
+
+	for _, conn := range e.conns {
+		conn.Close()
+	}
+	e.conns = e.conns[:0]
+}
+
+func (e *fakeExchange) setSilent(silent bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.silent = silent
+}
+
+func (e *fakeExchange) close() {
+	e.listener.Close()
+	e.disconnect()
+}
+
+func stopCrawler(t *testing.T, c *Crawler) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !assert.Nil(t, c.Stop(ctx)) {
+		t.FailNow()
+	}
+}
+
+// waitGoroutines waits until the number of goroutines drops to n.
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines are leaked:\n%s", runtime.NumGoroutine()-n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCrawlerStartStop(t *testing.T) {
+	e := newFakeExchange(t, false)
+	defer e.close()
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 3; i++ {
+		if !assert.Nil(t, c.Start()) {
+			t.FailNow()
+		}
+		m := e.expect(t, protocol.Hello)
+		assert.Equal(t, m.Version, protocol.Version)
+		assert.Equal(t, m.Role, protocol.RoleCrawler)
+
+		u, _ := url.Parse("http://example.com/")
+		c.wqueue <- protocol.NewSeed(u)
+		m = e.expect(t, protocol.URLs)
+		if assert.Equal(t, len(m.Links), 1) {
+			assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+		}
+
+		stopCrawler(t, c)
+		e.expect(t, protocol.Quit)
+		e.disconnect()
+	}
+
+	waitGoroutines(t, goroutines)
+}
+
+func TestCrawlerLegacy(t *testing.T) {
+	e := newFakeExchange(t, true)
+	defer e.close()
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	c.SetLegacy(true)
+
+	if !assert.Nil(t, c.Start()) {
+		t.FailNow()
+	}
+	e.expect(t, protocol.Hello)
+
+	u, _ := url.Parse("http://example.com/")
+	c.wqueue <- protocol.NewSeed(u)
+	c.wqueue <- protocol.NewSeed(u)
+	e.expect(t, protocol.URLs)
+	e.expect(t, protocol.URLs)
+
+	stopCrawler(t, c)
+	e.expect(t, protocol.Quit)
+}
+
+func TestCrawlerDone(t *testing.T) {
+	e := newFakeExchange(t, false)
+	defer e.close()
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	if !assert.Nil(t, c.Start()) {
+		t.FailNow()
+	}
+	e.expect(t, protocol.Hello)
+
+	u, _ := url.Parse("http://example.com/")
+	c.dqueue <- protocol.NewSeed(u)
+	m := e.expect(t, protocol.Done)
+	if assert.Equal(t, len(m.Links), 1) {
+		assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+	}
+
+	stopCrawler(t, c)
+	e.expect(t, protocol.Quit)
+}
+
+func TestCrawlerDoneWithCrawledLately(t *testing.T) {
+	e := newFakeExchange(t, false)
+	defer e.close()
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	u, _ := url.Parse("http://example.com/")
+	c.cqueue.cache[SHA1Hash([]byte(u.String()))] = time.Now()
+	if !assert.Nil(t, c.Start()) {
+		t.FailNow()
+	}
+	e.expect(t, protocol.Hello)
+
+	// a URL crawled lately is not crawled again, but is finished with
+	e.Lock()
+	conn := protocol.NewFramedConn(e.conns[0])
+	e.Unlock()
+	conn.Write(&protocol.Message{Type: protocol.URLs, ID: 1, Links: []*protocol.Link{protocol.NewSeed(u)}})
+	for {
+		select {
+		case m := <-e.messages:
+			if m.Type != protocol.Done {
+				continue
+			}
+			if assert.Equal(t, len(m.Links), 1) {
+				assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for DONE")
+		}
+		break
+	}
+	assert.Equal(t, c.cqueue.Count(), 0)
+
+	stopCrawler(t, c)
+}
+
+func TestCrawlerResendUnacknowledged(t *testing.T) {
+	e := newFakeExchange(t, false)
+	defer e.close()
+	e.setSilent(true)
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	if !assert.Nil(t, c.Start()) {
+		t.FailNow()
+	}
+	e.expect(t, protocol.Hello)
+
+	u, _ := url.Parse("http://example.com/")
+	c.wqueue <- protocol.NewSeed(u)
+	m := e.expect(t, protocol.URLs)
+	assert.Equal(t, c.outbox.Len(), 1)
+
+	e.setSilent(false)
+	e.disconnect()
+	e.expect(t, protocol.Hello)
+	resent := e.expect(t, protocol.URLs)
+	assert.NotEqual(t, resent.ID, m.ID)
+	if assert.Equal(t, len(resent.Links), 1) {
+		assert.Equal(t, resent.Links[0].URL.String(), "http://example.com/")
+	}
+
+	stopCrawler(t, c)
+	e.expect(t, protocol.Quit)
+	assert.Equal(t, c.outbox.Len(), 0)
+}
+
+func TestCrawlerStartTwice(t *testing.T) {
+	e := newFakeExchange(t, false)
+	defer e.close()
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	assert.Equal(t, c.Stop(context.Background()), NotStarted)
+
+	if !assert.Nil(t, c.Start()) {
+		t.FailNow()
+	}
+	assert.Equal(t, c.Start(), AlreadyStarted)
+
+	stopCrawler(t, c)
+	assert.Equal(t, c.Stop(context.Background()), NotStarted)
+}
+
+func TestCrawlerStartWithoutExchange(t *testing.T) {
+	e := newFakeExchange(t, false)
+	e.close()
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	assert.NotNil(t, c.Start())
+	assert.Equal(t, c.Stop(context.Background()), NotStarted)
+}
+
+func TestCrawlerRejoin(t *testing.T) {
+	e := newFakeExchange(t, false)
+	defer e.close()
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	goroutines := runtime.NumGoroutine()
+
+	c.SetId("crawler")
+	if !assert.Nil(t, c.Start()) {
+		t.FailNow()
+	}
+	first := e.expect(t, protocol.Hello)
+	assert.Equal(t, first.Crawler, "crawler")
+
+	e.disconnect()
+	second := e.expect(t, protocol.Hello)
+	assert.Equal(t, second.Crawler, first.Crawler)
+
+	stopCrawler(t, c)
+	e.expect(t, protocol.Quit)
+	e.disconnect()
+
+	waitGoroutines(t, goroutines)
+}
+
+func TestCrawlerStopWhileExchangeIsDown(t *testing.T) {
+	e := newFakeExchange(t, false)
+
+	c := NewCrawler(e.address(), nil, "bucket", "test", "test")
+	goroutines := runtime.NumGoroutine()
+
+	if !assert.Nil(t, c.Start()) {
+		t.FailNow()
+	}
+	e.expect(t, protocol.Hello)
+
+	e.close()
+	stopCrawler(t, c)
+
+	waitGoroutines(t, goroutines)
+}
+
+func TestCrawlerCredits(t *testing.T) {
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+
+	client, server := net.Pipe()
+	exchange := protocol.NewFramedConn(server)
+	defer exchange.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.session(ctx, context.Background(), client)
+	}()
+
+	read := func(expected string) *protocol.Message {
+		for {
+			m, err := exchange.Read()
+			if !assert.Nil(t, err) {
+				t.FailNow()
+			}
+			if m.Type == expected {
+				return m
+			}
+		}
+	}
+
+	hello := read(protocol.Hello)
+	assert.Equal(t, hello.Credits, creditWindow)
+	exchange.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleExchange})
+
+	// the queue holds the URLs, so no more credits are granted
+	links := make([]*protocol.Link, 0)
+	for i := 0; i < creditWindow/2; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://host%d.example.com/", i))
+		links = append(links, protocol.NewSeed(u))
+	}
+	exchange.Write(&protocol.Message{Type: protocol.URLs, ID: 1, Links: links})
+	read(protocol.Ack)
+	assert.Equal(t, c.cqueue.Count(), creditWindow/2)
+
+	// and the room left as it drains is granted again
+	c.cqueue.Flush()
+	m := read(protocol.Credit)
+	assert.Equal(t, m.Credits, creditWindow/2)
+
+	cancel()
+	read(protocol.Quit)
+	exchange.Close()
+	<-done
+}
@@ -0,0 +1,82 @@
+package crawler
+
+import (
+	"../protocol"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// CrawlEvent is a fetch attempt, which the crawl log has a JSON line of.
+type CrawlEvent struct {
+	Time        time.Time `json:"time"`
+	URL         string    `json:"url"`
+	Host        string    `json:"host"`
+	CrawlerID   string    `json:"crawler_id"`
+	Status      int       `json:"status,omitempty"` // none when no response was received
+	Duration    float64   `json:"duration"`         // in seconds
+	Bytes       int       `json:"bytes"`
+	ContentType string    `json:"content_type,omitempty"`
+	FinalURL    string    `json:"final_url,omitempty"` // where redirects ended, if anywhere
+	Error       string    `json:"error,omitempty"`
+	ErrorKind   string    `json:"error_kind,omitempty"`
+	Retryable   bool      `json:"retryable,omitempty"`
+}
+
+// DeadLetter is a URL given up on after it failed every attempt, which can
+// be submitted again as a seed.
+type DeadLetter struct {
+	Time      time.Time      `json:"time"`
+	Link      *protocol.Link `json:"link"`
+	CrawlerID string         `json:"crawler_id"`
+	Attempts  int            `json:"attempts"`
+	Error     string         `json:"error"` // of the last attempt
+	ErrorKind string         `json:"error_kind"`
+}
+
+// CrawlLog records fetch attempts or dead letters for jobs downstream to
+// process.
+type CrawlLog struct {
+	w       io.Writer
+	closer  io.Closer // nil when the writer is not owned
+	encoder *json.Encoder
+	sync.Mutex
+}
+
+// NewCrawlLog returns a log which writes to w.
+func NewCrawlLog(w io.Writer) *CrawlLog {
+	return &CrawlLog{w: w, encoder: json.NewEncoder(w)}
+}
+
+// OpenCrawlLog returns a log which appends to the file of path.
+func OpenCrawlLog(path string) (*CrawlLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	l := NewCrawlLog(file)
+	l.closer = file
+	return l, nil
+}
+
+// Record writes event, a CrawlEvent or a DeadLetter, as a line.
+func (l *CrawlLog) Record(event interface{}) error {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.encoder.Encode(event)
+}
+
+// Close closes the file of the log, if it was opened by OpenCrawlLog.
+func (l *CrawlLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
@@ -0,0 +1,57 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestErrorKind(t *testing.T) {
+	assert.Equal(t, "", errorKind(nil))
+	assert.Equal(t, "timeout", errorKind(ERR_TIMEOUT))
+	assert.Equal(t, "robots", errorKind(ERR_INVALID_ROBOTS))
+	assert.Equal(t, "other", errorKind(errors.New("unexpected EOF")))
+}
+
+func TestCrawlLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	c.SetId("crawler-1")
+	c.SetCrawlLog(NewCrawlLog(&buf))
+
+	u, _ := url.Parse(server.URL + "/old")
+	if _, _, err := c.download(u); !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	var event CrawlEvent
+	decoder := json.NewDecoder(&buf)
+	if !assert.Nil(t, decoder.Decode(&event)) {
+		t.FailNow()
+	}
+	assert.Equal(t, server.URL+"/old", event.URL)
+	assert.Equal(t, u.Host, event.Host)
+	assert.Equal(t, "crawler-1", event.CrawlerID)
+	assert.Equal(t, 200, event.Status)
+	assert.Equal(t, len("<html></html>"), event.Bytes)
+	assert.Equal(t, "text/html", event.ContentType)
+	assert.Equal(t, server.URL+"/new", event.FinalURL)
+	assert.Equal(t, "", event.ErrorKind)
+	// one line per fetch attempt
+	assert.False(t, decoder.More())
+}
@@ -1,6 +1,7 @@
 package crawler
 
 import (
+	"../protocol"
 	"errors"
 	urlparse "net/url"
 	"sort"
@@ -9,21 +10,35 @@ import (
 )
 
 var (
-	QueueEmpty  = errors.New("Queue is empty")
-	QueueClosed = errors.New("Queue was closed")
+	QueueEmpty    = errors.New("Queue is empty")
+	QueueClosed   = errors.New("Queue was closed")
+	QueueNotDue   = errors.New("No queued link is due yet")
+	CrawledLately = errors.New("Link has been crawled lately")
 )
 
 type QueueElement struct {
 	key          string
-	url          *urlparse.URL
+	link         *protocol.Link
 	takeEffectAt time.Time
 	next         *QueueElement
 }
 
+// QueuedHost describes the links of a netloc in the crawl queue.
+type QueuedHost struct {
+	Host   string    `json:"host"`
+	NextAt time.Time `json:"next_at"` // when the next link may be crawled
+	Count  int       `json:"count"`
+	URLs   []string  `json:"urls,omitempty"`
+}
+
 type CrawlQueue struct {
 	queue          []*QueueElement
 	leatest        map[string]*QueueElement
 	size           int
+	count          int                      // links including the ones chained behind heads
+	delayed        []*QueueElement          // links to retry, in the order they are due
+	delays         map[string]time.Duration // between the links of netlocs which are not paced by duration
+	holds          map[string]time.Time     // until when netlocs are held back
 	cache          map[string]time.Time
 	cacheAliveTime time.Duration
 	duration       time.Duration
@@ -31,30 +46,56 @@ type CrawlQueue struct {
 	sync.Mutex
 }
 
+// queueKey returns the netloc which the links of url are paced by. Its http
+// and https URLs are paced together, since one server serves both.
+func queueKey(url *urlparse.URL) string {
+	return url.Host
+}
+
 func NewCrawlQueue(duration time.Duration) *CrawlQueue {
 	return &CrawlQueue{
 		queue:          make([]*QueueElement, 0, 50),
 		leatest:        make(map[string]*QueueElement),
 		cache:          make(map[string]time.Time),
+		delays:         make(map[string]time.Duration),
+		holds:          make(map[string]time.Time),
 		cacheAliveTime: 10 * time.Minute,
 		size:           0,
 		duration:       duration,
 		closed:         false}
 }
 
-func (q CrawlQueue) Len() int {
+func (q *CrawlQueue) Len() int {
 	return q.size
 }
 
-func (q CrawlQueue) Less(i int, j int) bool {
+// Hosts returns the number of netlocs which have links in the queue.
+func (q *CrawlQueue) Hosts() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.size
+}
+
+// Count returns the number of links in the queue.
+func (q *CrawlQueue) Count() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.count
+}
+
+func (q *CrawlQueue) Less(i int, j int) bool {
 	return q.queue[i].takeEffectAt.Before(q.queue[j].takeEffectAt)
 }
 
-func (q CrawlQueue) Swap(i int, j int) {
+func (q *CrawlQueue) Swap(i int, j int) {
 	q.queue[i], q.queue[j] = q.queue[j], q.queue[i]
 }
 
-func (q *CrawlQueue) Push(url *urlparse.URL) error {
+// Push queues link, and fails with CrawledLately when it has been popped
+// within the lifetime of the cache.
+func (q *CrawlQueue) Push(link *protocol.Link) error {
 	q.Lock()
 	defer func() {
 		q.Unlock()
@@ -64,22 +105,151 @@ func (q *CrawlQueue) Push(url *urlparse.URL) error {
 		return QueueClosed
 	}
 
+	url := link.URL
 	if _, exists := q.cache[SHA1Hash([]byte(url.String()))]; exists {
-		return nil
+		return CrawledLately
 	}
 
-	element := &QueueElement{url.Scheme + "://" + url.Host, url, time.Now(), nil}
-	if leatest, exists := q.leatest[element.key]; exists {
-		leatest.next = element
+	q.add(&QueueElement{queueKey(url), link, time.Now(), nil})
+	return nil
+}
+
+// Retry puts link back in the queue at, when it joins the links of its
+// netloc. Links are retried even if they were crawled lately.
+func (q *CrawlQueue) Retry(link *protocol.Link, at time.Time) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return QueueClosed
+	}
+
+	url := link.URL
+	element := &QueueElement{queueKey(url), link, at, nil}
+	i := sort.Search(len(q.delayed), func(i int) bool {
+		return q.delayed[i].takeEffectAt.After(at)
+	})
+	q.delayed = append(q.delayed, nil)
+	copy(q.delayed[i+1:], q.delayed[i:])
+	q.delayed[i] = element
+	return nil
+}
+
+// Delayed returns the number of links waiting to be retried.
+func (q *CrawlQueue) Delayed() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.delayed)
+}
+
+// SetDelay sets the delay between the links of netloc key, which is the
+// duration of the queue when d is 0.
+func (q *CrawlQueue) SetDelay(key string, d time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+
+	if d <= 0 || d == q.duration {
+		delete(q.delays, key)
 	} else {
+		q.delays[key] = d
+	}
+}
+
+// Hold keeps the links of netloc key from being taken until until, including
+// the ones pushed or retried meanwhile.
+func (q *CrawlQueue) Hold(key string, until time.Time) {
+	q.Lock()
+	defer q.Unlock()
+
+	if !until.After(time.Now()) {
+		delete(q.holds, key)
+		return
+	}
+	q.holds[key] = until
+
+	for i := 0; i < q.size; i++ {
+		if q.queue[i].key == key && q.queue[i].takeEffectAt.Before(until) {
+			q.queue[i].takeEffectAt = until
+			sort.Sort(q)
+			break
+		}
+	}
+}
+
+// delay returns the delay between the links of netloc key.
+func (q *CrawlQueue) delay(key string) time.Duration {
+	if d, exists := q.delays[key]; exists {
+		return d
+	}
+	return q.duration
+}
+
+// notBefore returns at, or the end of the hold of key if it is later.
+func (q *CrawlQueue) notBefore(key string, at time.Time) time.Time {
+	if until, exists := q.holds[key]; exists && until.After(at) {
+		return until
+	}
+	return at
+}
+
+// add puts element at the end of the links of its netloc, or among them by
+// priority.
+func (q *CrawlQueue) add(element *QueueElement) {
+	link := element.link
+	q.count++
+	if leatest, exists := q.leatest[element.key]; !exists {
+		element.takeEffectAt = q.notBefore(element.key, element.takeEffectAt)
 		q.push(element)
+	} else if leatest.link.Priority >= link.Priority {
+		leatest.next = element
+	} else {
+		q.insert(element)
+		return
 	}
 
 	q.leatest[element.key] = element
-	return nil
 }
 
-func (q *CrawlQueue) Pop() (url *urlparse.URL, err error) {
+// releaseDelayed adds the links due to be retried by now.
+func (q *CrawlQueue) releaseDelayed(now time.Time) {
+	n := 0
+	for n < len(q.delayed) && !q.delayed[n].takeEffectAt.After(now) {
+		element := q.delayed[n]
+		element.takeEffectAt = now
+		q.add(element)
+		n++
+	}
+	q.delayed = q.delayed[n:]
+}
+
+// insert puts elem into the chain of its netloc after the elements which
+// have the same or higher priority. The head of the chain is already
+// scheduled and is never displaced.
+func (q *CrawlQueue) insert(elem *QueueElement) {
+	var prev *QueueElement
+	for i := 0; i < q.size; i++ {
+		if q.queue[i].key == elem.key {
+			prev = q.queue[i]
+			break
+		}
+	}
+
+	for prev.next != nil && prev.next.link.Priority >= elem.link.Priority {
+		prev = prev.next
+	}
+
+	elem.next = prev.next
+	prev.next = elem
+	if elem.next == nil {
+		q.leatest[elem.key] = elem
+	}
+}
+
+// Pop takes the link due first, and waits until it is due. A link held back
+// or delayed longer than the duration of the queue is not waited for, but
+// QueueNotDue is returned.
+func (q *CrawlQueue) Pop() (link *protocol.Link, err error) {
 	var element *QueueElement
 
 	q.Lock()
@@ -92,8 +262,11 @@ func (q *CrawlQueue) Pop() (url *urlparse.URL, err error) {
 		}
 	}()
 
+	q.releaseDelayed(time.Now())
 	if q.size == 0 {
-		return &urlparse.URL{}, QueueEmpty
+		return nil, QueueEmpty
+	} else if q.queue[0].takeEffectAt.Sub(time.Now()) > q.duration {
+		return nil, QueueNotDue
 	}
 
 	element = q.queue[0]
@@ -103,37 +276,104 @@ func (q *CrawlQueue) Pop() (url *urlparse.URL, err error) {
 		q.queue = q.queue[1:]
 	}
 	q.size--
+	q.count--
 
 	if next := element.next; next == nil {
 		delete(q.leatest, element.key)
 	} else {
+		delay := q.delay(element.key)
 		if now := time.Now(); element.takeEffectAt.Before(now) {
-			next.takeEffectAt = now.Add(q.duration)
+			next.takeEffectAt = now.Add(delay)
 		} else {
-			next.takeEffectAt = element.takeEffectAt.Add(q.duration)
+			next.takeEffectAt = element.takeEffectAt.Add(delay)
 		}
+		next.takeEffectAt = q.notBefore(next.key, next.takeEffectAt)
 		q.push(next)
 	}
 
 	element.next = nil
-	q.cache[SHA1Hash([]byte(element.url.String()))] = time.Now().Add(q.cacheAliveTime)
+	q.cache[SHA1Hash([]byte(element.link.URL.String()))] = time.Now().Add(q.cacheAliveTime)
 	q.cleanHistory()
 
-	return element.url, nil
+	return element.link, nil
+}
+
+// Flush empties the queue and returns the URLs which were in it.
+func (q *CrawlQueue) Flush() []*protocol.Link {
+	q.Lock()
+	defer q.Unlock()
+
+	links := make([]*protocol.Link, 0)
+	for i := 0; i < q.size; i++ {
+		for elem := q.queue[i]; elem != nil; elem = elem.next {
+			links = append(links, elem.link)
+		}
+	}
+	for _, elem := range q.delayed {
+		links = append(links, elem.link)
+	}
+
+	q.queue = q.queue[:0]
+	q.delayed = nil
+	q.leatest = make(map[string]*QueueElement)
+	q.size = 0
+	q.count = 0
+	return links
 }
 
-func (q *CrawlQueue) Flush() []*urlparse.URL {
+// Snapshot returns the netlocs in the queue in the order they are crawled,
+// with their URLs when withURLs is true.
+func (q *CrawlQueue) Snapshot(withURLs bool) []QueuedHost {
 	q.Lock()
 	defer q.Unlock()
 
-	urls := make([]*urlparse.URL, 0)
+	hosts := make([]QueuedHost, q.size)
 	for i := 0; i < q.size; i++ {
+		hosts[i] = QueuedHost{Host: q.queue[i].key, NextAt: q.queue[i].takeEffectAt}
 		for elem := q.queue[i]; elem != nil; elem = elem.next {
-			urls = append(urls, elem.url)
+			hosts[i].Count++
+			if withURLs {
+				hosts[i].URLs = append(hosts[i].URLs, elem.link.URL.String())
+			}
 		}
 	}
+	return hosts
+}
+
+// Purge removes the links of host, over any scheme, and returns them with
+// the ones waiting to be retried.
+func (q *CrawlQueue) Purge(host string) []*protocol.Link {
+	q.Lock()
+	defer q.Unlock()
 
-	return urls
+	links := make([]*protocol.Link, 0)
+	kept := q.queue[:0]
+	for i := 0; i < q.size; i++ {
+		if q.queue[i].link.URL.Host != host {
+			kept = append(kept, q.queue[i])
+			continue
+		}
+
+		for elem := q.queue[i]; elem != nil; elem = elem.next {
+			links = append(links, elem.link)
+		}
+		delete(q.leatest, q.queue[i].key)
+	}
+
+	q.queue = kept
+	q.size = len(kept)
+	q.count -= len(links)
+
+	delayed := q.delayed[:0]
+	for _, elem := range q.delayed {
+		if elem.link.URL.Host == host {
+			links = append(links, elem.link)
+		} else {
+			delayed = append(delayed, elem)
+		}
+	}
+	q.delayed = delayed
+	return links
 }
 
 func (q *CrawlQueue) Close() {
@@ -158,4 +398,9 @@ func (q *CrawlQueue) cleanHistory() {
 			delete(q.cache, url)
 		}
 	}
+	for key, until := range q.holds {
+		if until.Before(now) {
+			delete(q.holds, key)
+		}
+	}
 }
@@ -1,6 +1,7 @@
 package crawler
 
 import (
+	"../protocol"
 	"github.com/stretchr/testify/assert"
 	"net/url"
 	"strconv"
@@ -15,16 +16,16 @@ func TestCrawlQueuePush(t *testing.T) {
 		t.FailNow()
 	}
 
-	if !assert.Nil(t, q.Push(u)) || !assert.Equal(t, q.size, 1) {
+	if !assert.Nil(t, q.Push(protocol.NewSeed(u))) || !assert.Equal(t, q.size, 1) {
 		t.FailNow()
 	}
 
-	if got, err := q.Pop(); !assert.Nil(t, err) || !assert.Equal(t, got, u) {
+	if got, err := q.Pop(); !assert.Nil(t, err) || !assert.Equal(t, got.URL, u) {
 		t.FailNow()
 	}
 
 	q.Close()
-	if !assert.Equal(t, q.Push(u), QueueClosed) {
+	if !assert.Equal(t, q.Push(protocol.NewSeed(u)), QueueClosed) {
 		t.FailNow()
 	}
 }
@@ -34,14 +35,14 @@ func TestCrawlQueuePop(t *testing.T) {
 
 	for i := 0; i < 10; i++ {
 		u1, err := url.Parse("http://example.com/" + strconv.Itoa(i))
-		if !assert.Nil(t, err) || !assert.Nil(t, q.Push(u1)) || !assert.Equal(t, q.size, 1) {
+		if !assert.Nil(t, err) || !assert.Nil(t, q.Push(protocol.NewSeed(u1))) || !assert.Equal(t, q.size, 1) {
 			t.FailNow()
 		}
 	}
 
 	for i := 0; i < 15; i++ {
-		u2, err := url.Parse("https://example.com/" + strconv.Itoa(i))
-		if !assert.Nil(t, err) || !assert.Nil(t, q.Push(u2)) || !assert.Equal(t, q.size, 2) {
+		u2, err := url.Parse("http://example.org/" + strconv.Itoa(i))
+		if !assert.Nil(t, err) || !assert.Nil(t, q.Push(protocol.NewSeed(u2))) || !assert.Equal(t, q.size, 2) {
 			t.FailNow()
 		}
 	}
@@ -55,7 +56,7 @@ func TestCrawlQueuePop(t *testing.T) {
 		if i%2 == 0 {
 			u, err = url.Parse("http://example.com/" + strconv.Itoa(i/2))
 		} else {
-			u, err = url.Parse("https://example.com/" + strconv.Itoa(i/2))
+			u, err = url.Parse("http://example.org/" + strconv.Itoa(i/2))
 		}
 
 		if !assert.Nil(t, err) {
@@ -63,32 +64,32 @@ func TestCrawlQueuePop(t *testing.T) {
 		}
 
 		got, err := q.Pop()
-		if !assert.Nil(t, err) || !assert.Equal(t, got, u) {
+		if !assert.Nil(t, err) || !assert.Equal(t, got.URL, u) {
 			t.FailNow()
 		}
 	}
 
 	for i := 10; i < 14; i++ {
-		u, err := url.Parse("https://example.com/" + strconv.Itoa(i))
+		u, err := url.Parse("http://example.org/" + strconv.Itoa(i))
 		if !assert.Nil(t, err) {
 			t.FailNow()
 		}
 
 		got, err := q.Pop()
-		if !assert.Nil(t, err) || !assert.Equal(t, got, u) {
+		if !assert.Nil(t, err) || !assert.Equal(t, got.URL, u) {
 			t.FailNow()
 		}
 	}
 
-	uchan := make(chan *url.URL)
+	uchan := make(chan *protocol.Link)
 	go func() {
-		u, err := url.Parse("https://example.com/" + strconv.Itoa(14))
+		u, err := url.Parse("http://example.org/" + strconv.Itoa(14))
 		if !assert.Nil(t, err) {
 			t.FailNow()
 		}
 
 		got, err := q.Pop()
-		if !assert.Nil(t, err) || !assert.Equal(t, got, u) || !assert.Equal(t, q.size, 0) {
+		if !assert.Nil(t, err) || !assert.Equal(t, got.URL, u) || !assert.Equal(t, q.size, 0) {
 			t.FailNow()
 		}
 
@@ -110,34 +111,139 @@ func TestCrawlQueueFlush(t *testing.T) {
 
 	for i := 0; i < 10; i++ {
 		u1, err := url.Parse("http://example.com/" + strconv.Itoa(i))
-		if !assert.Nil(t, err) || !assert.Nil(t, q.Push(u1)) || !assert.Equal(t, q.size, 1) {
+		if !assert.Nil(t, err) || !assert.Nil(t, q.Push(protocol.NewSeed(u1))) || !assert.Equal(t, q.size, 1) {
 			t.FailNow()
 		}
 	}
 
 	for i := 0; i < 15; i++ {
-		u2, err := url.Parse("https://example.com/" + strconv.Itoa(i))
-		if !assert.Nil(t, err) || !assert.Nil(t, q.Push(u2)) || !assert.Equal(t, q.size, 2) {
+		u2, err := url.Parse("http://example.org/" + strconv.Itoa(i))
+		if !assert.Nil(t, err) || !assert.Nil(t, q.Push(protocol.NewSeed(u2))) || !assert.Equal(t, q.size, 2) {
 			t.FailNow()
 		}
 	}
 
+	assert.Equal(t, q.Count(), 25)
 	got := q.Flush()
 	if !assert.Equal(t, len(got), 25) {
 		t.FailNow()
 	}
+	assert.Equal(t, q.Count(), 0)
 
 	for i := 0; i < 10; i++ {
 		u, err := url.Parse("http://example.com/" + strconv.Itoa(i))
-		if !assert.Nil(t, err) || !assert.Equal(t, got[i], u) {
+		if !assert.Nil(t, err) || !assert.Equal(t, got[i].URL, u) {
 			t.FailNow()
 		}
 	}
 
 	for i := 0; i < 15; i++ {
-		u, err := url.Parse("https://example.com/" + strconv.Itoa(i))
-		if !assert.Nil(t, err) || !assert.Equal(t, got[i+10], u) {
+		u, err := url.Parse("http://example.org/" + strconv.Itoa(i))
+		if !assert.Nil(t, err) || !assert.Equal(t, got[i+10].URL, u) {
 			t.FailNow()
 		}
 	}
 }
+
+func TestCrawlQueuePushPriority(t *testing.T) {
+	q := NewCrawlQueue(1 * time.Millisecond)
+
+	push := func(path string, priority int) {
+		u, _ := url.Parse("http://example.com/" + path)
+		link := protocol.NewSeed(u)
+		link.Priority = priority
+		if !assert.Nil(t, q.Push(link)) {
+			t.FailNow()
+		}
+	}
+
+	push("head", 0)
+	push("low1", 0)
+	push("low2", 0)
+	push("high", 10)
+	push("middle", 5)
+	push("low3", 0)
+
+	expected := []string{"head", "high", "middle", "low1", "low2", "low3"}
+	for _, path := range expected {
+		got, err := q.Pop()
+		if !assert.Nil(t, err) || !assert.Equal(t, got.URL.Path, "/"+path) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestCrawlQueueSnapshotPurge(t *testing.T) {
+	q := NewCrawlQueue(1 * time.Second)
+	for _, rawurl := range []string{"http://a.example.com/1", "http://b.example.com/", "http://a.example.com/2", "https://a.example.com/"} {
+		u, _ := url.Parse(rawurl)
+		if !assert.Nil(t, q.Push(protocol.NewSeed(u))) {
+			t.FailNow()
+		}
+	}
+
+	// every scheme of a host is paced together
+	hosts := q.Snapshot(false)
+	if assert.Equal(t, len(hosts), 2) {
+		assert.Equal(t, hosts[0].Host, "a.example.com")
+		assert.Equal(t, hosts[0].Count, 3)
+		assert.Nil(t, hosts[0].URLs)
+	}
+	hosts = q.Snapshot(true)
+	assert.Equal(t, hosts[0].URLs, []string{"http://a.example.com/1", "http://a.example.com/2", "https://a.example.com/"})
+
+	// every scheme of the host is purged
+	assert.Equal(t, len(q.Purge("a.example.com")), 3)
+	assert.Equal(t, q.Count(), 1)
+	assert.Equal(t, q.Hosts(), 1)
+	assert.Equal(t, len(q.Purge("a.example.com")), 0)
+
+	// a purged host is queued afresh
+	u, _ := url.Parse("http://a.example.com/3")
+	assert.Nil(t, q.Push(protocol.NewSeed(u)))
+	assert.Equal(t, q.Count(), 2)
+	got, err := q.Pop()
+	if assert.Nil(t, err) {
+		assert.Equal(t, got.URL.String(), "http://b.example.com/")
+	}
+}
+
+func TestCrawlQueueRetry(t *testing.T) {
+	q := NewCrawlQueue(10 * time.Millisecond)
+	u, _ := url.Parse("http://example.com/")
+	if got, err := func() (*protocol.Link, error) {
+		q.Push(protocol.NewSeed(u))
+		return q.Pop()
+	}(); !assert.Nil(t, err) || !assert.Equal(t, got.URL, u) {
+		t.FailNow()
+	}
+
+	// a link crawled lately is not pushed again, but is retried
+	link := protocol.NewSeed(u)
+	assert.Equal(t, q.Push(link), CrawledLately)
+	assert.Equal(t, q.Count(), 0)
+	assert.Nil(t, q.Retry(link, time.Now().Add(50*time.Millisecond)))
+	assert.Equal(t, q.Delayed(), 1)
+	assert.Equal(t, q.Count(), 0)
+
+	_, err := q.Pop()
+	assert.Equal(t, err, QueueEmpty)
+	time.Sleep(60 * time.Millisecond)
+	got, err := q.Pop()
+	if assert.Nil(t, err) {
+		assert.True(t, got == link)
+	}
+	assert.Equal(t, q.Delayed(), 0)
+
+	// links waiting to be retried are flushed and purged
+	v, _ := url.Parse("http://other.example.com/")
+	assert.Nil(t, q.Retry(link, time.Now().Add(time.Hour)))
+	assert.Nil(t, q.Retry(protocol.NewSeed(v), time.Now().Add(time.Minute)))
+	assert.Equal(t, len(q.Purge("other.example.com")), 1)
+	assert.Equal(t, q.Delayed(), 1)
+	assert.Equal(t, q.Flush(), []*protocol.Link{link})
+	assert.Equal(t, q.Delayed(), 0)
+
+	q.Close()
+	assert.Equal(t, q.Retry(link, time.Now()), QueueClosed)
+}
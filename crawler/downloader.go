@@ -1,11 +1,15 @@
 package crawler
 
 import (
+	"../logging"
+	"../protocol"
 	"bytes"
 	"code.google.com/p/go.net/html"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/temoto/robotstxt-go"
 	"io/ioutil"
-	"log"
 	"net/http"
 	urlparse "net/url"
 	"path"
@@ -13,60 +17,181 @@ import (
 	"time"
 )
 
-func (c *Crawler) startDownloader(quit chan bool) {
-	downloader := func(url *urlparse.URL) {
+// How long a server may take to answer a request, up to the headers of the
+// response. The body is read within the body timeout of the crawler.
+var fetchTimeout = 2 * time.Second
+
+const DefaultBodyTimeout = 30 * time.Second
+
+// startDownloader crawls URLs from the crawl queue until ctx is done. The
+// download in progress at that time is completed. URLs found and finished are
+// sent to the exchange unless abort is done. URLs put back in the queue to be
+// retried are not finished yet.
+func (c *Crawler) startDownloader(ctx context.Context, abort context.Context) {
+	downloader := func(link *protocol.Link) (retrying bool) {
+		url := link.URL
 		urlString := url.String()
 
-		if _, err := c.pagestore.IsKnownURL(url); err != nil {
-			log.Printf("%s has skipped because an error occurred: %v", urlString, err)
+		logger := c.logger.With(logging.URL, urlString, logging.Host, url.Host)
+
+		if c.blocked.Contains(url.Host) {
+			logger.Info("Skipped URL of blocked host")
+		} else if reason := c.traps.Check(url); reason != "" {
+			logger.Info("Skipped URL which looks like a spider trap", "reason", reason)
+		} else if _, err := c.pagestore.IsKnownURL(url); err != nil {
+			logger.Error("Skipped URL which could not be looked up", logging.Error, err, logging.ErrorKind, errorKind(err))
+			c.failures.Add(urlString, err)
+		} else if allowed, err := c.checkRobotsPolicy(url); err != nil {
+			logger.Info("Put off URL because robots.txt failed to load", logging.ErrorKind, errorKind(err))
+			return c.fail(link, err)
 		} else {
-			if c.checkRobotsPolicy(url) {
+			if allowed {
+				finished := c.inflight.Start(urlString)
 				page, redirectChain, err := c.download(url)
+				finished()
 				if err != nil {
-					log.Println(err)
+					return c.fail(link, err)
 				} else {
-					if urls, err := c.detectURLs(page); err == nil {
-						for _, url := range urls {
-							c.wqueue <- url
+					c.traps.Observe(url, page.Body)
+					if links, err := c.detectURLs(link, page); err == nil {
+						for _, child := range links {
+							if c.withinLimits(child) && child.InSeedScope() && c.scope.Allows(child.URL) && c.traps.Check(child.URL) == "" {
+								select {
+								case c.wqueue <- child:
+								case <-abort.Done():
+									c.logger.Warn("Flushed residual URL", logging.URL, child.URL.String())
+								}
+							}
 						}
 					}
 
-					c.pagestore.Save(page)
+					if err := c.pagestore.Save(page); err != nil {
+						c.failures.Add(urlString, err)
+					}
 					for _, page := range redirectChain {
 						c.pagestore.Save(page)
 					}
 				}
 			} else {
-				log.Printf("%s has skipped because denied crawling by robots.txt", url.String())
+				robotsDenied.Inc()
+				logger.Info("Skipped URL denied by robots.txt")
 			}
 		}
+		return false
 	}
 
-	urlchan := make(chan *urlparse.URL, 1)
-	go func() {
-		for {
-			url, err := c.cqueue.Pop()
-			if err == QueueEmpty {
-				time.Sleep(1 * time.Second)
-			} else {
-				urlchan <- url
+	for ctx.Err() == nil {
+		if c.paused.Load() {
+			select {
+			case <-ctx.Done():
+			case <-c.resumed:
 			}
+			continue
 		}
-	}()
 
-loop:
-	for {
-		select {
-		case <-quit:
-			break loop
-		case url := <-urlchan:
-			downloader(url)
+		link, err := c.cqueue.Pop()
+		if err == QueueEmpty || err == QueueNotDue {
+			select {
+			case <-ctx.Done():
+			case <-time.After(1 * time.Second):
+			}
 			continue
 		}
+
+		if downloader(link) {
+			continue
+		}
+
+		select {
+		case c.dqueue <- link:
+		case <-abort.Done():
+		}
+	}
+
+	c.logger.Info("Stopped downloader")
+}
+
+// fail records that downloading link failed with err, and puts it back in
+// the crawl queue if it may pass later. It reports whether link is retried.
+// A URL which fails every attempt is given up on as a dead letter.
+func (c *Crawler) fail(link *protocol.Link, err error) bool {
+	url := link.URL
+	attempts, retried := c.attempts.Take(url.String())
+	page, lookupErr := c.pagestore.Get(url.String())
+	if !retried && lookupErr == nil && page != nil {
+		// it may have been retried by this or another crawler before the
+		// exchange routed it here again
+		attempts = page.State.recentAttempts(time.Now().Add(-2 * c.retryPolicy.MaxDelay))
 	}
+	attempts++
 
-	quit <- true
-	log.Printf("Stopped downloader")
+	c.failures.Add(url.String(), err)
+	if lookupErr == nil {
+		c.saveFailure(url, page, err, attempts)
+	}
+	return c.retry(link, err, attempts)
+}
+
+// retry puts link back in the crawl queue after it failed attempts in a row,
+// with err last, unless err is permanent or it has been attempted enough.
+func (c *Crawler) retry(link *protocol.Link, err error, attempts int) bool {
+	if !Retryable(err) {
+		return false
+	} else if attempts >= c.retryPolicy.MaxAttempts {
+		c.deadLetter(link, err, attempts)
+		return false
+	}
+
+	var retryAfter time.Duration
+	var e *Error
+	if errors.As(err, &e) {
+		retryAfter = e.RetryAfter
+	}
+	delay := c.retryPolicy.Delay(attempts, retryAfter)
+	c.attempts.Set(link.URL.String(), attempts)
+	if err := c.cqueue.Retry(link, time.Now().Add(delay)); err != nil {
+		c.attempts.Take(link.URL.String())
+		return false
+	}
+
+	retriesScheduled.Inc()
+	c.logger.Info("Retrying URL", logging.URL, link.URL.String(), logging.Host, link.URL.Host, "attempts", attempts,
+		"delay", delay.Seconds(), logging.ErrorKind, errorKind(err))
+	return true
+}
+
+// deadLetter gives up on link, which failed attempts times with err last.
+func (c *Crawler) deadLetter(link *protocol.Link, err error, attempts int) {
+	deadLetters.Inc()
+	c.logger.Warn("Gave up on URL", logging.URL, link.URL.String(), logging.Host, link.URL.Host, "attempts", attempts,
+		logging.Error, err, logging.ErrorKind, errorKind(err))
+
+	if c.deadLetterLog == nil {
+		return
+	}
+	letter := &DeadLetter{
+		Time:      time.Now().UTC(),
+		Link:      link,
+		CrawlerID: c.id,
+		Attempts:  attempts,
+		Error:     err.Error(),
+		ErrorKind: errorKind(err)}
+	if err := c.deadLetterLog.Record(letter); err != nil {
+		c.logger.Error("Failed to write dead letter log", logging.Error, err)
+	}
+}
+
+// saveFailure records on page, the stored page of url if there is one, that
+// downloading it failed with err after attempts in a row.
+func (c *Crawler) saveFailure(url *urlparse.URL, page *Page, err error, attempts int) {
+	if page == nil {
+		page = NewPage(url.String(), 0, "", []byte{}, "", time.Time{})
+	}
+
+	page.State.Fail(err, attempts, time.Now().UTC())
+	if err := c.pagestore.Save(page); err != nil {
+		c.failures.Add(url.String(), err)
+	}
 }
 
 func (c *Crawler) download(url *urlparse.URL) (p *Page, redirectChain []*Page, err error) {
@@ -93,31 +218,49 @@ func (c *Crawler) download(url *urlparse.URL) (p *Page, redirectChain []*Page, e
 	}
 	request.Header.Add("User-Agent", c.userAgent)
 
-	var response *http.Response
-	done := make(chan bool, 1)
-	go func() {
-		response, err = client.Do(request)
-		if err != nil {
-			log.Println(err)
-			err = ERR_DOWNLOAD
-			return
+	// the headers are awaited within fetchTimeout, and the body is read
+	// within the body timeout
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	request = request.WithContext(ctx)
+	expire := func() {
+		cancel(context.DeadlineExceeded)
+	}
+	failed := func(cause error) error {
+		if context.Cause(ctx) == context.DeadlineExceeded {
+			cause = context.DeadlineExceeded
 		}
-		done <- true
+		return downloadError(cause)
+	}
+	timer := time.AfterFunc(fetchTimeout, expire)
+
+	start := time.Now()
+	status := 0
+	defer func() {
+		c.recordFetch(url, start, status, p, err)
 	}()
 
-	select {
-	case <-time.After(2 * time.Second):
-		err = ERR_TIMEOUT
+	response, cause := client.Do(request)
+	timer.Stop()
+	if cause != nil {
+		err = failed(cause)
+		return
+	}
+	defer response.Body.Close()
+	if c.bodyTimeout > 0 {
+		timer = time.AfterFunc(c.bodyTimeout, expire)
+		defer timer.Stop()
+	}
+	status = response.StatusCode
+	if e := statusError(status, parseRetryAfter(response.Header.Get("Retry-After"), time.Now())); e != nil {
+		err = e
 		return
-	case <-done:
 	}
 
 	body := []byte{}
 	if response.StatusCode == http.StatusOK {
-		defer response.Body.Close()
-		if body, err = ioutil.ReadAll(response.Body); err != nil {
-			log.Println(err)
-			err = ERR_INTERNAL
+		if body, cause = ioutil.ReadAll(response.Body); cause != nil {
+			err = failed(cause)
 			return
 		}
 	}
@@ -126,7 +269,111 @@ func (c *Crawler) download(url *urlparse.URL) (p *Page, redirectChain []*Page, e
 	return
 }
 
-func (c *Crawler) checkRobotsPolicy(url *urlparse.URL) bool {
+// recordFetch counts, logs and records in the crawl log the fetch of url
+// which started at start and ended with status and p, or with err.
+func (c *Crawler) recordFetch(url *urlparse.URL, start time.Time, status int, p *Page, err error) {
+	duration := time.Since(start)
+	fetchDuration.Observe(duration.Seconds())
+	pagesFetched.WithLabelValues(statusLabel(status, err)).Inc()
+	c.observeHost(url, duration, status, err)
+
+	event := &CrawlEvent{
+		Time:      start.UTC(),
+		URL:       url.String(),
+		Host:      url.Host,
+		CrawlerID: c.id,
+		Status:    status,
+		Duration:  duration.Seconds(),
+		ErrorKind: errorKind(err),
+		Retryable: Retryable(err)}
+	if p != nil {
+		bytesDownloaded.Add(float64(len(p.Body)))
+		event.Bytes = len(p.Body)
+		event.ContentType = p.ContentType
+		if p.URL != event.URL {
+			event.FinalURL = p.URL
+		}
+	}
+	if err != nil {
+		event.Error = err.Error()
+		c.logger.Warn("Failed to fetch", logging.URL, event.URL, logging.Host, event.Host, logging.Status, status,
+			logging.Duration, event.Duration, logging.Error, err, logging.ErrorKind, event.ErrorKind)
+	} else {
+		c.logger.Debug("Fetched", logging.URL, event.URL, logging.Host, event.Host, logging.Status, status,
+			logging.Duration, event.Duration)
+	}
+
+	if c.crawlLog != nil {
+		if err := c.crawlLog.Record(event); err != nil {
+			c.logger.Error("Failed to write crawl log", logging.Error, err)
+		}
+	}
+}
+
+// observeHost adjusts the delay and the circuit of the host of url after a
+// download which lasted took and ended with status or err.
+func (c *Crawler) observeHost(url *urlparse.URL, took time.Duration, status int, err error) {
+	var retryAfter time.Duration
+	var e *Error
+	if errors.As(err, &e) {
+		retryAfter = e.RetryAfter
+	}
+	failed := status >= http.StatusInternalServerError || (err != nil && Classify(err) != ClassRedirect)
+
+	key := queueKey(url)
+	change := c.health.Observe(key, took, failed, retryAfter)
+	c.cqueue.SetDelay(key, change.delay)
+	if !change.holdUntil.IsZero() {
+		c.cqueue.Hold(key, change.holdUntil)
+	}
+
+	switch {
+	case change.to == CircuitOpen && change.from != CircuitOpen:
+		circuitsOpened.Inc()
+		c.logger.Warn("Opened circuit of host", logging.Host, key, "from", change.from,
+			"until", change.holdUntil, logging.Error, err, logging.ErrorKind, errorKind(err))
+	case change.to == CircuitClosed && change.from != CircuitClosed:
+		c.logger.Info("Closed circuit of host", logging.Host, key, "delay", change.delay.Seconds())
+	case !change.holdUntil.IsZero():
+		c.logger.Info("Held back host", logging.Host, key, "until", change.holdUntil)
+	}
+}
+
+// checkRobotsPolicy reports whether robots.txt allows url. It fails with
+// the error robots.txt failed to load with, until it is loaded again a while
+// later, since no URL of the host may be crawled meanwhile (RFC 9309).
+func (c *Crawler) checkRobotsPolicy(url *urlparse.URL) (bool, error) {
+	key := url.Scheme + "://" + url.Host
+	robotsGroup, cached, err := c.robots.Get(key)
+	if err != nil {
+		return false, err
+	} else if !cached {
+		var status int
+		if robotsGroup, status, err = c.loadRobots(url); err != nil {
+			c.logger.Warn("Failed to load robots.txt, so URLs of host are put off", logging.Host, url.Host, logging.Error, err, logging.ErrorKind, errorKind(err))
+			c.failures.Add(key+"/robots.txt", err)
+			if Classify(err) != ClassDatabase {
+				// the page store is read again for the next URL
+				c.robots.PutFailure(key, status, err)
+			}
+			return false, err
+		}
+		c.robots.Put(key, robotsGroup, status)
+	}
+
+	if robotsGroup == nil {
+		return true, nil
+	} else if url.RawQuery == "" {
+		return robotsGroup.Test(url.Path), nil
+	} else {
+		return robotsGroup.Test(url.Path + "?" + url.RawQuery), nil
+	}
+}
+
+// loadRobots returns the robots.txt rules for the host of url with the
+// status it was fetched with, from the page store or else from the host.
+// The rules are nil when every URL is allowed, and a server error fails.
+func (c *Crawler) loadRobots(url *urlparse.URL) (*robotstxt.Group, int, error) {
 	robotstxtURL := &urlparse.URL{
 		Scheme: url.Scheme,
 		User:   url.User,
@@ -136,53 +383,49 @@ func (c *Crawler) checkRobotsPolicy(url *urlparse.URL) bool {
 	var robotstxtData *Page
 	var err error
 	if robotstxtData, err = c.pagestore.Get(robotstxtURL.String()); err != nil {
-		return true
+		return nil, 0, err
 	} else if robotstxtData == nil {
 		robotstxtData, _, err = c.download(robotstxtURL)
 		if err != nil {
-			log.Printf("Error occurred during downloading robots.txt: %v", err)
-			return true
+			return nil, 0, err
 		} else if robotstxtData == nil {
-			return true
+			return nil, 0, nil
 		}
 
 		if robotstxtData.URL != robotstxtURL.String() {
 			// redirected
-			return true
+			return nil, robotstxtData.State.LastStatusCode, nil
+		} else if status := robotstxtData.State.LastStatusCode; status >= 500 {
+			// not stored, so that it is fetched again
+			return nil, status, &Error{ERR_UNAVAILABLE, ClassBusy, true, fmt.Errorf("status %d", status), 0}
 		} else {
 			if err = c.pagestore.Save(robotstxtData); err != nil {
-				log.Printf("Error occurred during saving robots.txt: %v", err)
-				return true
+				return nil, 0, err
 			}
 		}
 	}
 
 	if robotstxtData.State.LastStatusCode != 200 {
-		return true
+		return nil, robotstxtData.State.LastStatusCode, nil
 	}
 
 	robots, err := robotstxt.FromBytes(robotstxtData.Body)
 	if err != nil {
-		log.Println("Error occurred during parsing robots.tx: %v", err)
-		return true
+		c.logger.Warn("Failed to parse robots.txt, so every URL is allowed", logging.Host, url.Host, logging.Error, err, logging.ErrorKind, errorKind(ERR_INVALID_ROBOTS))
+		return nil, robotstxtData.State.LastStatusCode, nil
 	}
 
-	robotsGroup := robots.FindGroup(c.crawlerName)
-	if url.RawQuery == "" {
-		return robotsGroup.Test(url.Path)
-	} else {
-		return robotsGroup.Test(url.Path + "?" + url.RawQuery)
-	}
+	return robots.FindGroup(c.crawlerName), robotstxtData.State.LastStatusCode, nil
 }
 
-func (c *Crawler) detectURLs(p *Page) ([]*urlparse.URL, error) {
+func (c *Crawler) detectURLs(parent *protocol.Link, p *Page) ([]*protocol.Link, error) {
 	if !strings.HasPrefix(p.ContentType, "text/html") && !strings.HasPrefix(p.ContentType, "application/xhtml+xml") {
-		return nil, ERR_NOT_HTML
+		return nil, newError(ERR_NOT_HTML, nil)
 	}
 
 	doc, err := html.Parse(bytes.NewReader(p.Body))
 	if err != nil {
-		return nil, ERR_HTML_PARSE_ERROR
+		return nil, newError(ERR_HTML_PARSE_ERROR, err)
 	}
 
 	toAbs := func(base *urlparse.URL, url *urlparse.URL) {
@@ -234,7 +477,7 @@ func (c *Crawler) detectURLs(p *Page) ([]*urlparse.URL, error) {
 	}
 	f(doc)
 
-	result := make([]*urlparse.URL, 0, len(URLs))
+	result := make([]*protocol.Link, 0, len(URLs))
 	for _url := range URLs {
 		url, err := urlparse.Parse(_url)
 		if err != nil || url.Scheme != "" && url.Scheme != "http" && url.Scheme != "https" {
@@ -246,7 +489,7 @@ func (c *Crawler) detectURLs(p *Page) ([]*urlparse.URL, error) {
 			url.Fragment = ""
 		}
 
-		result = append(result, url)
+		result = append(result, parent.Child(url))
 	}
 
 	return result, nil
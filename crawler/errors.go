@@ -1,7 +1,16 @@
 package crawler
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
 )
 
 var (
@@ -14,4 +23,147 @@ var (
 	ERR_INVALID_ROBOTS   = errors.New("Robots.txt is invalid format")
 	ERR_NOT_HTML         = errors.New("This page is not written in HTML")
 	ERR_HTML_PARSE_ERROR = errors.New("Failed to parse HTML")
+	ERR_UNAVAILABLE      = errors.New("Server is unavailable")
 )
+
+// ErrorClass is what a failure to crawl a URL is put down to.
+type ErrorClass string
+
+const (
+	ClassDNS        ErrorClass = "dns"     // the host could not be resolved
+	ClassRefused    ErrorClass = "refused" // the host refused the connection
+	ClassReset      ErrorClass = "reset"   // the connection was cut off
+	ClassTLS        ErrorClass = "tls"     // the certificate or handshake was bad
+	ClassTimeout    ErrorClass = "timeout"
+	ClassBusy       ErrorClass = "busy" // the server answered 429 or 5xx
+	ClassRedirect   ErrorClass = "redirect"
+	ClassDownload   ErrorClass = "download" // any other failure to download
+	ClassDatabase   ErrorClass = "database"
+	ClassInternal   ErrorClass = "internal"
+	ClassInvalidURL ErrorClass = "invalid_url"
+	ClassRobots     ErrorClass = "robots"
+	ClassNotHTML    ErrorClass = "not_html"
+	ClassParse      ErrorClass = "parse"
+	ClassOther      ErrorClass = "other"
+)
+
+var sentinelClasses = map[error]ErrorClass{
+	ERR_MANY_REDIRECT:    ClassRedirect,
+	ERR_TIMEOUT:          ClassTimeout,
+	ERR_DATABASE:         ClassDatabase,
+	ERR_DOWNLOAD:         ClassDownload,
+	ERR_INTERNAL:         ClassInternal,
+	ERR_INVALIDURL:       ClassInvalidURL,
+	ERR_INVALID_ROBOTS:   ClassRobots,
+	ERR_NOT_HTML:         ClassNotHTML,
+	ERR_HTML_PARSE_ERROR: ClassParse,
+	ERR_UNAVAILABLE:      ClassBusy,
+}
+
+// Error is a failure to crawl a URL. It matches its sentinel ERR_ value and
+// its cause with errors.Is and errors.As.
+type Error struct {
+	Kind       error // one of the ERR_ values
+	Class      ErrorClass
+	Retryable  bool          // whether crawling the URL again later may succeed
+	Err        error         // the cause, if any
+	RetryAfter time.Duration // how long the server asked to wait, if it did
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// newError returns an error of kind caused by err, which is retryable when
+// the database or the crawler itself failed.
+func newError(kind error, err error) *Error {
+	class := sentinelClasses[kind]
+	return &Error{kind, class, class == ClassDatabase || class == ClassInternal, err, 0}
+}
+
+// downloadError returns the error which a download failed with because of
+// err, classified by the cause. Failures which are not known to pass are
+// permanent, so that hosts are not hammered for nothing.
+func downloadError(err error) *Error {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.Is(err, ERR_MANY_REDIRECT):
+		return &Error{ERR_MANY_REDIRECT, ClassRedirect, false, err, 0}
+	case errors.As(err, &dnsErr):
+		return &Error{ERR_DOWNLOAD, ClassDNS, dnsErr.IsTemporary || dnsErr.IsTimeout, err, 0}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &Error{ERR_TIMEOUT, ClassTimeout, true, err, 0}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return &Error{ERR_DOWNLOAD, ClassRefused, true, err, 0}
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return &Error{ERR_DOWNLOAD, ClassReset, true, err, 0}
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return &Error{ERR_DOWNLOAD, ClassTLS, false, err, 0}
+	}
+	return &Error{ERR_DOWNLOAD, ClassDownload, false, err, 0}
+}
+
+// statusError returns the error which a response of status failed with, or
+// nil when it is an answer to keep. Server errors may pass, and 429 and 503
+// wait for retryAfter if the server asked to.
+func statusError(status int, retryAfter time.Duration) *Error {
+	switch {
+	case status == http.StatusTooManyRequests, status == http.StatusServiceUnavailable:
+	case status >= 500 && status < 600:
+		retryAfter = 0
+	default:
+		return nil
+	}
+	return &Error{ERR_UNAVAILABLE, ClassBusy, true, fmt.Errorf("status %d", status), retryAfter}
+}
+
+// Classify returns the class of err, or an empty class when there is no
+// error.
+func Classify(err error) ErrorClass {
+	var e *Error
+	if err == nil {
+		return ""
+	} else if errors.As(err, &e) {
+		return e.Class
+	}
+	for sentinel, class := range sentinelClasses {
+		if errors.Is(err, sentinel) {
+			return class
+		}
+	}
+	return ClassOther
+}
+
+// Retryable reports whether crawling a URL again later may succeed where it
+// failed with err.
+func Retryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Retryable
+	}
+	return false
+}
+
+// errorKind returns the kind of err which logs are keyed by, or an empty
+// string when there is no error.
+func errorKind(err error) string {
+	return string(Classify(err))
+}
@@ -0,0 +1,146 @@
+package crawler
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDownloadError(t *testing.T) {
+	err := downloadError(&url.Error{Op: "Get", URL: "http://example.com/", Err: &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}})
+	assert.Equal(t, ClassDNS, err.Class)
+	assert.False(t, err.Retryable)
+	err = downloadError(&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true})
+	assert.Equal(t, ClassDNS, err.Class)
+	assert.True(t, err.Retryable)
+
+	err = downloadError(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})
+	assert.Equal(t, ClassRefused, err.Class)
+	assert.True(t, err.Retryable)
+	err = downloadError(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET})
+	assert.Equal(t, ClassReset, err.Class)
+	assert.True(t, err.Retryable)
+
+	err = downloadError(&url.Error{Op: "Get", URL: "http://example.com/", Err: ERR_MANY_REDIRECT})
+	assert.Equal(t, ClassRedirect, err.Class)
+	assert.False(t, err.Retryable)
+	assert.Equal(t, ClassDownload, downloadError(errors.New("unsupported protocol scheme")).Class)
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{http.StatusOK, false, 0},
+		{http.StatusNotFound, false, 0},
+		{http.StatusTooManyRequests, true, time.Minute},
+		{http.StatusInternalServerError, true, 0},
+		{http.StatusBadGateway, true, 0},
+		{http.StatusServiceUnavailable, true, time.Minute},
+		{http.StatusGatewayTimeout, true, 0},
+	}
+
+	for _, test := range tests {
+		err := statusError(test.status, time.Minute)
+		if !test.retryable {
+			assert.Nil(t, err, test.status)
+			continue
+		}
+		if assert.NotNil(t, err, test.status) {
+			assert.True(t, errors.Is(err, ERR_UNAVAILABLE), test.status)
+			assert.Equal(t, ClassBusy, err.Class, test.status)
+			assert.True(t, err.Retryable, test.status)
+			assert.Equal(t, test.retryAfter, err.RetryAfter, test.status)
+		}
+	}
+}
+
+func TestErrorMatching(t *testing.T) {
+	cause := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	var err error = downloadError(cause)
+
+	assert.True(t, errors.Is(err, ERR_DOWNLOAD))
+	assert.False(t, errors.Is(err, ERR_TIMEOUT))
+	assert.True(t, errors.Is(err, syscall.ECONNREFUSED))
+	var opErr *net.OpError
+	assert.True(t, errors.As(err, &opErr))
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "Failed to download a page: "+cause.Error(), err.Error())
+
+	assert.Equal(t, ClassRefused, Classify(err))
+	assert.True(t, Retryable(err))
+	// bare sentinels are classified but not retried
+	assert.Equal(t, ClassNotHTML, Classify(ERR_NOT_HTML))
+	assert.False(t, Retryable(ERR_NOT_HTML))
+	assert.Equal(t, ErrorClass(""), Classify(nil))
+	assert.True(t, Retryable(newError(ERR_DATABASE, errors.New("riak is down"))))
+}
+
+func TestDownloadClassifiesCause(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/large":
+			// the headers come at once and the body slowly
+			w.Write([]byte("<html>"))
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	defer func(timeout time.Duration) {
+		fetchTimeout = timeout
+	}(fetchTimeout)
+	fetchTimeout = 50 * time.Millisecond
+
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	u, _ := url.Parse(server.URL + "/slow")
+	_, _, err := c.download(u)
+	assert.True(t, errors.Is(err, ERR_TIMEOUT))
+	assert.Equal(t, ClassTimeout, Classify(err))
+	assert.True(t, Retryable(err))
+
+	// reading the body is limited apart
+	u, _ = url.Parse(server.URL + "/large")
+	_, _, err = c.download(u)
+	assert.Nil(t, err)
+	c.SetBodyTimeout(50 * time.Millisecond)
+	_, _, err = c.download(u)
+	assert.True(t, errors.Is(err, ERR_TIMEOUT))
+
+	// nothing listens on the port of a closed server
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	u, _ = url.Parse(closed.URL + "/")
+	_, _, err = c.download(u)
+	assert.True(t, errors.Is(err, syscall.ECONNREFUSED))
+	assert.Equal(t, ClassRefused, Classify(err))
+}
+
+func TestCrawlingStateFail(t *testing.T) {
+	downloadAt := time.Date(2014, 1, 1, 3, 4, 5, 0, time.UTC)
+	page := NewPage("http://example.com/", 200, "text/html", []byte("<html></html>"), "", downloadAt)
+	at := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	page.State.Fail(downloadError(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}), 2, at)
+
+	assert.Equal(t, at, page.State.LastAttempt)
+	assert.Equal(t, downloadAt, page.State.LastDownload)
+	assert.Equal(t, ClassReset, page.State.ErrorClass)
+	assert.True(t, page.State.Retryable)
+	assert.NotEqual(t, "", page.State.LastError)
+	// what was downloaded before is kept
+	assert.Equal(t, 200, page.State.LastStatusCode)
+	assert.Equal(t, "<html></html>", string(page.Body))
+}
@@ -0,0 +1,193 @@
+package crawler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthPolicy tells how the crawler backs off from hosts which fail or
+// slow down. A healthy host is paced as the crawl queue. Every failure
+// doubles its delay and every slow response widens it by half, up to
+// MaxDelay, and every fast response halves it again. After MaxFailures in a
+// row its circuit opens, which pauses the host for OpenDuration. The first
+// URL crawled after that probes the host: the circuit closes if it passes and
+// opens again for twice as long, up to MaxOpenDuration, if it fails.
+type HealthPolicy struct {
+	MaxDelay        time.Duration
+	SlowResponse    time.Duration // responses slower than this widen the delay
+	MaxFailures     int           // in a row, which open the circuit
+	OpenDuration    time.Duration
+	MaxOpenDuration time.Duration
+}
+
+var DefaultHealthPolicy = HealthPolicy{
+	MaxDelay:        2 * time.Minute,
+	SlowResponse:    time.Second,
+	MaxFailures:     5,
+	OpenDuration:    time.Minute,
+	MaxOpenDuration: 30 * time.Minute}
+
+// CircuitState is whether the URLs of a host are crawled.
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // crawled
+	CircuitOpen     CircuitState = "open"      // paused
+	CircuitHalfOpen CircuitState = "half_open" // probed with a URL
+)
+
+// HostHealth describes a host which is backed off from.
+type HostHealth struct {
+	Host      string       `json:"host"` // as the crawl queue paces it
+	State     CircuitState `json:"state"`
+	Delay     float64      `json:"delay"`                // between its URLs, in seconds
+	Failures  int          `json:"failures"`             // in a row
+	OpenUntil *time.Time   `json:"open_until,omitempty"` // while the circuit is open
+}
+
+type hostState struct {
+	delay     time.Duration
+	failures  int
+	open      time.Duration // how long the circuit opens for next
+	openUntil time.Time     // zero while the circuit is closed
+}
+
+// healthChange is what an observation changed about a host.
+type healthChange struct {
+	delay     time.Duration // between its URLs from now on
+	holdUntil time.Time     // until when its URLs are held back, if they are
+	from, to  CircuitState
+}
+
+// healthTracker tracks the health of the hosts crawled lately. Healthy hosts
+// are forgotten.
+type healthTracker struct {
+	policy HealthPolicy
+	base   time.Duration // between the URLs of healthy hosts
+	hosts  map[string]*hostState
+	sync.Mutex
+}
+
+func newHealthTracker(policy HealthPolicy, base time.Duration) *healthTracker {
+	return &healthTracker{policy: policy, base: base, hosts: make(map[string]*hostState)}
+}
+
+func (t *healthTracker) SetPolicy(policy HealthPolicy) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.policy = policy
+}
+
+func (s *hostState) circuit(now time.Time) CircuitState {
+	switch {
+	case s.openUntil.IsZero():
+		return CircuitClosed
+	case now.Before(s.openUntil):
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+// Observe records a download from host which took took and failed when
+// failed is true. The host is held back for at least retryAfter when its
+// server asked so.
+func (t *healthTracker) Observe(host string, took time.Duration, failed bool, retryAfter time.Duration) healthChange {
+	t.Lock()
+	defer t.Unlock()
+
+	p := t.policy
+	now := time.Now()
+	s, exists := t.hosts[host]
+	if !exists {
+		s = &hostState{delay: t.base, open: p.OpenDuration}
+	}
+	change := healthChange{from: s.circuit(now)}
+
+	if failed {
+		s.failures++
+		s.delay = minDuration(s.delay*2, p.MaxDelay)
+		if change.from == CircuitHalfOpen {
+			s.open = minDuration(s.open*2, p.MaxOpenDuration)
+		}
+		if change.from == CircuitHalfOpen || (change.from == CircuitClosed && s.failures >= p.MaxFailures) {
+			s.openUntil = now.Add(s.open)
+			change.holdUntil = s.openUntil
+		}
+	} else {
+		s.failures = 0
+		s.openUntil = time.Time{}
+		s.open = p.OpenDuration
+		if took > p.SlowResponse {
+			s.delay = minDuration(s.delay+s.delay/2, p.MaxDelay)
+		} else if s.delay > t.base {
+			s.delay = maxDuration(s.delay/2, t.base)
+		}
+	}
+
+	if retryAfter > 0 {
+		if until := now.Add(minDuration(retryAfter, p.MaxOpenDuration)); until.After(change.holdUntil) {
+			change.holdUntil = until
+		}
+	}
+	change.delay = s.delay
+	change.to = s.circuit(now)
+
+	if s.failures == 0 && s.delay <= t.base {
+		delete(t.hosts, host)
+	} else {
+		t.hosts[host] = s
+	}
+	return change
+}
+
+// Hosts returns the hosts which are backed off from, in order.
+func (t *healthTracker) Hosts() []HostHealth {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	hosts := make([]HostHealth, 0, len(t.hosts))
+	for host, s := range t.hosts {
+		h := HostHealth{Host: host, State: s.circuit(now), Delay: s.delay.Seconds(), Failures: s.failures}
+		if h.State == CircuitOpen {
+			openUntil := s.openUntil
+			h.OpenUntil = &openUntil
+		}
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts
+}
+
+// Circuits returns the number of hosts in each state but closed.
+func (t *healthTracker) Circuits() map[CircuitState]int {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	circuits := map[CircuitState]int{CircuitOpen: 0, CircuitHalfOpen: 0}
+	for _, s := range t.hosts {
+		if state := s.circuit(now); state != CircuitClosed {
+			circuits[state]++
+		}
+	}
+	return circuits
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
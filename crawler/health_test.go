@@ -0,0 +1,159 @@
+package crawler
+
+import (
+	"../protocol"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var testHealthPolicy = HealthPolicy{
+	MaxDelay:        time.Minute,
+	SlowResponse:    time.Second,
+	MaxFailures:     3,
+	OpenDuration:    50 * time.Millisecond,
+	MaxOpenDuration: 150 * time.Millisecond}
+
+func TestHealthTrackerPacing(t *testing.T) {
+	h := newHealthTracker(testHealthPolicy, 5*time.Second)
+
+	// failures double the delay, and slow responses widen it
+	assert.Equal(t, 10*time.Second, h.Observe("http://a", 0, true, 0).delay)
+	assert.Equal(t, 15*time.Second, h.Observe("http://a", 2*time.Second, false, 0).delay)
+	assert.Equal(t, 30*time.Second, h.Observe("http://a", 0, true, 0).delay)
+	assert.Equal(t, time.Minute, h.Observe("http://a", 0, true, 0).delay)
+
+	// fast responses narrow it gradually, and the healthy host is forgotten
+	assert.Equal(t, 30*time.Second, h.Observe("http://a", 0, false, 0).delay)
+	assert.Equal(t, 1, len(h.Hosts()))
+	assert.Equal(t, 15*time.Second, h.Observe("http://a", 0, false, 0).delay)
+	assert.Equal(t, 7500*time.Millisecond, h.Observe("http://a", 0, false, 0).delay)
+	assert.Equal(t, 5*time.Second, h.Observe("http://a", 0, false, 0).delay)
+	assert.Equal(t, 0, len(h.Hosts()))
+
+	// the server asking to wait holds the host back, up to MaxOpenDuration
+	change := h.Observe("http://b", 0, true, 100*time.Millisecond)
+	assert.Equal(t, CircuitClosed, change.to)
+	assert.True(t, change.holdUntil.After(time.Now().Add(50*time.Millisecond)))
+	change = h.Observe("http://b", 0, true, time.Hour)
+	assert.True(t, change.holdUntil.Before(time.Now().Add(time.Second)))
+}
+
+func TestHealthTrackerCircuit(t *testing.T) {
+	h := newHealthTracker(testHealthPolicy, 5*time.Second)
+
+	assert.Equal(t, CircuitClosed, h.Observe("http://a", 0, true, 0).to)
+	assert.Equal(t, CircuitClosed, h.Observe("http://a", 0, true, 0).to)
+	change := h.Observe("http://a", 0, true, 0)
+	assert.Equal(t, CircuitClosed, change.from)
+	assert.Equal(t, CircuitOpen, change.to)
+	assert.False(t, change.holdUntil.IsZero())
+	assert.Equal(t, map[CircuitState]int{CircuitOpen: 1, CircuitHalfOpen: 0}, h.Circuits())
+	if hosts := h.Hosts(); assert.Equal(t, 1, len(hosts)) {
+		assert.Equal(t, CircuitOpen, hosts[0].State)
+		assert.Equal(t, 3, hosts[0].Failures)
+		assert.NotNil(t, hosts[0].OpenUntil)
+	}
+
+	// a failed probe opens the circuit again for longer
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, map[CircuitState]int{CircuitOpen: 0, CircuitHalfOpen: 1}, h.Circuits())
+	change = h.Observe("http://a", 0, true, 0)
+	assert.Equal(t, CircuitHalfOpen, change.from)
+	assert.Equal(t, CircuitOpen, change.to)
+	assert.True(t, change.holdUntil.After(time.Now().Add(60*time.Millisecond)))
+
+	// and a passed one closes it
+	time.Sleep(110 * time.Millisecond)
+	change = h.Observe("http://a", 0, false, 0)
+	assert.Equal(t, CircuitHalfOpen, change.from)
+	assert.Equal(t, CircuitClosed, change.to)
+	assert.True(t, change.holdUntil.IsZero())
+	assert.Equal(t, map[CircuitState]int{CircuitOpen: 0, CircuitHalfOpen: 0}, h.Circuits())
+}
+
+func TestCrawlQueueDelayHold(t *testing.T) {
+	q := NewCrawlQueue(10 * time.Millisecond)
+	for _, rawurl := range []string{"http://a.example.com/1", "http://a.example.com/2", "http://b.example.com/"} {
+		u, _ := url.Parse(rawurl)
+		if !assert.Nil(t, q.Push(protocol.NewSeed(u))) {
+			t.FailNow()
+		}
+	}
+
+	// a held netloc is passed over, and the links pushed meanwhile too
+	q.Hold("a.example.com", time.Now().Add(time.Hour))
+	got, err := q.Pop()
+	if assert.Nil(t, err) {
+		assert.Equal(t, "http://b.example.com/", got.URL.String())
+	}
+	u, _ := url.Parse("http://b.example.com/2")
+	q.Hold("b.example.com", time.Now().Add(time.Hour))
+	assert.Nil(t, q.Push(protocol.NewSeed(u)))
+	_, err = q.Pop()
+	assert.Equal(t, QueueNotDue, err)
+	assert.Equal(t, 3, q.Count())
+
+	// a widened delay paces the links of a netloc
+	q = NewCrawlQueue(10 * time.Millisecond)
+	for _, rawurl := range []string{"http://a.example.com/1", "http://a.example.com/2"} {
+		u, _ := url.Parse(rawurl)
+		if !assert.Nil(t, q.Push(protocol.NewSeed(u))) {
+			t.FailNow()
+		}
+	}
+	q.SetDelay("a.example.com", time.Hour)
+	if got, err := q.Pop(); assert.Nil(t, err) {
+		assert.Equal(t, "http://a.example.com/1", got.URL.String())
+	}
+	if hosts := q.Snapshot(false); assert.Equal(t, 1, len(hosts)) {
+		assert.True(t, hosts[0].NextAt.After(time.Now().Add(59*time.Minute)))
+	}
+	_, err = q.Pop()
+	assert.Equal(t, QueueNotDue, err)
+}
+
+func TestCrawlerBacksOffFailingHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	c.SetHealthPolicy(testHealthPolicy)
+	admin := httptest.NewServer(c.AdminHandler())
+	defer admin.Close()
+
+	u, _ := url.Parse(server.URL + "/")
+	key := u.Host
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.download(u); !assert.True(t, errors.Is(err, ERR_UNAVAILABLE)) {
+			t.FailNow()
+		}
+	}
+
+	resp, err := http.Get(admin.URL + "/health")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	var hosts []HostHealth
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&hosts))
+	resp.Body.Close()
+	if assert.Equal(t, 1, len(hosts)) {
+		assert.Equal(t, key, hosts[0].Host)
+		assert.Equal(t, CircuitOpen, hosts[0].State)
+		assert.Equal(t, 40.0, hosts[0].Delay)
+	}
+
+	// the host is paused in the crawl queue
+	assert.Nil(t, c.cqueue.Push(protocol.NewSeed(u)))
+	if hosts := c.cqueue.Snapshot(false); assert.Equal(t, 1, len(hosts)) {
+		assert.True(t, hosts[0].NextAt.After(time.Now().Add(20*time.Millisecond)))
+	}
+}
@@ -0,0 +1,101 @@
+package crawler
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+)
+
+var (
+	pagesFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kaken_crawler_pages_fetched_total",
+		Help: "Pages fetched by HTTP status code, or by error when none was received.",
+	}, []string{"code"})
+	bytesDownloaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kaken_crawler_downloaded_bytes_total",
+		Help: "Bytes of page bodies downloaded.",
+	})
+	fetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kaken_crawler_fetch_duration_seconds",
+		Help:    "Time taken to fetch a page, including redirects.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5},
+	})
+	robotsDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kaken_crawler_robots_denied_total",
+		Help: "URLs skipped because robots.txt denies crawling them.",
+	})
+	retriesScheduled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kaken_crawler_retries_total",
+		Help: "URLs put back in the crawl queue after failing for a transient reason.",
+	})
+	deadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kaken_crawler_dead_letters_total",
+		Help: "URLs given up on after failing every attempt.",
+	})
+	circuitsOpened = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kaken_crawler_circuits_opened_total",
+		Help: "Times a host was paused after failing repeatedly.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(pagesFetched, bytesDownloaded, fetchDuration, robotsDenied, retriesScheduled, deadLetters, circuitsOpened)
+}
+
+// statusLabel returns the label of a fetch which ended with code, or with
+// err before a response was received.
+func statusLabel(code int, err error) string {
+	switch {
+	case errors.Is(err, ERR_TIMEOUT):
+		return "timeout"
+	case err != nil && code == 0:
+		return "error"
+	}
+	return strconv.Itoa(code)
+}
+
+var (
+	queueURLsDesc = prometheus.NewDesc("kaken_crawler_queue_urls",
+		"URLs in the crawl queue.", nil, nil)
+	queueHostsDesc = prometheus.NewDesc("kaken_crawler_queue_hosts",
+		"Hosts with URLs in the crawl queue.", nil, nil)
+	sendQueueDesc = prometheus.NewDesc("kaken_crawler_send_queue_urls",
+		"URLs found and waiting to be sent to the exchange.", nil, nil)
+	retryingDesc = prometheus.NewDesc("kaken_crawler_retrying_urls",
+		"URLs waiting in the crawl queue to be retried.", nil, nil)
+	hostCircuitsDesc = prometheus.NewDesc("kaken_crawler_host_circuits",
+		"Hosts backed off from by the state of their circuit.", []string{"state"}, nil)
+	unacknowledgedDesc = prometheus.NewDesc("kaken_crawler_unacknowledged_urls",
+		"URLs sent to the exchange and not acknowledged yet.", nil, nil)
+)
+
+type crawlerCollector struct {
+	c *Crawler
+}
+
+// Collector returns the metrics of the queues of c, to be registered by the
+// program running it.
+func (c *Crawler) Collector() prometheus.Collector {
+	return &crawlerCollector{c}
+}
+
+func (cc *crawlerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueURLsDesc
+	ch <- queueHostsDesc
+	ch <- sendQueueDesc
+	ch <- retryingDesc
+	ch <- hostCircuitsDesc
+	ch <- unacknowledgedDesc
+}
+
+func (cc *crawlerCollector) Collect(ch chan<- prometheus.Metric) {
+	c := cc.c
+	ch <- prometheus.MustNewConstMetric(queueURLsDesc, prometheus.GaugeValue, float64(c.cqueue.Count()))
+	ch <- prometheus.MustNewConstMetric(queueHostsDesc, prometheus.GaugeValue, float64(c.cqueue.Hosts()))
+	ch <- prometheus.MustNewConstMetric(sendQueueDesc, prometheus.GaugeValue, float64(len(c.wqueue)))
+	ch <- prometheus.MustNewConstMetric(retryingDesc, prometheus.GaugeValue, float64(c.cqueue.Delayed()))
+	for state, n := range c.health.Circuits() {
+		ch <- prometheus.MustNewConstMetric(hostCircuitsDesc, prometheus.GaugeValue, float64(n), string(state))
+	}
+	ch <- prometheus.MustNewConstMetric(unacknowledgedDesc, prometheus.GaugeValue, float64(c.outbox.Len()))
+}
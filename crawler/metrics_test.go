@@ -0,0 +1,92 @@
+package crawler
+
+import (
+	"../protocol"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusLabel(t *testing.T) {
+	assert.Equal(t, "200", statusLabel(200, nil))
+	assert.Equal(t, "404", statusLabel(404, nil))
+	assert.Equal(t, "timeout", statusLabel(0, ERR_TIMEOUT))
+	assert.Equal(t, "error", statusLabel(0, ERR_DOWNLOAD))
+	// a response was received even if reading its body failed
+	assert.Equal(t, "200", statusLabel(200, errors.New("unexpected EOF")))
+}
+
+func TestDownloadMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	ok, missing := pagesFetched.WithLabelValues("200"), pagesFetched.WithLabelValues("404")
+	okBefore, missingBefore := testutil.ToFloat64(ok), testutil.ToFloat64(missing)
+	bytesBefore := testutil.ToFloat64(bytesDownloaded)
+
+	u, _ := url.Parse(server.URL + "/")
+	if _, _, err := c.download(u); !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	u, _ = url.Parse(server.URL + "/missing")
+	if _, _, err := c.download(u); !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, okBefore+1, testutil.ToFloat64(ok))
+	assert.Equal(t, missingBefore+1, testutil.ToFloat64(missing))
+	// only the body of the page found is kept
+	assert.Equal(t, bytesBefore+float64(len("<html></html>")), testutil.ToFloat64(bytesDownloaded))
+}
+
+func TestCrawlerCollector(t *testing.T) {
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	for _, rawurl := range []string{"http://a.example.com/1", "http://a.example.com/2", "http://b.example.com/"} {
+		u, _ := url.Parse(rawurl)
+		if !assert.Nil(t, c.cqueue.Push(protocol.NewSeed(u))) {
+			t.FailNow()
+		}
+	}
+	u, _ := url.Parse("http://c.example.com/")
+	c.wqueue <- protocol.NewSeed(u)
+	u, _ = url.Parse("http://d.example.com/")
+	if !assert.Nil(t, c.cqueue.Retry(protocol.NewSeed(u), time.Now().Add(time.Hour))) {
+		t.FailNow()
+	}
+
+	expected := `
+# HELP kaken_crawler_host_circuits Hosts backed off from by the state of their circuit.
+# TYPE kaken_crawler_host_circuits gauge
+kaken_crawler_host_circuits{state="half_open"} 0
+kaken_crawler_host_circuits{state="open"} 0
+# HELP kaken_crawler_queue_hosts Hosts with URLs in the crawl queue.
+# TYPE kaken_crawler_queue_hosts gauge
+kaken_crawler_queue_hosts 2
+# HELP kaken_crawler_queue_urls URLs in the crawl queue.
+# TYPE kaken_crawler_queue_urls gauge
+kaken_crawler_queue_urls 3
+# HELP kaken_crawler_retrying_urls URLs waiting in the crawl queue to be retried.
+# TYPE kaken_crawler_retrying_urls gauge
+kaken_crawler_retrying_urls 1
+# HELP kaken_crawler_send_queue_urls URLs found and waiting to be sent to the exchange.
+# TYPE kaken_crawler_send_queue_urls gauge
+kaken_crawler_send_queue_urls 1
+# HELP kaken_crawler_unacknowledged_urls URLs sent to the exchange and not acknowledged yet.
+# TYPE kaken_crawler_unacknowledged_urls gauge
+kaken_crawler_unacknowledged_urls 0
+`
+	assert.Nil(t, testutil.CollectAndCompare(c.Collector(), strings.NewReader(expected)))
+}
@@ -0,0 +1,155 @@
+package crawler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxRecentErrors = 100
+
+// Download is a URL being downloaded.
+type Download struct {
+	URL   string    `json:"url"`
+	Since time.Time `json:"since"`
+}
+
+// downloads tracks the URLs being downloaded by the downloader and by
+// forced fetches.
+type downloads struct {
+	urls map[string]time.Time
+	sync.Mutex
+}
+
+func newDownloads() *downloads {
+	return &downloads{urls: make(map[string]time.Time)}
+}
+
+// Start records that url is being downloaded, and returns a func to call
+// when it is finished.
+func (d *downloads) Start(url string) func() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.urls[url] = time.Now()
+	return func() {
+		d.Lock()
+		defer d.Unlock()
+
+		delete(d.urls, url)
+	}
+}
+
+// List returns the URLs being downloaded, oldest first.
+func (d *downloads) List() []Download {
+	d.Lock()
+	defer d.Unlock()
+
+	list := make([]Download, 0, len(d.urls))
+	for url, since := range d.urls {
+		list = append(list, Download{url, since})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Since.Before(list[j].Since)
+	})
+	return list
+}
+
+// CrawlError is a failure to crawl a URL.
+type CrawlError struct {
+	Time      time.Time  `json:"time"`
+	URL       string     `json:"url"`
+	Error     string     `json:"error"`
+	Class     ErrorClass `json:"class"`
+	Retryable bool       `json:"retryable"`
+}
+
+// errorLog keeps the latest maxRecentErrors failures.
+type errorLog struct {
+	entries []CrawlError
+	next    int // where the next entry goes once the log is full
+	sync.Mutex
+}
+
+func newErrorLog() *errorLog {
+	return &errorLog{entries: make([]CrawlError, 0, maxRecentErrors)}
+}
+
+func (l *errorLog) Add(url string, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	entry := CrawlError{time.Now(), url, err.Error(), Classify(err), Retryable(err)}
+	if len(l.entries) < maxRecentErrors {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % maxRecentErrors
+}
+
+// Recent returns the failures kept, newest first.
+func (l *errorLog) Recent() []CrawlError {
+	l.Lock()
+	defer l.Unlock()
+
+	recent := make([]CrawlError, len(l.entries))
+	for i := range recent {
+		recent[i] = l.entries[(l.next+len(l.entries)-1-i)%len(l.entries)]
+	}
+	return recent
+}
+
+// hostSet is a set of hosts which is safe for concurrent use.
+type hostSet struct {
+	hosts map[string]bool
+	sync.RWMutex
+}
+
+func newHostSet() *hostSet {
+	return &hostSet{hosts: make(map[string]bool)}
+}
+
+// Add adds host, and reports false when it was there already.
+func (s *hostSet) Add(host string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.hosts[host] {
+		return false
+	}
+	s.hosts[host] = true
+	return true
+}
+
+// Remove removes host, and reports false when it was not there.
+func (s *hostSet) Remove(host string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.hosts[host] {
+		return false
+	}
+	delete(s.hosts, host)
+	return true
+}
+
+func (s *hostSet) Contains(host string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.hosts[host]
+}
+
+// List returns the hosts in order.
+func (s *hostSet) List() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	hosts := make([]string, 0, len(s.hosts))
+	for host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -0,0 +1,81 @@
+package crawler
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestErrorLog(t *testing.T) {
+	l := newErrorLog()
+	assert.Equal(t, len(l.Recent()), 0)
+
+	for i := 0; i < maxRecentErrors+10; i++ {
+		l.Add("http://example.com/"+strconv.Itoa(i), errors.New("failed"))
+	}
+
+	// the oldest are dropped, and the newest come first
+	recent := l.Recent()
+	if assert.Equal(t, len(recent), maxRecentErrors) {
+		assert.Equal(t, recent[0].URL, "http://example.com/"+strconv.Itoa(maxRecentErrors+9))
+		assert.Equal(t, recent[maxRecentErrors-1].URL, "http://example.com/10")
+	}
+}
+
+func TestDownloads(t *testing.T) {
+	d := newDownloads()
+	first := d.Start("http://example.com/1")
+	time.Sleep(time.Millisecond)
+	second := d.Start("http://example.com/2")
+
+	list := d.List()
+	if assert.Equal(t, len(list), 2) {
+		assert.Equal(t, list[0].URL, "http://example.com/1")
+	}
+
+	first()
+	second()
+	assert.Equal(t, len(d.List()), 0)
+}
+
+func TestRobotsCache(t *testing.T) {
+	r := newRobotsCache()
+	_, cached, _ := r.Get("http://example.com")
+	assert.False(t, cached)
+
+	r.Put("http://example.com", nil, 404)
+	group, cached, err := r.Get("http://example.com")
+	assert.True(t, cached)
+	assert.Nil(t, group)
+	assert.Nil(t, err)
+	if states := r.States(); assert.Equal(t, len(states), 1) {
+		assert.Equal(t, states[0].Status, 404)
+		assert.True(t, states[0].AllowsAll)
+	}
+
+	defer func(ttl time.Duration) {
+		robotsCacheTTL = ttl
+	}(robotsCacheTTL)
+	robotsCacheTTL = 0
+	_, cached, _ = r.Get("http://example.com")
+	assert.False(t, cached)
+	assert.Equal(t, len(r.States()), 0)
+
+	// expired entries are swept as others are put
+	r.Put("http://example.com", nil, 404)
+	r.swept = time.Time{}
+	r.Put("http://example.org", nil, 404)
+	assert.Equal(t, len(r.entries), 0)
+
+	// a failure is kept for a while, and puts off the host meanwhile
+	r.PutFailure("http://example.com", 500, ERR_UNAVAILABLE)
+	_, cached, err = r.Get("http://example.com")
+	assert.True(t, cached)
+	assert.Equal(t, err, ERR_UNAVAILABLE)
+	if states := r.States(); assert.Equal(t, len(states), 1) {
+		assert.False(t, states[0].AllowsAll)
+		assert.Equal(t, states[0].Error, ERR_UNAVAILABLE.Error())
+	}
+}
@@ -1,16 +1,42 @@
 package crawler
 
 import (
+	"../logging"
 	"github.com/tpjg/goriakpbc"
-	"log"
+	"log/slog"
 	urlparse "net/url"
 	"time"
 )
 
 type CrawlingState struct {
-	LastStatusCode int       `riak:"lastStatusCode"`
-	LastDownload   time.Time `riak:"lastDownload"`
-	Deleted        bool      `riak:"deleted"`
+	LastStatusCode int        `riak:"lastStatusCode"`
+	LastDownload   time.Time  `riak:"lastDownload"`
+	LastAttempt    time.Time  `riak:"lastAttempt"` // of the last download, even if it failed
+	Deleted        bool       `riak:"deleted"`
+	LastError      string     `riak:"lastError"`  // of the last download, if it failed
+	ErrorClass     ErrorClass `riak:"errorClass"` // of LastError
+	Retryable      bool       `riak:"retryable"`  // whether LastError may pass
+	Attempts       int        `riak:"attempts"`   // failed in a row, until LastError
+}
+
+// Fail records that the download at attemptAt failed with err, after
+// attempts in a row. The page kept from an earlier download is left as it
+// was, and so is when it was downloaded.
+func (s *CrawlingState) Fail(err error, attempts int, attemptAt time.Time) {
+	s.LastAttempt = attemptAt
+	s.Attempts = attempts
+	s.LastError = err.Error()
+	s.ErrorClass = Classify(err)
+	s.Retryable = Retryable(err)
+}
+
+// recentAttempts returns the attempts failed in a row, unless the last one
+// was before since, when they are taken to be over.
+func (s *CrawlingState) recentAttempts(since time.Time) int {
+	if s.LastError == "" || s.LastAttempt.Before(since) {
+		return 0
+	}
+	return s.Attempts
 }
 
 type Page struct {
@@ -26,6 +52,7 @@ func NewPage(url string, statusCode int, contentType string, body []byte, redire
 	state := CrawlingState{
 		LastStatusCode: statusCode,
 		LastDownload:   downloadAt,
+		LastAttempt:    downloadAt,
 		Deleted:        false}
 	p := &Page{
 		URL:         url,
@@ -55,7 +82,7 @@ func (s *PageStore) Get(url string) (*Page, error) {
 	if err := s.client.LoadModelFrom(s.bucket, key, p); err == riak.NotFound {
 		return nil, nil
 	} else if err != nil {
-		return nil, ERR_DATABASE
+		return nil, newError(ERR_DATABASE, err)
 	} else {
 		return p, nil
 	}
@@ -65,16 +92,16 @@ func (s *PageStore) Save(p *Page) error {
 	key := SHA1Hash([]byte(p.URL))
 
 	if err := s.client.NewModelIn(s.bucket, key, p); err != nil {
-		log.Println(err)
-		return ERR_DATABASE
+		slog.Error("Failed to save page", logging.URL, p.URL, logging.Error, err)
+		return newError(ERR_DATABASE, err)
 	}
 
 	if err := s.client.SaveAs(key, p); err != nil {
-		log.Println(err)
-		return ERR_DATABASE
+		slog.Error("Failed to save page", logging.URL, p.URL, logging.Error, err)
+		return newError(ERR_DATABASE, err)
 	}
 
-	log.Printf("%s has just been saved as %s", p.URL, key)
+	slog.Debug("Saved page", logging.URL, p.URL, "key", key)
 	return nil
 }
 
@@ -86,8 +113,8 @@ func (s *PageStore) Delete(page *Page) {
 func (s *PageStore) IsKnownURL(url *urlparse.URL) (bool, error) {
 	exists, err := s.client.ExistsIn(s.bucket, SHA1Hash([]byte(url.String())))
 	if err != nil {
-		log.Println(err)
-		return false, ERR_DATABASE
+		slog.Error("Failed to look up page", logging.URL, url.String(), logging.Error, err)
+		return false, newError(ERR_DATABASE, err)
 	}
 
 	return exists, nil
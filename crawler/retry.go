@@ -0,0 +1,113 @@
+package crawler
+
+import (
+	"../protocol"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy tells how URLs which failed to download for a transient reason
+// are tried again.
+type RetryPolicy struct {
+	MaxAttempts int           // in all, including the first; 1 never retries
+	BaseDelay   time.Duration // before the second attempt, doubled for every next one
+	MaxDelay    time.Duration // longest waited, even if a server asks for longer
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    time.Hour}
+
+// Delay returns how long to wait after attempts failed ones before the next.
+// The backoff is jittered between half and all of it, so that URLs failed
+// together are not retried together, and is no shorter than retryAfter.
+func (p RetryPolicy) Delay(attempts int, retryAfter time.Duration) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if half := delay / 2; half > 0 {
+		delay = half + time.Duration(rand.Int63n(int64(delay-half)))
+	}
+
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// parseRetryAfter returns how long a Retry-After header of value asks to
+// wait from now, in seconds or until an HTTP date. It is 0 when there is no
+// valid header.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	} else if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// attempts counts the failed attempts of the URLs waiting to be retried in
+// the crawl queue. The counts of the others are in their stored pages.
+type attempts struct {
+	counts map[string]int
+	sync.Mutex
+}
+
+func newAttempts() *attempts {
+	return &attempts{counts: make(map[string]int)}
+}
+
+// Take returns the failed attempts of url and forgets them, and reports
+// whether it is being retried.
+func (a *attempts) Take(url string) (int, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	n, exists := a.counts[url]
+	delete(a.counts, url)
+	return n, exists
+}
+
+func (a *attempts) Set(url string, n int) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.counts[url] = n
+}
+
+// Forget drops the counts of links which are not retried any more.
+func (a *attempts) Forget(links []*protocol.Link) {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, link := range links {
+		delete(a.counts, link.URL.String())
+	}
+}
+
+// Reset drops every count, once the crawl queue is flushed.
+func (a *attempts) Reset() {
+	a.Lock()
+	defer a.Unlock()
+
+	a.counts = make(map[string]int)
+}
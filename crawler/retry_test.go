@@ -0,0 +1,141 @@
+package crawler
+
+import (
+	"../protocol"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	for i := 0; i < 100; i++ {
+		// jittered between half and all of the backoff
+		d := p.Delay(1, 0)
+		assert.True(t, d >= 500*time.Millisecond && d < time.Second, d)
+		d = p.Delay(3, 0)
+		assert.True(t, d >= 2*time.Second && d < 4*time.Second, d)
+		d = p.Delay(100, 0)
+		assert.True(t, d >= 5*time.Second && d < 10*time.Second, d)
+	}
+
+	// servers are waited for as long as they ask, up to MaxDelay
+	assert.Equal(t, 7*time.Second, p.Delay(1, 7*time.Second))
+	assert.Equal(t, 10*time.Second, p.Delay(1, time.Minute))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-1", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+func TestDownloadUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	u, _ := url.Parse(server.URL + "/")
+	_, _, err := c.download(u)
+
+	var e *Error
+	if assert.True(t, errors.As(err, &e)) {
+		assert.True(t, errors.Is(err, ERR_UNAVAILABLE))
+		assert.Equal(t, ClassBusy, e.Class)
+		assert.True(t, e.Retryable)
+		assert.Equal(t, 120*time.Second, e.RetryAfter)
+	}
+}
+
+func TestRobotsUnavailable(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// a host which is busy disallows every URL, and its robots.txt is not
+	// fetched again for a while
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	for _, path := range []string{"/1", "/2"} {
+		u, _ := url.Parse(server.URL + path)
+		allowed, err := c.checkRobotsPolicy(u)
+		assert.False(t, allowed)
+		assert.True(t, errors.Is(err, ERR_UNAVAILABLE))
+		assert.True(t, Retryable(err))
+	}
+	assert.Equal(t, requests, 1)
+}
+
+func TestCrawlingStateRecentAttempts(t *testing.T) {
+	now := time.Now()
+	s := CrawlingState{}
+	s.Fail(ERR_TIMEOUT, 2, now)
+	assert.Equal(t, s.recentAttempts(now.Add(-time.Hour)), 2)
+	// attempts long ago are over
+	assert.Equal(t, s.recentAttempts(now.Add(time.Second)), 0)
+
+	s = NewPage("http://example.com/", 200, "text/html", []byte{}, "", now).State
+	assert.Equal(t, s.recentAttempts(now.Add(-time.Hour)), 0)
+}
+
+func TestCrawlerRetry(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewCrawler(Exchange{}, nil, "bucket", "test", "test")
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour})
+	c.SetDeadLetterLog(NewCrawlLog(&buf))
+
+	u, _ := url.Parse("http://example.com/")
+	link := protocol.NewSeed(u)
+	refused := downloadError(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})
+
+	// permanent failures are not retried
+	assert.False(t, c.retry(link, ERR_NOT_HTML, 1))
+	assert.Equal(t, c.cqueue.Delayed(), 0)
+
+	assert.True(t, c.retry(link, refused, 1))
+	assert.Equal(t, c.cqueue.Delayed(), 1)
+	attempts, retried := c.attempts.Take("http://example.com/")
+	assert.True(t, retried)
+	assert.Equal(t, attempts, 1)
+
+	// the server asking to wait pushes the retry back
+	busy := statusError(http.StatusTooManyRequests, 2*time.Hour)
+	assert.True(t, c.retry(link, busy, 2))
+	assert.Equal(t, len(c.cqueue.Flush()), 2)
+	attempts, _ = c.attempts.Take("http://example.com/")
+	assert.Equal(t, attempts, 2)
+
+	// and the last attempt gives up as a dead letter
+	assert.False(t, c.retry(link, refused, 3))
+	assert.Equal(t, c.cqueue.Delayed(), 0)
+	_, retried = c.attempts.Take("http://example.com/")
+	assert.False(t, retried)
+
+	var letter struct {
+		Link      map[string]interface{} `json:"link"`
+		Attempts  int                    `json:"attempts"`
+		ErrorKind string                 `json:"error_kind"`
+	}
+	if assert.Nil(t, json.NewDecoder(&buf).Decode(&letter)) {
+		assert.Equal(t, "http://example.com/", letter.Link["url"])
+		assert.Equal(t, 3, letter.Attempts)
+		assert.Equal(t, "refused", letter.ErrorKind)
+	}
+}
@@ -0,0 +1,123 @@
+package crawler
+
+import (
+	"github.com/temoto/robotstxt-go"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long the robots.txt of a host is kept in memory, and how long a
+// failure to load it is, during which its URLs are put off.
+var (
+	robotsCacheTTL   = 1 * time.Hour
+	robotsFailureTTL = 5 * time.Minute
+)
+
+// RobotsState describes the robots.txt of a host kept in memory.
+type RobotsState struct {
+	Host      string    `json:"host"`
+	Status    int       `json:"status"`          // of the robots.txt response
+	AllowsAll bool      `json:"allows_all"`      // when there is no robots.txt to follow
+	Error     string    `json:"error,omitempty"` // when it failed to load
+	CachedAt  time.Time `json:"cached_at"`
+}
+
+type robotsEntry struct {
+	group    *robotstxt.Group // nil when every URL is allowed
+	status   int
+	err      error // when it failed to load
+	cachedAt time.Time
+}
+
+func (e *robotsEntry) expired() bool {
+	if e.err != nil {
+		return time.Since(e.cachedAt) > robotsFailureTTL
+	}
+	return time.Since(e.cachedAt) > robotsCacheTTL
+}
+
+// robotsCache keeps the robots.txt rules of the hosts crawled lately, so
+// that the page store is not read for every URL. Expired entries are swept
+// now and then as entries are put.
+type robotsCache struct {
+	entries map[string]*robotsEntry // keyed by scheme://host
+	swept   time.Time
+	sync.Mutex
+}
+
+func newRobotsCache() *robotsCache {
+	return &robotsCache{entries: make(map[string]*robotsEntry)}
+}
+
+// Get returns the rules of host or the error they failed to load with, and
+// false when neither is cached or they have expired.
+func (r *robotsCache) Get(host string) (*robotstxt.Group, bool, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	entry, exists := r.entries[host]
+	if !exists {
+		return nil, false, nil
+	} else if entry.expired() {
+		delete(r.entries, host)
+		return nil, false, nil
+	}
+	return entry.group, true, entry.err
+}
+
+// Put caches the rules of host, which are nil when every URL is allowed.
+func (r *robotsCache) Put(host string, group *robotstxt.Group, status int) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.entries[host] = &robotsEntry{group, status, nil, time.Now()}
+	r.sweep()
+}
+
+// PutFailure caches that the rules of host failed to load with err, after
+// a response of status if there was one.
+func (r *robotsCache) PutFailure(host string, status int, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.entries[host] = &robotsEntry{nil, status, err, time.Now()}
+	r.sweep()
+}
+
+// sweep drops the expired entries, at most once in the lifetime of a failure
+// so that putting stays cheap.
+func (r *robotsCache) sweep() {
+	if time.Since(r.swept) < robotsFailureTTL {
+		return
+	}
+	r.swept = time.Now()
+
+	for host, entry := range r.entries {
+		if entry.expired() {
+			delete(r.entries, host)
+		}
+	}
+}
+
+// States returns the hosts which are cached in order.
+func (r *robotsCache) States() []RobotsState {
+	r.Lock()
+	defer r.Unlock()
+
+	states := make([]RobotsState, 0, len(r.entries))
+	for host, entry := range r.entries {
+		if entry.expired() {
+			continue
+		}
+		state := RobotsState{host, entry.status, entry.group == nil && entry.err == nil, "", entry.cachedAt}
+		if entry.err != nil {
+			state.Error = entry.err.Error()
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Host < states[j].Host
+	})
+	return states
+}
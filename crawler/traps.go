@@ -0,0 +1,229 @@
+package crawler
+
+import (
+	"../logging"
+	"hash/fnv"
+	"log/slog"
+	urlparse "net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type TrapConfig struct {
+	MaxURLLength        int // characters in the whole URL
+	MaxRepeatedSegments int // occurrences of the same path segment
+	MaxQueryParams      int // parameters in the query string
+	MaxSimilarPages     int // near-identical pages under one URL pattern of a host
+	SimilarityDistance  int // maximum hamming distance between similar fingerprints
+}
+
+var DefaultTrapConfig = TrapConfig{
+	MaxURLLength:        1024,
+	MaxRepeatedSegments: 2,
+	MaxQueryParams:      10,
+	MaxSimilarPages:     50,
+	SimilarityDistance:  3}
+
+const (
+	maxFingerprintsPerPattern = 32
+	maxTrapPatterns           = 100000 // unflagged ones beyond are forgotten
+)
+
+// How long a pattern which has not been flagged is kept after the last page
+// observed under it.
+var trapPatternTTL = 1 * time.Hour
+
+type TrapHost struct {
+	Host      string
+	Pattern   string
+	Reason    string
+	FlaggedAt time.Time
+}
+
+type trapPattern struct {
+	fingerprints []uint64
+	similar      int
+	flagged      *TrapHost
+	observedAt   time.Time
+}
+
+// TrapDetector rejects URLs which look like they are generated without
+// bound, such as infinite calendars, session IDs or recursive paths.
+type TrapDetector struct {
+	config   TrapConfig
+	patterns map[string]*trapPattern // keyed by host + URL pattern
+	flagged  []*TrapHost
+	pruned   time.Time
+	sync.Mutex
+}
+
+func NewTrapDetector(config TrapConfig) *TrapDetector {
+	return &TrapDetector{
+		config:   config,
+		patterns: make(map[string]*trapPattern),
+		flagged:  make([]*TrapHost, 0)}
+}
+
+// Check returns why url looks like a trap, or an empty string.
+func (d *TrapDetector) Check(url *urlparse.URL) string {
+	if rawurl := url.String(); len(rawurl) > d.config.MaxURLLength {
+		return "URL is too long"
+	}
+
+	counts := make(map[string]int)
+	for _, segment := range strings.Split(url.Path, "/") {
+		if segment == "" {
+			continue
+		}
+		if counts[segment]++; counts[segment] > d.config.MaxRepeatedSegments {
+			return "path segment " + segment + " is repeated"
+		}
+	}
+
+	if params := url.Query(); len(params) > d.config.MaxQueryParams {
+		return "too many query parameters"
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if pattern, exists := d.patterns[url.Host+urlPattern(url)]; exists && pattern.flagged != nil {
+		return pattern.flagged.Reason
+	}
+	return ""
+}
+
+// Observe records the content of a downloaded page, and flags the URL
+// pattern of the page once it keeps yielding near-identical content.
+func (d *TrapDetector) Observe(url *urlparse.URL, body []byte) {
+	fingerprint := simhash(body)
+	pattern := urlPattern(url)
+	key := url.Host + pattern
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	stats, exists := d.patterns[key]
+	if !exists {
+		d.prune(now)
+		stats = &trapPattern{fingerprints: make([]uint64, 0, maxFingerprintsPerPattern)}
+		d.patterns[key] = stats
+	}
+	if stats.flagged != nil {
+		return
+	}
+	stats.observedAt = now
+
+	for _, known := range stats.fingerprints {
+		if hammingDistance(known, fingerprint) <= d.config.SimilarityDistance {
+			stats.similar++
+			break
+		}
+	}
+	if len(stats.fingerprints) < maxFingerprintsPerPattern {
+		stats.fingerprints = append(stats.fingerprints, fingerprint)
+	}
+
+	if stats.similar >= d.config.MaxSimilarPages {
+		stats.flagged = &TrapHost{
+			Host:      url.Host,
+			Pattern:   pattern,
+			Reason:    "near-identical pages under " + pattern,
+			FlaggedAt: time.Now()}
+		d.flagged = append(d.flagged, stats.flagged)
+		stats.fingerprints = nil
+
+		slog.Warn("Flagged spider trap", logging.Host, url.Host, "reason", stats.flagged.Reason)
+	}
+}
+
+// prune forgets the patterns which have not been observed lately, now and
+// then or once there are too many. Flagged ones are kept, since URLs are
+// checked against them.
+func (d *TrapDetector) prune(now time.Time) {
+	if len(d.patterns) < maxTrapPatterns && now.Sub(d.pruned) < trapPatternTTL {
+		return
+	}
+	d.pruned = now
+
+	for key, stats := range d.patterns {
+		if stats.flagged == nil && (now.Sub(stats.observedAt) > trapPatternTTL || len(d.patterns) >= maxTrapPatterns) {
+			delete(d.patterns, key)
+		}
+	}
+}
+
+// Report returns the hosts flagged as traps, oldest first.
+func (d *TrapDetector) Report() []TrapHost {
+	d.Lock()
+	defer d.Unlock()
+
+	report := make([]TrapHost, 0, len(d.flagged))
+	for _, host := range d.flagged {
+		report = append(report, *host)
+	}
+	return report
+}
+
+var digits = regexp.MustCompile(`[0-9]+`)
+
+// urlPattern abstracts the variable parts of url: numbers in the path are
+// replaced and only the names of query parameters are kept.
+func urlPattern(url *urlparse.URL) string {
+	pattern := digits.ReplaceAllString(url.Path, "#")
+	if i := strings.Index(pattern, ";"); i >= 0 {
+		pattern = pattern[:i]
+	}
+
+	if url.RawQuery != "" {
+		names := make([]string, 0)
+		for name := range url.Query() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pattern += "?" + strings.Join(names, "&")
+	}
+	return pattern
+}
+
+func simhash(body []byte) uint64 {
+	var weights [64]int
+
+	words := strings.FieldsFunc(string(body), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		h := fnv.New64a()
+		h.Write([]byte(word))
+		sum := h.Sum64()
+
+		for i := uint(0); i < 64; i++ {
+			if sum&(1<<i) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+
+	var fingerprint uint64
+	for i := uint(0); i < 64; i++ {
+		if weights[i] > 0 {
+			fingerprint |= 1 << i
+		}
+	}
+	return fingerprint
+}
+
+func hammingDistance(x, y uint64) int {
+	distance := 0
+	for diff := x ^ y; diff != 0; diff &= diff - 1 {
+		distance++
+	}
+	return distance
+}
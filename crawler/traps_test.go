@@ -0,0 +1,98 @@
+package crawler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrapDetectorCheck(t *testing.T) {
+	d := NewTrapDetector(DefaultTrapConfig)
+
+	ok := []string{
+		"http://example.com/",
+		"http://example.com/a/b/a/b/",
+		"http://example.com/calendar/2013/09/?page=1"}
+	for _, rawurl := range ok {
+		u, _ := url.Parse(rawurl)
+		assert.Equal(t, d.Check(u), "", rawurl)
+	}
+
+	params := make([]string, 0)
+	for i := 0; i <= DefaultTrapConfig.MaxQueryParams; i++ {
+		params = append(params, "p"+strconv.Itoa(i)+"=1")
+	}
+
+	traps := []string{
+		"http://example.com/" + strings.Repeat("a", DefaultTrapConfig.MaxURLLength),
+		"http://example.com/a/b/a/b/a/b/",
+		"http://example.com/?" + strings.Join(params, "&")}
+	for _, rawurl := range traps {
+		u, _ := url.Parse(rawurl)
+		assert.NotEqual(t, d.Check(u), "", rawurl)
+	}
+}
+
+func TestTrapDetectorObserve(t *testing.T) {
+	config := DefaultTrapConfig
+	config.MaxSimilarPages = 3
+	d := NewTrapDetector(config)
+
+	body := []byte("<html><body>No events are scheduled on this day.</body></html>")
+	for i := 0; i <= config.MaxSimilarPages; i++ {
+		u, _ := url.Parse("http://example.com/calendar/" + strconv.Itoa(2000+i))
+		assert.Equal(t, d.Check(u), "")
+		d.Observe(u, body)
+	}
+
+	next, _ := url.Parse("http://example.com/calendar/3000")
+	assert.NotEqual(t, d.Check(next), "")
+
+	other, _ := url.Parse("http://example.com/about")
+	assert.Equal(t, d.Check(other), "")
+
+	report := d.Report()
+	if assert.Equal(t, len(report), 1) {
+		assert.Equal(t, report[0].Host, "example.com")
+		assert.Equal(t, report[0].Pattern, "/calendar/#")
+	}
+}
+
+func TestTrapDetectorPrune(t *testing.T) {
+	config := DefaultTrapConfig
+	config.MaxSimilarPages = 1
+	d := NewTrapDetector(config)
+
+	body := []byte("<html><body>No events are scheduled on this day.</body></html>")
+	for i := 0; i < 2; i++ {
+		u, _ := url.Parse("http://example.com/calendar/" + strconv.Itoa(2000+i))
+		d.Observe(u, body)
+	}
+	for i := 0; i < 10; i++ {
+		u, _ := url.Parse("http://host" + strconv.Itoa(i) + ".example.org/")
+		d.Observe(u, body)
+	}
+	assert.Equal(t, len(d.patterns), 11)
+
+	// patterns not observed lately are forgotten, but not the flagged one
+	defer func(ttl time.Duration) { trapPatternTTL = ttl }(trapPatternTTL)
+	trapPatternTTL = 0
+	u, _ := url.Parse("http://example.net/")
+	d.Observe(u, body)
+	assert.Equal(t, len(d.patterns), 2)
+
+	next, _ := url.Parse("http://example.com/calendar/3000")
+	assert.NotEqual(t, d.Check(next), "")
+}
+
+func TestSimhash(t *testing.T) {
+	x := simhash([]byte("the quick brown fox jumps over the lazy dog on monday"))
+	y := simhash([]byte("the quick brown fox jumps over the lazy dog on tuesday"))
+	z := simhash([]byte("lorem ipsum dolor sit amet consectetur adipiscing elit"))
+
+	assert.True(t, hammingDistance(x, y) < hammingDistance(x, z))
+	assert.Equal(t, hammingDistance(x, x), 0)
+}
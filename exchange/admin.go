@@ -0,0 +1,160 @@
+package exchange
+
+import (
+	"../logging"
+	"../protocol"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// The admin API of the exchange is served over HTTP in JSON:
+//
+//	GET  /crawlers               every crawler in the cluster
+//	GET  /ring                   the points of the hash ring
+//	GET  /owner?url=URL          the crawler URL is routed to
+//	POST /urls                   submit seeds, as SubmitURLs of gRPC
+//	POST /crawlers/{id}/drain    stop routing URLs to a crawler
+//	POST /crawlers/{id}/evict    disconnect a crawler
+//
+// Only crawlers connected to the exchange can be drained or evicted.
+
+type SubmitURLsRequest struct {
+	Links []*protocol.Link `json:"urls"`
+}
+
+// Rejection tells why a URL was not accepted.
+type Rejection struct {
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+type SubmitURLsResponse struct {
+	Accepted int         `json:"accepted"`
+	Rejected []Rejection `json:"rejected,omitempty"`
+}
+
+// CrawlerInfo describes a crawler. Only the ones connected to the exchange
+// asked have an address and the counts.
+type CrawlerInfo struct {
+	ID          string     `json:"id"`
+	Exchange    string     `json:"exchange"`
+	Weight      float64    `json:"weight"`
+	Addr        string     `json:"addr,omitempty"`
+	Since       *time.Time `json:"since,omitempty"`
+	Sent        uint64     `json:"sent,omitempty"`
+	Queued      int        `json:"queued,omitempty"`
+	Outstanding int        `json:"outstanding,omitempty"`
+	Draining    bool       `json:"draining,omitempty"`
+}
+
+type ListCrawlersResponse struct {
+	Crawlers []CrawlerInfo `json:"crawlers"`
+}
+
+type GetRingResponse struct {
+	Points []RingPoint `json:"points"`
+}
+
+// OwnerResponse tells the crawler which a URL is routed to.
+type OwnerResponse struct {
+	URL      string `json:"url"`
+	Crawler  string `json:"crawler"`
+	Exchange string `json:"exchange"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminServer struct {
+	e *Exchange
+}
+
+// AdminHandler returns the handler of the admin API of e.
+func (e *Exchange) AdminHandler() http.Handler {
+	s := &adminServer{e}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /crawlers", s.listCrawlers)
+	mux.HandleFunc("GET /ring", s.getRing)
+	mux.HandleFunc("GET /owner", s.getOwner)
+	mux.HandleFunc("POST /urls", s.submitURLs)
+	mux.HandleFunc("POST /crawlers/{id}/drain", s.drainCrawler)
+	mux.HandleFunc("POST /crawlers/{id}/evict", s.evictCrawler)
+	return mux
+}
+
+func (s *adminServer) listCrawlers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &ListCrawlersResponse{s.e.crawlerInfos()})
+}
+
+func (s *adminServer) getRing(w http.ResponseWriter, r *http.Request) {
+	points := s.e.router.Ring()
+	if points == nil {
+		points = []RingPoint{}
+	}
+	writeJSON(w, http.StatusOK, &GetRingResponse{points})
+}
+
+func (s *adminServer) getOwner(w http.ResponseWriter, r *http.Request) {
+	rawurl := r.URL.Query().Get("url")
+	if rawurl == "" {
+		writeError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+
+	crawler, err := s.e.router.Route(rawurl)
+	if err == EmptyError {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &OwnerResponse{rawurl, crawler.GetId(), string(crawler.GetExchangeId())})
+}
+
+func (s *adminServer) submitURLs(w http.ResponseWriter, r *http.Request) {
+	req := new(SubmitURLsRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.e.submitSeeds(req.Links, r.RemoteAddr))
+}
+
+func (s *adminServer) drainCrawler(w http.ResponseWriter, r *http.Request) {
+	s.crawlerAction(w, s.e.Drain(r.PathValue("id")))
+}
+
+func (s *adminServer) evictCrawler(w http.ResponseWriter, r *http.Request) {
+	s.crawlerAction(w, s.e.Evict(r.PathValue("id")))
+}
+
+// crawlerAction answers a request to act on a crawler which ended with err.
+func (s *adminServer) crawlerAction(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case CrawlerNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case RemoteCrawler, CrawlerDraining:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write admin response", logging.Error, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &adminError{message})
+}
@@ -0,0 +1,160 @@
+package exchange
+
+import (
+	"../protocol"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAdminCrawlers(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+	server := httptest.NewServer(e.AdminHandler())
+	defer server.Close()
+
+	crawler := joinExchange(t, e)
+	defer crawler.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+
+	// seeds submitted over the API are sent to the crawler
+	seed, _ := protocol.ParseLink("http://example.com/")
+	data, _ := json.Marshal(&SubmitURLsRequest{[]*protocol.Link{seed}})
+	resp, err := http.Post(server.URL+"/urls", "application/json", bytes.NewReader(data))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	submitted := new(SubmitURLsResponse)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(submitted))
+	resp.Body.Close()
+	assert.Equal(t, submitted.Accepted, 1)
+	m := readURLs(t, crawler)
+	crawler.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+
+	resp, err = http.Get(server.URL + "/crawlers")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	crawlers := new(ListCrawlersResponse)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(crawlers))
+	resp.Body.Close()
+	if !assert.Equal(t, len(crawlers.Crawlers), 1) {
+		t.FailNow()
+	}
+	info := crawlers.Crawlers[0]
+	assert.Equal(t, info.Exchange, "a")
+	assert.NotEqual(t, info.Addr, "")
+	if assert.NotNil(t, info.Since) {
+		assert.WithinDuration(t, *info.Since, time.Now(), 5*time.Second)
+	}
+	assert.Equal(t, info.Sent, uint64(1))
+	assert.Equal(t, info.Outstanding, 1)
+
+	resp, err = http.Get(server.URL + "/ring")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	ring := new(GetRingResponse)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(ring))
+	resp.Body.Close()
+	assert.Equal(t, len(ring.Points), defaultVnodes)
+
+	resp, err = http.Get(server.URL + "/owner?url=" + url.QueryEscape("http://example.com/a"))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	owner := new(OwnerResponse)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(owner))
+	resp.Body.Close()
+	assert.Equal(t, owner.Crawler, info.ID)
+	assert.Equal(t, owner.Exchange, "a")
+
+	resp, err = http.Get(server.URL + "/owner")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestAdminDrainAndEvict(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+	server := httptest.NewServer(e.AdminHandler())
+	defer server.Close()
+
+	crawler := joinExchange(t, e)
+	defer crawler.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+	id := e.router.Crawlers()[0].GetId()
+
+	statuses := []struct {
+		id     string
+		status int
+	}{
+		{"unknown", http.StatusNotFound},
+		{id, http.StatusNoContent},
+		{id, http.StatusConflict}}
+	for _, s := range statuses {
+		resp, err := http.Post(server.URL+"/crawlers/"+s.id+"/drain", "", nil)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, s.status, s.id)
+	}
+
+	// a drained crawler owns no URLs, so they are held
+	resp, err := http.Get(server.URL + "/owner?url=" + url.QueryEscape("http://example.com/"))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+
+	seed, _ := protocol.ParseLink("http://example.com/")
+	data, _ := json.Marshal(&SubmitURLsRequest{[]*protocol.Link{seed}})
+	resp, err = http.Post(server.URL+"/urls", "application/json", bytes.NewReader(data))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	waitFor(t, func() bool {
+		return e.held.Len() == 1
+	})
+
+	resp, err = http.Post(server.URL+"/crawlers/"+id+"/evict", "", nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 0
+	})
+
+	crawler.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		m, err := crawler.Read()
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		if m.Type == protocol.Error {
+			assert.Equal(t, m.Error, "evicted")
+			break
+		}
+	}
+}
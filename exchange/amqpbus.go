@@ -0,0 +1,81 @@
+package exchange
+
+import (
+	"github.com/streadway/amqp"
+	"sync"
+)
+
+const (
+	amqpExchange = "kaken"
+)
+
+// AMQPBus is a Bus over an AMQP broker such as RabbitMQ. Topics are routing
+// keys of a topic exchange, and each subscription gets its own queue.
+type AMQPBus struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	sync.Mutex
+}
+
+func NewAMQPBus(url string) (*AMQPBus, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := channel.ExchangeDeclare(amqpExchange, "topic", true, false, false, false, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &AMQPBus{
+		conn:    conn,
+		channel: channel}, nil
+}
+
+func (b *AMQPBus) Publish(topic string, body []byte) error {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.channel.Publish(amqpExchange, topic, false, false, amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        body})
+}
+
+func (b *AMQPBus) Subscribe(topic string) (<-chan []byte, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	queue, err := b.channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.channel.QueueBind(queue.Name, topic, amqpExchange, false, nil); err != nil {
+		return nil, err
+	}
+
+	deliveries, err := b.channel.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		for delivery := range deliveries {
+			ch <- delivery.Body
+		}
+	}()
+	return ch, nil
+}
+
+func (b *AMQPBus) Close() error {
+	return b.conn.Close()
+}
@@ -0,0 +1,137 @@
+package exchange
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+var (
+	InvalidSnapshot = errors.New("Snapshot of Bloom filter is invalid")
+)
+
+// BloomFilter tells whether a key may have been added, with false positives
+// at the rate it was sized for and no false negatives.
+type BloomFilter struct {
+	bits []uint64
+	m    uint64 // bits
+	k    uint64 // hashes of a key
+	set  uint64 // bits set
+	sync.Mutex
+}
+
+// NewBloomFilter returns a filter for n keys with false positives at the
+// rate p.
+func NewBloomFilter(n int, p float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.001
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return newBloomFilter(m, k)
+}
+
+func newBloomFilter(m uint64, k uint64) *BloomFilter {
+	return &BloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// TestAndAdd adds key, and reports whether it may have been added before.
+func (f *BloomFilter) TestAndAdd(key string) bool {
+	h1, h2 := f.hash(key)
+
+	f.Lock()
+	defer f.Unlock()
+
+	present := true
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			present = false
+			f.bits[bit/64] |= 1 << (bit % 64)
+			f.set++
+		}
+	}
+	return present
+}
+
+// Test reports whether key may have been added, without adding it.
+func (f *BloomFilter) Test(key string) bool {
+	h1, h2 := f.hash(key)
+
+	f.Lock()
+	defer f.Unlock()
+
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// FalsePositiveRate estimates the rate of false positives from the bits
+// set, which rises toward 1 as keys are added past the size of the filter.
+func (f *BloomFilter) FalsePositiveRate() float64 {
+	f.Lock()
+	defer f.Unlock()
+
+	return math.Pow(float64(f.set)/float64(f.m), float64(f.k))
+}
+
+// hash returns two hashes of key, which make the k hashes by double hashing.
+func (f *BloomFilter) hash(key string) (uint64, uint64) {
+	h := sha1.New()
+	io.WriteString(h, key)
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+// WriteTo writes the filter to w, to be read back by ReadBloomFilter. Keys
+// may be added meanwhile.
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	f.Lock()
+	header := []uint64{f.m, f.k}
+	bits := make([]uint64, len(f.bits))
+	copy(bits, f.bits)
+	f.Unlock()
+
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.BigEndian, bits); err != nil {
+		return 16, err
+	}
+	return 16 + int64(len(bits))*8, nil
+}
+
+// ReadBloomFilter reads a filter written by WriteTo.
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	header := make([]uint64, 2)
+	if err := binary.Read(r, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+	if header[0] == 0 || header[1] == 0 || header[0] > 1<<40 {
+		return nil, InvalidSnapshot
+	}
+
+	f := newBloomFilter(header[0], header[1])
+	if err := binary.Read(r, binary.BigEndian, f.bits); err != nil {
+		return nil, err
+	}
+	for _, word := range f.bits {
+		f.set += uint64(bits.OnesCount64(word))
+	}
+	return f, nil
+}
@@ -0,0 +1,100 @@
+package exchange
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := NewBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		f.TestAndAdd("http://example.com/" + strconv.Itoa(i))
+	}
+	for i := 0; i < 10000; i++ {
+		if !f.TestAndAdd("http://example.com/" + strconv.Itoa(i)) {
+			t.Fatalf("http://example.com/%d was forgotten", i)
+		}
+	}
+
+	// probing adds the keys too, so a few are enough
+	positives := 0
+	for i := 0; i < 1000; i++ {
+		if f.TestAndAdd("http://example.org/" + strconv.Itoa(i)) {
+			positives++
+		}
+	}
+	t.Logf("%d false positives in 1000", positives)
+	assert.True(t, positives < 30)
+}
+
+func TestBloomFilterSnapshot(t *testing.T) {
+	f := NewBloomFilter(100, 0.01)
+	f.TestAndAdd("http://example.com/")
+
+	var buf bytes.Buffer
+	_, err := f.WriteTo(&buf)
+	assert.Nil(t, err)
+
+	read, err := ReadBloomFilter(&buf)
+	if assert.Nil(t, err) {
+		assert.True(t, read.TestAndAdd("http://example.com/"))
+		assert.False(t, read.TestAndAdd("http://example.org/"))
+	}
+
+	_, err = ReadBloomFilter(bytes.NewReader(make([]byte, 16)))
+	assert.Equal(t, err, InvalidSnapshot)
+}
+
+func TestDedupSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+
+	d, err := OpenDedup(path, 100, 0.01)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.False(t, d.Seen("http://example.com/"))
+	d.Add("http://example.com/")
+	assert.True(t, d.Seen("http://example.com/"))
+	hits, misses := d.Stats()
+	assert.Equal(t, hits, uint64(1))
+	assert.Equal(t, misses, uint64(1))
+	assert.Nil(t, d.Snapshot())
+
+	d, err = OpenDedup(path, 100, 0.01)
+	if assert.Nil(t, err) {
+		assert.True(t, d.Seen("http://example.com/"))
+	}
+
+	// both generations are snapshotted
+	for i := 0; d.previous == nil; i++ {
+		d.Add("http://example.org/" + strconv.Itoa(i))
+	}
+	assert.Nil(t, d.Snapshot())
+	d, err = OpenDedup(path, 100, 0.01)
+	if assert.Nil(t, err) && assert.NotNil(t, d.previous) {
+		assert.True(t, d.Seen("http://example.com/"))
+	}
+}
+
+func TestDedupGenerations(t *testing.T) {
+	d := NewDedup(1000, 0.01)
+	for i := 0; i < 10000; i++ {
+		d.Add("http://example.com/" + strconv.Itoa(i))
+		assert.True(t, d.FalsePositiveRate() < 0.03)
+	}
+	// the latest URLs are remembered and the oldest forgotten
+	assert.True(t, d.Seen("http://example.com/9999"))
+	assert.False(t, d.Seen("http://example.com/0"))
+
+	positives := 0
+	for i := 0; i < 1000; i++ {
+		if d.Seen("http://example.org/" + strconv.Itoa(i)) {
+			positives++
+		}
+	}
+	t.Logf("%d false positives in 1000", positives)
+	assert.True(t, positives < 50)
+}
@@ -0,0 +1,103 @@
+package exchange
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	BusClosed = errors.New("Bus was closed")
+)
+
+// Bus is a publish/subscribe message bus connecting the exchanges of a
+// cluster. Every subscriber of a topic receives each message published to it.
+type Bus interface {
+	Publish(topic string, body []byte) error
+	Subscribe(topic string) (<-chan []byte, error)
+	Close() error
+}
+
+// MemoryBus is a Bus within a process, which stands in for a broker when the
+// exchanges of a cluster share a process.
+type MemoryBus struct {
+	subscribers map[string][]chan []byte
+	closed      bool
+	sync.RWMutex
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		subscribers: make(map[string][]chan []byte),
+		closed:      false}
+}
+
+func (b *MemoryBus) Publish(topic string, body []byte) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return BusClosed
+	}
+
+	for _, ch := range b.subscribers[topic] {
+		ch <- body
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(topic string) (<-chan []byte, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return nil, BusClosed
+	}
+
+	in := make(chan []byte)
+	out := make(chan []byte)
+	go queueMessages(in, out)
+
+	b.subscribers[topic] = append(b.subscribers[topic], in)
+	return out, nil
+}
+
+// queueMessages relays messages from in to out, queueing as many as needed
+// so that publishers never wait for a slow subscriber, as with a broker.
+func queueMessages(in <-chan []byte, out chan<- []byte) {
+	defer close(out)
+
+	queue := make([][]byte, 0)
+	for {
+		var send chan<- []byte
+		var next []byte
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+
+		select {
+		case body, ok := <-in:
+			if !ok {
+				return
+			}
+			queue = append(queue, body)
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+}
+
+func (b *MemoryBus) Close() error {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		for _, chans := range b.subscribers {
+			for _, ch := range chans {
+				close(ch)
+			}
+		}
+	}
+	return nil
+}
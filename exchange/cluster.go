@@ -0,0 +1,285 @@
+package exchange
+
+import (
+	"../logging"
+	"../protocol"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	membershipTopic = "membership"
+	urlTopicPrefix  = "urls."
+	forwardsPrefix  = "FORWARDS " // followed by the times a URL has been forwarded, before it
+
+	// Times a URL is forwarded at most, so that exchanges which disagree on
+	// membership do not pass it back and forth.
+	maxForwards = 2
+)
+
+var (
+	ForwardLoop = errors.New("URL has been forwarded too many times")
+
+	// How often an exchange republishes its crawlers, and how long the
+	// crawlers of a silent exchange are kept in the ring.
+	membershipInterval = 10 * time.Second
+	membershipTimeout  = 3 * membershipInterval
+)
+
+type membership struct {
+	Exchange string             `json:"exchange"`
+	Crawlers []string           `json:"crawlers"`
+	Weights  map[string]float64 `json:"weights,omitempty"` // 1 unless given
+	Loads    map[string]int     `json:"loads,omitempty"`   // outstanding URLs, 0 unless given
+	Leaving  bool               `json:"leaving"`
+}
+
+// forwardedLink is a URL forwarded by another exchange, and the times it has
+// been forwarded.
+type forwardedLink struct {
+	link     *protocol.Link
+	forwards int
+}
+
+type member struct {
+	crawlers map[string]*Crawler
+	lastSeen time.Time
+}
+
+// Cluster joins exchanges over a Bus. Each exchange publishes the crawlers
+// connected to it, so that the ring of every exchange spans the crawlers of
+// the whole cluster, and URLs owned by a remote crawler are forwarded to its
+// exchange.
+type Cluster struct {
+	id      exchangeid
+	bus     Bus
+	router  *Router
+	members map[exchangeid]*member
+	logger  *slog.Logger
+	sync.Mutex
+}
+
+func NewCluster(id exchangeid, bus Bus, router *Router) *Cluster {
+	return &Cluster{
+		id:      id,
+		bus:     bus,
+		router:  router,
+		members: make(map[exchangeid]*member),
+		logger:  slog.Default().With(logging.ExchangeID, string(id))}
+}
+
+// Announce publishes the crawlers connected to this exchange.
+func (c *Cluster) Announce() error {
+	return c.publishMembership(false)
+}
+
+// Forward sends link to the exchange eid to be routed there, as forwarded
+// forwards times so far including this one.
+func (c *Cluster) Forward(eid exchangeid, link *protocol.Link, forwards int) error {
+	body := forwardsPrefix + strconv.Itoa(forwards) + "\n" + link.Encode()
+	return c.bus.Publish(urlTopicPrefix+string(eid), []byte(body))
+}
+
+// parseForwarded decodes a URL sent by Forward. Exchanges which do not count
+// forwards send the link alone, which is taken as forwarded once.
+func parseForwarded(body string) (forwardedLink, error) {
+	f := forwardedLink{forwards: 1}
+	if strings.HasPrefix(body, forwardsPrefix) {
+		line, rest, _ := strings.Cut(body[len(forwardsPrefix):], "\n")
+		forwards, err := strconv.Atoi(line)
+		if err != nil || forwards < 1 {
+			return f, protocol.InvalidLink
+		}
+		f.forwards, body = forwards, rest
+	}
+
+	link, err := protocol.ParseLink(body)
+	f.link = link
+	return f, err
+}
+
+// Run receives membership and forwarded URLs until quit is signaled, and
+// then announces that this exchange is leaving. Forwarded URLs are passed
+// to fchan.
+func (c *Cluster) Run(fchan chan<- forwardedLink, quit chan bool) {
+	memberships, err := c.bus.Subscribe(membershipTopic)
+	if err != nil {
+		c.logger.Error("Failed to subscribe membership", logging.Error, err)
+		<-quit
+		quit <- true
+		return
+	}
+
+	urls, err := c.bus.Subscribe(urlTopicPrefix + string(c.id))
+	if err != nil {
+		c.logger.Error("Failed to subscribe URLs", logging.Error, err)
+		<-quit
+		quit <- true
+		return
+	}
+
+	if err := c.Announce(); err != nil {
+		c.logger.Warn("Failed to announce membership", logging.Error, err)
+	}
+
+	ticker := time.NewTicker(membershipInterval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-quit:
+			break loop
+		case body, ok := <-memberships:
+			if !ok {
+				<-quit
+				break loop
+			}
+			c.handleMembership(body)
+		case body, ok := <-urls:
+			if !ok {
+				<-quit
+				break loop
+			}
+
+			forwarded, err := parseForwarded(string(body))
+			if err != nil {
+				c.logger.Warn("Invalid URL forwarded", logging.URL, string(body), logging.Error, err)
+				continue
+			}
+
+			select {
+			case fchan <- forwarded:
+			case <-quit:
+				break loop
+			}
+		case <-ticker.C:
+			if err := c.Announce(); err != nil {
+				c.logger.Warn("Failed to announce membership", logging.Error, err)
+			}
+			c.expire()
+		}
+	}
+
+	if err := c.publishMembership(true); err != nil {
+		c.logger.Warn("Failed to announce leaving", logging.Error, err)
+	}
+	quit <- true
+}
+
+func (c *Cluster) publishMembership(leaving bool) error {
+	m := membership{
+		Exchange: string(c.id),
+		Crawlers: c.router.Members(c.id),
+		Leaving:  leaving}
+	if leaving {
+		m.Crawlers = []string{}
+	}
+	for _, crawler := range c.router.Crawlers() {
+		if crawler.GetExchangeId() == c.id && crawler.GetWeight() != 1 && !leaving {
+			if m.Weights == nil {
+				m.Weights = make(map[string]float64)
+			}
+			m.Weights[crawler.GetId()] = crawler.GetWeight()
+		}
+		if crawler.GetExchangeId() == c.id && !leaving {
+			if load := c.router.Outstanding(crawler); load > 0 {
+				if m.Loads == nil {
+					m.Loads = make(map[string]int)
+				}
+				m.Loads[crawler.GetId()] = load
+			}
+		}
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.bus.Publish(membershipTopic, body)
+}
+
+func (c *Cluster) handleMembership(body []byte) {
+	var m membership
+	if err := json.Unmarshal(body, &m); err != nil {
+		c.logger.Warn("Invalid membership", logging.Error, err)
+		return
+	}
+
+	eid := exchangeid(m.Exchange)
+	if eid == c.id {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	known, exists := c.members[eid]
+	if !exists {
+		known = &member{crawlers: make(map[string]*Crawler)}
+		c.members[eid] = known
+		c.logger.Info("Exchange joined the cluster", "peer", eid)
+
+		// let the newcomer know our crawlers without waiting for the interval
+		go c.Announce()
+	}
+	known.lastSeen = time.Now()
+
+	current := make(map[string]bool)
+	for _, id := range m.Crawlers {
+		current[id] = true
+		weight := validWeight(m.Weights[id])
+		if crawler, exists := known.crawlers[id]; !exists || crawler.GetWeight() != weight {
+			if exists {
+				c.router.Remove(crawler)
+			}
+
+			crawler := newRemoteCrawler(id, eid, weight)
+			known.crawlers[id] = crawler
+			c.router.Add(crawler)
+		}
+		c.router.SetLoad(known.crawlers[id], m.Loads[id])
+	}
+
+	for id, crawler := range known.crawlers {
+		if !current[id] {
+			delete(known.crawlers, id)
+			c.router.Remove(crawler)
+		}
+	}
+
+	if m.Leaving {
+		delete(c.members, eid)
+		c.forget(eid)
+		c.logger.Info("Exchange left the cluster", "peer", eid)
+	}
+}
+
+// forget lets the bus drop what it keeps for the exchange eid, which left.
+func (c *Cluster) forget(eid exchangeid) {
+	if bus, ok := c.bus.(interface{ Forget(exchangeid) }); ok {
+		bus.Forget(eid)
+	}
+}
+
+func (c *Cluster) expire() {
+	c.Lock()
+	defer c.Unlock()
+
+	deadline := time.Now().Add(-membershipTimeout)
+	for eid, known := range c.members {
+		if known.lastSeen.Before(deadline) {
+			for _, crawler := range known.crawlers {
+				c.router.Remove(crawler)
+			}
+			delete(c.members, eid)
+			c.forget(eid)
+			c.logger.Warn("Exchange has been silent and is removed from the cluster", "peer", eid)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package exchange
+
+import (
+	"../protocol"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func startExchange(t *testing.T, id string, bus Bus) (*Exchange, func()) {
+	return startExchangeWith(t, id, func(e *Exchange) {
+		if bus != nil {
+			e.SetBus(bus)
+		}
+	})
+}
+
+// startExchangeWith starts an exchange after setup has configured it.
+func startExchangeWith(t *testing.T, id string, setup func(e *Exchange)) (*Exchange, func()) {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewExchange(id, socket)
+	setup(e)
+
+	quit := make(chan bool, 1)
+	quitted := make(chan bool, 1)
+	go e.Start(quit, quitted)
+
+	return e, func() {
+		quit <- true
+		<-quitted
+	}
+}
+
+func dialExchange(t *testing.T, e *Exchange) protocol.Conn {
+	conn, err := net.Dial("tcp", e.socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protocol.NewFramedConn(conn)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryBus(t *testing.T) {
+	bus := NewMemoryBus()
+
+	ch1, err := bus.Subscribe("topic")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	ch2, _ := bus.Subscribe("topic")
+	other, _ := bus.Subscribe("other")
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, bus.Publish("topic", []byte{byte(i)}))
+	}
+
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, <-ch1, []byte{byte(i)})
+		assert.Equal(t, <-ch2, []byte{byte(i)})
+	}
+
+	bus.Close()
+	_, ok := <-other
+	assert.False(t, ok)
+	assert.Equal(t, bus.Publish("topic", []byte{}), BusClosed)
+}
+
+func TestClusterForward(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+
+	testClusterForward(t, bus, bus)
+}
+
+func testClusterForward(t *testing.T, busA Bus, busB Bus) {
+	a, stopA := startExchange(t, "a", busA)
+	b, stopB := startExchange(t, "b", busB)
+	defer stopB()
+
+	crawler := dialExchange(t, a)
+	defer crawler.Close()
+	crawler.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleCrawler, Weight: 2})
+
+	waitFor(t, func() bool {
+		return len(b.router.Members("a")) == 1
+	})
+	assert.Equal(t, b.router.Members("a"), a.router.Members("a"))
+	assert.Equal(t, b.router.Crawlers()[0].GetWeight(), 2.0)
+	assert.Equal(t, b.router.Ring(), a.router.Ring())
+
+	seeder := dialExchange(t, b)
+	defer seeder.Close()
+	seed, _ := protocol.ParseLink("http://example.com/\n")
+	seeder.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleSeeder})
+	seeder.Write(&protocol.Message{Type: protocol.Seeds, ID: 1, Links: []*protocol.Link{seed}})
+
+	crawler.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		m, err := crawler.Read()
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		if m.Type != protocol.URLs {
+			continue
+		}
+
+		if assert.Equal(t, len(m.Links), 1) {
+			assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+		}
+		crawler.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+		break
+	}
+
+	crawler.Close()
+	seeder.Close()
+	stopA()
+
+	waitFor(t, func() bool {
+		return len(b.router.Members("a")) == 0
+	})
+}
+
+func TestParseForwarded(t *testing.T) {
+	link, _ := protocol.ParseLink("http://example.com/\n")
+	f, err := parseForwarded(forwardsPrefix + "2\n" + link.Encode())
+	if assert.Nil(t, err) {
+		assert.Equal(t, f.forwards, 2)
+		assert.Equal(t, f.link.URL.String(), "http://example.com/")
+	}
+
+	// from an exchange which does not count forwards
+	f, err = parseForwarded(link.Encode())
+	if assert.Nil(t, err) {
+		assert.Equal(t, f.forwards, 1)
+	}
+
+	_, err = parseForwarded(forwardsPrefix + "x\n" + link.Encode())
+	assert.Equal(t, err, protocol.InvalidLink)
+}
+
+func TestExchangeForwardLoop(t *testing.T) {
+	bus := NewMemoryBus()
+	forwarded, _ := bus.Subscribe(urlTopicPrefix + "b")
+	e := NewExchange("a", nil)
+	e.SetBus(bus)
+	e.router.Add(newRemoteCrawler("c", "b", 1))
+
+	// a URL is forwarded on until it has been forwarded too many times
+	link, _ := protocol.ParseLink("http://example.com/\n")
+	assert.Nil(t, e.dispatch(link, maxForwards-1))
+	f, err := parseForwarded(string(<-forwarded))
+	if assert.Nil(t, err) {
+		assert.Equal(t, f.forwards, maxForwards)
+	}
+	assert.Equal(t, e.dispatch(link, maxForwards), ForwardLoop)
+}
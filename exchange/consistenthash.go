@@ -2,8 +2,10 @@ package exchange
 
 import (
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"io"
+	"math"
 	"sort"
 	"strconv"
 	// "log"
@@ -11,7 +13,7 @@ import (
 )
 
 const (
-	numOfVnodes int = 20
+	defaultVnodes int = 256
 )
 
 var (
@@ -45,25 +47,83 @@ func compareNodeid(x nodeid, y nodeid) int {
 }
 
 type ConsistentHash struct {
-	ring  nodering
-	nodes map[nodeid]string
+	ring    nodering
+	nodes   map[nodeid]string
+	counts  map[string]int // vnodes of each token
+	vnodes  int            // vnodes of a token of weight 1
+	loads   map[string]int // keys each token holds, for bounded loads
+	total   int            // sum of loads
+	epsilon float64        // 0 for unbounded loads
 	sync.RWMutex
 }
 
 func NewConsistentHash() *ConsistentHash {
 	c := new(ConsistentHash)
 	c.nodes = make(map[nodeid]string)
+	c.counts = make(map[string]int)
+	c.vnodes = defaultVnodes
+	c.loads = make(map[string]int)
 
 	return c
 }
 
+// SetVnodes sets the number of vnodes of a token of weight 1 added from now
+// on. More vnodes spread keys more evenly at the cost of memory.
+func (c *ConsistentHash) SetVnodes(n int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if n > 0 {
+		c.vnodes = n
+	}
+}
+
+// SetLoadBound makes Get pass over a token which holds (1+epsilon) times
+// its share of the loads, and take the next token on the ring which does
+// not, as in consistent hashing with bounded loads. Keys stay with their
+// token while it has room. 0 turns the bound off.
+func (c *ConsistentHash) SetLoadBound(epsilon float64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if epsilon >= 0 {
+		c.epsilon = epsilon
+	}
+}
+
+// SetLoad tells the number of keys token holds at present.
+func (c *ConsistentHash) SetLoad(token string, load int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, exists := c.counts[token]; !exists {
+		return
+	}
+	c.total += load - c.loads[token]
+	c.loads[token] = load
+}
+
 func (c *ConsistentHash) Add(token string) {
+	c.AddWeighted(token, 1)
+}
+
+// AddWeighted adds token with vnodes in proportion to weight, so that it
+// takes about weight times as many keys as a token of weight 1. A token
+// added again takes the new weight.
+func (c *ConsistentHash) AddWeighted(token string, weight float64) {
 	c.Lock()
 	defer c.Unlock()
 
-	for i := 0; i < numOfVnodes; i++ {
+	c.remove(token)
+
+	n := int(weight*float64(c.vnodes) + 0.5)
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
 		c.nodes[c.hashKey(c.vnodeId(token, i))] = token
 	}
+	c.counts[token] = n
 
 	c.updateRing()
 }
@@ -72,14 +132,45 @@ func (c *ConsistentHash) Remove(token string) {
 	c.Lock()
 	defer c.Unlock()
 
-	for i := 0; i < numOfVnodes; i++ {
+	c.remove(token)
+	c.updateRing()
+}
+
+func (c *ConsistentHash) remove(token string) {
+	for i := 0; i < c.counts[token]; i++ {
 		delete(c.nodes, c.hashKey(c.vnodeId(token, i)))
 	}
+	delete(c.counts, token)
+	c.total -= c.loads[token]
+	delete(c.loads, token)
+}
 
-	c.updateRing()
+// Get returns the token which takes key, within the load bound if one is
+// set.
+func (c *ConsistentHash) Get(key string) (string, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.ring) == 0 {
+		return "", EmptyError
+	}
+
+	i := c.search(c.hashKey(key))
+	if c.epsilon == 0 {
+		return c.nodes[c.ring[i]], nil
+	}
+
+	for n := 0; n < len(c.ring); n++ {
+		token := c.nodes[c.ring[(i+n)%len(c.ring)]]
+		if c.loads[token] < c.capacity(token) {
+			return token, nil
+		}
+	}
+	return c.nodes[c.ring[i]], nil
 }
 
-func (c *ConsistentHash) Get(token string) (string, error) {
+// Owner returns the token which takes key regardless of loads.
+func (c *ConsistentHash) Owner(key string) (string, error) {
 	c.RLock()
 	defer c.RUnlock()
 
@@ -87,10 +178,36 @@ func (c *ConsistentHash) Get(token string) (string, error) {
 		return "", EmptyError
 	}
 
-	i := c.search(c.hashKey(token))
+	i := c.search(c.hashKey(key))
 	return c.nodes[c.ring[i]], nil
 }
 
+// capacity is the load bound of token including the key being placed, in
+// proportion to the vnodes of token.
+func (c *ConsistentHash) capacity(token string) int {
+	share := float64(c.total+1) * float64(c.counts[token]) / float64(len(c.ring))
+	return int(math.Ceil((1 + c.epsilon) * share))
+}
+
+// RingPoint is a virtual node on the ring, which takes the keys hashed up
+// to Key.
+type RingPoint struct {
+	Key   string `json:"key"` // hex encoded
+	Token string `json:"token"`
+}
+
+// Points returns the virtual nodes in ring order.
+func (c *ConsistentHash) Points() []RingPoint {
+	c.RLock()
+	defer c.RUnlock()
+
+	points := make([]RingPoint, len(c.ring))
+	for i, key := range c.ring {
+		points[i] = RingPoint{hex.EncodeToString(key[:]), c.nodes[key]}
+	}
+	return points
+}
+
 func (c *ConsistentHash) vnodeId(token string, i int) string {
 	return token + "$" + strconv.Itoa(i)
 }
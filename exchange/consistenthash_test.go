@@ -4,14 +4,19 @@ import (
 	"crypto/sha1"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"math"
 	"math/rand"
 	"strconv"
 	"testing"
 )
 
 func isNodeExists(c *ConsistentHash, token string) bool {
+	if c.counts[token] == 0 {
+		return false
+	}
+
 	var target nodeid
-	for i := 0; i < numOfVnodes; i++ {
+	for i := 0; i < c.counts[token]; i++ {
 		key := c.hashKey(c.vnodeId(token, i))
 
 		if _, exists := c.nodes[key]; !exists {
@@ -37,15 +42,16 @@ func TestNewConsistentHash(t *testing.T) {
 	c := NewConsistentHash()
 	assert.Equal(t, len(c.ring), 0)
 	assert.Equal(t, len(c.nodes), 0)
-	assert.Equal(t, numOfVnodes, 20)
+	assert.Equal(t, c.vnodes, defaultVnodes)
+	assert.True(t, defaultVnodes > 20)
 }
 
 func TestConsistentHashAdd(t *testing.T) {
 	c := NewConsistentHash()
 
 	c.Add("testnode")
-	assert.Equal(t, len(c.ring), numOfVnodes)
-	assert.Equal(t, len(c.nodes), numOfVnodes)
+	assert.Equal(t, len(c.ring), defaultVnodes)
+	assert.Equal(t, len(c.nodes), defaultVnodes)
 
 	assert.Equal(t, isNodeExists(c, "testnode"), true)
 }
@@ -61,8 +67,8 @@ func TestConsistentHashRemove(t *testing.T) {
 	c.Remove("node2")
 	assert.Equal(t, isNodeExists(c, "node1"), true)
 
-	assert.Equal(t, len(c.ring), numOfVnodes)
-	assert.Equal(t, len(c.nodes), numOfVnodes)
+	assert.Equal(t, len(c.ring), defaultVnodes)
+	assert.Equal(t, len(c.nodes), defaultVnodes)
 }
 
 func TestConsistentHashGet(t *testing.T) {
@@ -128,3 +134,157 @@ func TestConsistentHashupdateRing(t *testing.T) {
 		assert.NotEqual(t, compareNodeid(c.ring[i-1], c.ring[i]), 1)
 	}
 }
+
+// loads hashes n keys and returns the number of keys each token takes.
+func loads(c Hash, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		token, _ := c.Get("http://host" + strconv.Itoa(i) + ".example.com")
+		counts[token]++
+	}
+	return counts
+}
+
+// coefficientOfVariation returns the standard deviation of values divided
+// by their mean.
+func coefficientOfVariation(values []float64) float64 {
+	var sum, squares float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(squares/float64(len(values))) / mean
+}
+
+func loadVariation(vnodes int) float64 {
+	c := NewConsistentHash()
+	c.SetVnodes(vnodes)
+	for i := 0; i < 10; i++ {
+		c.Add("node" + strconv.Itoa(i))
+	}
+
+	values := make([]float64, 0)
+	for _, n := range loads(c, 100000) {
+		values = append(values, float64(n))
+	}
+	return coefficientOfVariation(values)
+}
+
+func TestConsistentHashLoadVariance(t *testing.T) {
+	few := loadVariation(20)
+	many := loadVariation(defaultVnodes)
+	t.Logf("coefficient of variation: %.3f with 20 vnodes, %.3f with %d", few, many, defaultVnodes)
+
+	assert.True(t, many < few)
+	assert.True(t, many < 0.1)
+}
+
+func TestConsistentHashAddWeighted(t *testing.T) {
+	c := NewConsistentHash()
+	c.AddWeighted("small", 1)
+	c.AddWeighted("large", 3)
+	assert.Equal(t, c.counts["small"], defaultVnodes)
+	assert.Equal(t, c.counts["large"], 3*defaultVnodes)
+	assert.Equal(t, len(c.ring), 4*defaultVnodes)
+
+	counts := loads(c, 100000)
+	ratio := float64(counts["large"]) / float64(counts["small"])
+	t.Logf("large takes %.2f times as many keys as small", ratio)
+	assert.InDelta(t, ratio, 3, 0.6)
+
+	// adding again takes the new weight, and removing takes every vnode
+	c.AddWeighted("large", 0.5)
+	assert.Equal(t, c.counts["large"], defaultVnodes/2)
+	c.Remove("large")
+	assert.Equal(t, len(c.ring), defaultVnodes)
+	assert.False(t, isNodeExists(c, "large"))
+
+	c.AddWeighted("tiny", 0.0001)
+	assert.Equal(t, c.counts["tiny"], 1)
+}
+
+// place gets a token for each key and adds one to its load, as the router
+// does when it assigns a URL.
+func place(c *ConsistentHash, keys []string) map[string]int {
+	loads := make(map[string]int)
+	for _, key := range keys {
+		token, _ := c.Get(key)
+		loads[token]++
+		c.SetLoad(token, loads[token])
+	}
+	return loads
+}
+
+func TestConsistentHashBoundedLoads(t *testing.T) {
+	// a few hosts make most of the keys
+	keys := make([]string, 0)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, "http://host"+strconv.Itoa(i%3)+".example.com")
+		keys = append(keys, "http://host"+strconv.Itoa(i)+".example.org")
+	}
+
+	newHash := func() *ConsistentHash {
+		c := NewConsistentHash()
+		for i := 0; i < 4; i++ {
+			c.Add("node" + strconv.Itoa(i))
+		}
+		return c
+	}
+
+	max := func(loads map[string]int) int {
+		m := 0
+		for _, n := range loads {
+			if n > m {
+				m = n
+			}
+		}
+		return m
+	}
+
+	unbounded := max(place(newHash(), keys))
+
+	c := newHash()
+	c.SetLoadBound(0.25)
+	bounded := max(place(c, keys))
+	t.Logf("largest load: %d unbounded, %d bounded", unbounded, bounded)
+
+	limit := int(math.Ceil(1.25 * float64(len(keys)) / 4))
+	assert.True(t, bounded <= limit)
+	assert.True(t, unbounded > limit)
+}
+
+func TestConsistentHashBoundedLoadsSticky(t *testing.T) {
+	c := NewConsistentHash()
+	c.SetLoadBound(0.25)
+	for i := 0; i < 4; i++ {
+		c.Add("node" + strconv.Itoa(i))
+	}
+
+	// keys stay with their owner while it has room
+	for i := 0; i < 100; i++ {
+		key := "http://host" + strconv.Itoa(i) + ".example.com"
+		owner, _ := c.Owner(key)
+		token, _ := c.Get(key)
+		assert.Equal(t, token, owner)
+	}
+
+	key := "http://example.com"
+	owner, _ := c.Owner(key)
+	c.SetLoad(owner, 10)
+	token, _ := c.Get(key)
+	assert.NotEqual(t, token, owner)
+
+	c.SetLoad(owner, 0)
+	token, _ = c.Get(key)
+	assert.Equal(t, token, owner)
+
+	// loads of removed tokens no longer count
+	c.SetLoad(owner, 10)
+	c.Remove(owner)
+	assert.Equal(t, c.total, 0)
+	c.SetLoad(owner, 10)
+	assert.Equal(t, c.total, 0)
+}
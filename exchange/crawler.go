@@ -1,20 +1,48 @@
 package exchange
 
 import (
+	"../protocol"
 	"github.com/nu7hatch/gouuid"
-	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxWeight    = 100.0
+	maxBatchSize = 100 // URLs sent to a crawler in a message
 )
 
 type Crawler struct {
-	id   string
-	eid  exchangeid
-	conn net.Conn
+	id     string
+	eid    exchangeid
+	weight float64 // share of hosts relative to a crawler of 1
+	conn   protocol.Conn
+	outbox *protocol.Outbox // URLs sent but not acknowledged yet
+	sendq  *sendQueue       // URLs routed but not sent yet
+	since  time.Time        // when the crawler connected
+	sent   uint64           // URLs sent, accessed atomically
 }
 
-func NewCrawler(eid exchangeid, conn net.Conn) *Crawler {
+func NewCrawler(eid exchangeid, conn protocol.Conn) *Crawler {
 	id, _ := uuid.NewV4()
 
-	return &Crawler{id.String(), eid, conn}
+	return &Crawler{id.String(), eid, 1, conn, protocol.NewOutbox(), newSendQueue(), time.Now(), 0}
+}
+
+// newRemoteCrawler returns a crawler connected to another exchange.
+func newRemoteCrawler(id string, eid exchangeid, weight float64) *Crawler {
+	return &Crawler{id: id, eid: eid, weight: validWeight(weight)}
+}
+
+// validWeight returns weight within (0, maxWeight], or 1 when it is not
+// given.
+func validWeight(weight float64) float64 {
+	if weight <= 0 {
+		return 1
+	} else if weight > maxWeight {
+		return maxWeight
+	}
+	return weight
 }
 
 func (c *Crawler) GetId() string {
@@ -25,6 +53,56 @@ func (c *Crawler) GetExchangeId() exchangeid {
 	return c.eid
 }
 
-func (c *Crawler) GetConn() net.Conn {
+func (c *Crawler) GetWeight() float64 {
+	return c.weight
+}
+
+func (c *Crawler) GetConn() protocol.Conn {
 	return c.conn
 }
+
+// GetSince returns when the crawler connected to this exchange.
+func (c *Crawler) GetSince() time.Time {
+	return c.since
+}
+
+// GetSent returns the number of URLs sent to the crawler.
+func (c *Crawler) GetSent() uint64 {
+	return atomic.LoadUint64(&c.sent)
+}
+
+// Send sends links to the crawler, and keeps them until they are
+// acknowledged. Links sent over the legacy protocol are never acknowledged,
+// so they are not kept.
+func (c *Crawler) Send(links []*protocol.Link) error {
+	m := &protocol.Message{Type: protocol.URLs, Links: links}
+	if c.conn.Framed() {
+		m.ID = c.outbox.Add(links)
+	}
+	if err := c.conn.Write(m); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.sent, uint64(len(links)))
+	return nil
+}
+
+// Enqueue queues link to be sent in the background, and fails when the
+// crawler has left or is not keeping up.
+func (c *Crawler) Enqueue(link *protocol.Link) error {
+	return c.sendq.Push(link)
+}
+
+// Grant allows n more links to be sent to the crawler.
+func (c *Crawler) Grant(n int) {
+	c.sendq.Grant(n)
+}
+
+// Ack forgets the links sent with id.
+func (c *Crawler) Ack(id uint64) {
+	c.outbox.Ack(id)
+}
+
+// Overdue reports whether the crawler has been slow to acknowledge links.
+func (c *Crawler) Overdue() bool {
+	return c.outbox.Overdue(protocol.AckTimeout)
+}
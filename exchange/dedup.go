@@ -0,0 +1,153 @@
+package exchange
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// How often the dedup filter of an exchange is snapshotted.
+	dedupSnapshotInterval = 5 * time.Minute
+)
+
+// Dedup remembers the URLs which have been routed, so that the ones
+// reported again by crawlers are dropped. It may drop a new URL now and
+// then, at about twice the false positive rate of its filter.
+//
+// URLs are recorded in generations of a filter each. Once the false
+// positive rate of the current one reaches the rate it was sized for, it
+// becomes the previous one and a new one is started, so that the URLs
+// recorded before it are forgotten rather than every new URL dropped.
+type Dedup struct {
+	filter   *BloomFilter
+	previous *BloomFilter // the generation before filter, if any
+	n        int
+	p        float64
+	path     string // where the filter is snapshotted, if anywhere
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+	sync.Mutex
+}
+
+// NewDedup returns a filter for generations of n URLs with false positives
+// at the rate p.
+func NewDedup(n int, p float64) *Dedup {
+	return &Dedup{filter: NewBloomFilter(n, p), n: n, p: p}
+}
+
+// OpenDedup returns a filter which is snapshotted to the file of path, and
+// starts from the last snapshot if there is one.
+func OpenDedup(path string, n int, p float64) (*Dedup, error) {
+	d := &Dedup{n: n, p: p, path: path}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		d.filter = NewBloomFilter(n, p)
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if d.filter, err = ReadBloomFilter(reader); err != nil {
+		return nil, err
+	}
+	if d.previous, err = ReadBloomFilter(reader); err == io.EOF {
+		d.previous = nil
+	} else if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Seen reports whether url has been recorded.
+func (d *Dedup) Seen(url string) bool {
+	d.Lock()
+	seen := d.filter.Test(url) || (d.previous != nil && d.previous.Test(url))
+	d.Unlock()
+
+	if seen {
+		d.hits.Add(1)
+	} else {
+		d.misses.Add(1)
+	}
+	return seen
+}
+
+// Add records url, and starts a new generation when the current one is
+// full.
+func (d *Dedup) Add(url string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.filter.TestAndAdd(url)
+	if d.filter.FalsePositiveRate() >= d.p {
+		d.previous = d.filter
+		d.filter = NewBloomFilter(d.n, d.p)
+	}
+}
+
+// FalsePositiveRate estimates the rate of new URLs which are taken for
+// recorded ones.
+func (d *Dedup) FalsePositiveRate() float64 {
+	d.Lock()
+	defer d.Unlock()
+
+	rate := d.filter.FalsePositiveRate()
+	if d.previous != nil {
+		rate += (1 - rate) * d.previous.FalsePositiveRate()
+	}
+	return rate
+}
+
+// Stats returns the number of URLs which have been seen before, and of
+// those which have not.
+func (d *Dedup) Stats() (hits uint64, misses uint64) {
+	return d.hits.Load(), d.misses.Load()
+}
+
+// Snapshot writes the filter to its file, replacing the last snapshot only
+// once it is complete. It does nothing without a file.
+func (d *Dedup) Snapshot() error {
+	if d.path == "" {
+		return nil
+	}
+
+	tmp := d.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	filters := []*BloomFilter{d.filter}
+	if d.previous != nil {
+		filters = append(filters, d.previous)
+	}
+	d.Unlock()
+
+	w := bufio.NewWriter(file)
+	for _, filter := range filters {
+		if _, err := filter.WriteTo(w); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
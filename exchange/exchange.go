@@ -1,37 +1,121 @@
 package exchange
 
 import (
-	"bufio"
+	"../logging"
+	"../protocol"
+	"../scope"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"net/url"
-	"strings"
+	"sync"
+	"time"
 )
 
 type exchangeid string
 
+var (
+	OutOfScope    = errors.New("URL is out of scope")
+	Stopping      = errors.New("Exchange is stopping")
+	RemoteCrawler = errors.New("Crawler is connected to another exchange")
+)
+
 type Exchange struct {
-	id     exchangeid
-	router *Router
-	socket net.Listener
-	uchan  chan string
+	id      exchangeid
+	router  *Router
+	scope   *scope.Scope
+	cluster *Cluster
+	legacy  bool
+	socket  net.Listener
+	uchan   chan *protocol.Link
+	rchan   chan *protocol.Link // URLs reported by crawlers, dropped if routed already
+	fchan   chan forwardedLink  // URLs forwarded by other exchanges
+	held    *HoldQueue          // URLs waiting for a crawler to join or to keep up
+	room    chan struct{}       // signaled when URLs have been taken from a send queue
+	dedup   *Dedup              // URLs routed already, if they are dropped
+	logger  *slog.Logger
+
+	// Clients are closed and waited for when the exchange stops, and
+	// quitting is closed to make URLs dropped from then on.
+	clients     map[protocol.Conn]bool
+	clientsDone sync.WaitGroup
+	quitting    chan struct{}
+	sync.Mutex
 }
 
 func NewExchange(id string, socket net.Listener) *Exchange {
 	return &Exchange{
-		exchangeid(id),
-		NewRouter(),
-		socket,
-		make(chan string)}
+		id:       exchangeid(id),
+		router:   NewRouter(),
+		socket:   socket,
+		uchan:    make(chan *protocol.Link),
+		rchan:    make(chan *protocol.Link),
+		fchan:    make(chan forwardedLink),
+		held:     NewHoldQueue(defaultHoldSize),
+		room:     make(chan struct{}, 1),
+		clients:  make(map[protocol.Conn]bool),
+		quitting: make(chan struct{}),
+		logger:   slog.Default().With(logging.ExchangeID, id)}
+}
+
+// SetScope makes the exchange drop URLs which are not allowed by s.
+func (e *Exchange) SetScope(s *scope.Scope) {
+	e.scope = s
+}
+
+// SetLegacy makes the exchange speak the legacy line protocol instead of
+// the framed one.
+func (e *Exchange) SetLegacy(legacy bool) {
+	e.legacy = legacy
+}
+
+// SetLoadBound makes the exchange pass over crawlers which hold more than
+// (1+epsilon) times their share of outstanding URLs. It must be set after
+// the routing, and fails when the hash cannot bound loads.
+func (e *Exchange) SetLoadBound(epsilon float64) error {
+	return e.router.SetLoadBound(epsilon)
+}
+
+// SetRouting makes the exchange route URLs by the keys of strategy, shared
+// out among crawlers with hash.
+func (e *Exchange) SetRouting(strategy Strategy, hash Hash) {
+	e.router.SetStrategy(strategy)
+	e.router.SetHash(hash)
+}
+
+// SetDedup makes the exchange drop URLs reported by crawlers which d has
+// seen routed already. Seeds are always routed.
+func (e *Exchange) SetDedup(d *Dedup) {
+	e.dedup = d
+}
+
+// SetHoldQueue makes the exchange keep URLs in q while no crawler is
+// connected. The exchange closes q when it stops.
+func (e *Exchange) SetHoldQueue(q *HoldQueue) {
+	e.held = q
+}
+
+// SetBus makes the exchange a member of the cluster of exchanges connected
+// to bus.
+func (e *Exchange) SetBus(bus Bus) {
+	e.cluster = NewCluster(e.id, bus, e.router)
 }
 
 func (e *Exchange) Start(quit <-chan bool, quitted chan<- bool) {
 	squit := make(chan bool, 1)
 	uquit := make(chan bool, 1)
+	cquit := make(chan bool)
+
+	dquit := make(chan bool)
 
 	go e.waitClient(squit)
 	go e.distributeUrl(uquit)
+	if e.dedup != nil {
+		go e.snapshotDedup(dquit)
+	}
+	if e.cluster != nil {
+		go e.cluster.Run(e.fchan, cquit)
+	}
 
 	select {
 	case <-quit:
@@ -40,22 +124,39 @@ func (e *Exchange) Start(quit <-chan bool, quitted chan<- bool) {
 	case <-squit:
 	}
 
-	close(e.uchan)
+	e.closeClients()
+
+	if e.cluster != nil {
+		cquit <- true
+		<-cquit
+	}
+
 	<-uquit
 
+	if e.dedup != nil {
+		dquit <- true
+		<-dquit
+	}
+
+	if n := e.held.Len(); n > 0 {
+		e.logger.Warn("Left URLs held for crawlers", "count", n)
+	}
+	if err := e.held.Close(); err != nil {
+		e.logger.Error("Failed to close hold queue", logging.Error, err)
+	}
+
 	quitted <- true
 }
 
 func (e *Exchange) waitClient(quit chan<- bool) {
 	for {
-		log.Printf("Waiting client")
+		e.logger.Debug("Waiting client")
 		client, err := e.socket.Accept()
-		log.Printf("Accepting client")
 		if err != nil {
-			log.Println(err)
+			e.logger.Info("Stopped accepting clients", logging.Error, err)
 			break
 		}
-		log.Printf("Connected from %s", client.RemoteAddr().String())
+		e.logger.Info("Client connected", "addr", client.RemoteAddr().String())
 
 		go e.handleConnection(client)
 	}
@@ -63,76 +164,557 @@ func (e *Exchange) waitClient(quit chan<- bool) {
 	quit <- true
 }
 
+func (e *Exchange) addCrawler(crawler *Crawler) error {
+	if err := e.router.Add(crawler); err != nil {
+		return err
+	}
+
+	if e.cluster != nil {
+		if err := e.cluster.Announce(); err != nil {
+			e.logger.Warn("Failed to announce membership", logging.Error, err)
+		}
+	}
+	return nil
+}
+
+// removeCrawler removes crawler from the ring and routes the URLs it has
+// not finished to the others.
+func (e *Exchange) removeCrawler(crawler *Crawler) {
+	links := e.router.Remove(crawler)
+
+	// URLs queued since the removal are not outstanding
+	seen := make(map[string]bool)
+	for _, link := range links {
+		seen[link.URL.String()] = true
+	}
+	for _, link := range crawler.sendq.Close() {
+		if !seen[link.URL.String()] {
+			seen[link.URL.String()] = true
+			links = append(links, link)
+		}
+	}
+
+	if e.cluster != nil {
+		if err := e.cluster.Announce(); err != nil {
+			e.logger.Warn("Failed to announce membership", logging.Error, err)
+		}
+	}
+
+	e.reroute(crawler, links)
+}
+
+// reroute routes links left by crawler to the others.
+func (e *Exchange) reroute(crawler *Crawler, links []*protocol.Link) {
+	if len(links) > 0 {
+		e.logger.Info("Rerouting URLs left by crawler", logging.CrawlerID, crawler.GetId(), "count", len(links))
+	}
+	for i, link := range links {
+		select {
+		case e.uchan <- link:
+		case <-e.quitting:
+			e.logger.Warn("Dropped URLs left by crawler because exchange is stopping", logging.CrawlerID, crawler.GetId(), "count", len(links)-i)
+			urlsDropped.WithLabelValues(dropStopping).Add(float64(len(links) - i))
+			return
+		}
+	}
+}
+
+// localCrawler returns the crawler id connected to this exchange.
+func (e *Exchange) localCrawler(id string) (*Crawler, error) {
+	crawler, err := e.router.Get(id)
+	if err != nil {
+		return nil, err
+	} else if crawler.GetExchangeId() != e.id {
+		return nil, RemoteCrawler
+	}
+	return crawler, nil
+}
+
+// Drain stops routing URLs to the crawler id and routes the ones queued for
+// it to the others. The crawler finishes the URLs it has been sent, and
+// stays connected until it leaves or is evicted.
+func (e *Exchange) Drain(id string) error {
+	crawler, err := e.localCrawler(id)
+	if err != nil {
+		return err
+	}
+	if err := e.router.Drain(crawler); err != nil {
+		return err
+	}
+	e.logger.Info("Draining crawler", logging.CrawlerID, id)
+
+	links := crawler.sendq.Close()
+	e.router.Complete(crawler, links)
+
+	if e.cluster != nil {
+		if err := e.cluster.Announce(); err != nil {
+			e.logger.Warn("Failed to announce membership", logging.Error, err)
+		}
+	}
+
+	e.reroute(crawler, links)
+	return nil
+}
+
+// Evict disconnects the crawler id, and routes the URLs it has not finished
+// to the others. The crawler may join again.
+func (e *Exchange) Evict(id string) error {
+	crawler, err := e.localCrawler(id)
+	if err != nil {
+		return err
+	}
+	e.logger.Info("Evicting crawler", logging.CrawlerID, id)
+
+	// serve removes the crawler once the connection fails
+	conn := crawler.GetConn()
+	conn.Write(&protocol.Message{Type: protocol.Error, Error: "evicted"})
+	conn.Close()
+	return nil
+}
+
+// track registers conn to be closed when the exchange stops, and reports
+// false when it is stopping already.
+func (e *Exchange) track(conn protocol.Conn) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	select {
+	case <-e.quitting:
+		return false
+	default:
+	}
+
+	e.clients[conn] = true
+	e.clientsDone.Add(1)
+	return true
+}
+
+func (e *Exchange) untrack(conn protocol.Conn) {
+	e.Lock()
+	delete(e.clients, conn)
+	e.Unlock()
+
+	e.clientsDone.Done()
+}
+
+// closeClients disconnects every client and waits for them to be handled.
+func (e *Exchange) closeClients() {
+	e.Lock()
+	close(e.quitting)
+	for conn := range e.clients {
+		conn.Close()
+	}
+	e.Unlock()
+
+	e.clientsDone.Wait()
+}
+
 func (e *Exchange) handleConnection(client net.Conn) {
-	defer client.Close()
+	var conn protocol.Conn
+	if e.legacy {
+		conn = protocol.NewLegacyConn(client)
+	} else {
+		conn = protocol.NewFramedConn(client)
+	}
+
+	e.serve(conn)
+}
+
+// serve talks with a crawler or a seeder over conn until it goes away.
+func (e *Exchange) serve(conn protocol.Conn) {
+	if !e.track(conn) {
+		conn.Close()
+		return
+	}
+	defer e.untrack(conn)
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
 
-	crawler := NewCrawler(e.id, client)
-	e.router.Add(crawler)
+	// The connection becomes a crawler only after it says hello as a
+	// crawler, so that seeders never receive URLs.
+	crawler := NewCrawler(e.id, conn)
 
-	reader := bufio.NewReader(crawler.GetConn())
+	greeted := false
+	joined := false
+	quitted := false
+	done := make(chan bool)
+	defer close(done)
+
+loop:
 	for {
-		rawurl, err := reader.ReadString('\n')
+		if conn.Framed() {
+			conn.SetReadDeadline(time.Now().Add(3 * protocol.HeartbeatInterval))
+		}
+
+		m, err := conn.Read()
 		if err == io.EOF {
-			log.Printf("Connection closed by %s", client.RemoteAddr().String())
+			e.logger.Info("Connection closed by client", "addr", addr)
 
-			e.router.Remove(crawler)
+			e.removeCrawler(crawler)
 			break
+		} else if err == protocol.FrameTooLong {
+			e.logger.Warn("Frame too long from client", "addr", addr)
+			conn.Write(&protocol.Message{Type: protocol.Error, Error: err.Error()})
+
+			e.removeCrawler(crawler)
+			break
+		} else if err == protocol.InvalidMessage {
+			e.logger.Warn("Invalid message from client", "addr", addr)
+			conn.Write(&protocol.Message{Type: protocol.Error, Error: err.Error()})
+			continue
 		} else if err != nil {
-			log.Println(err)
+			e.logger.Warn("Failed to read from client", "addr", addr, logging.Error, err)
 
-			e.router.Remove(crawler)
+			e.removeCrawler(crawler)
 			break
 		}
 
-		if strings.HasSuffix(rawurl, "\r\n") {
-			rawurl = rawurl[:len(rawurl)-2] + "\n"
+		switch m.Type {
+		case protocol.Hello:
+			if m.Role == protocol.RoleCrawler && !joined {
+				// a crawler rejoining takes back its position in the ring
+				if m.Crawler != "" {
+					crawler.id = m.Crawler
+				}
+				crawler.weight = validWeight(m.Weight)
+			}
+
+			if conn.Framed() && !greeted {
+				version, ok := protocol.NegotiateVersion(m.Version)
+				if !ok {
+					e.logger.Warn("Client speaks unsupported version", "addr", addr, "version", m.Version)
+					conn.Write(&protocol.Message{Type: protocol.Error, Error: "unsupported version"})
+					break loop
+				}
+				conn.Write(&protocol.Message{Type: protocol.Hello, Version: version, Role: protocol.RoleExchange})
+				go e.sendHeartbeats(crawler, done)
+
+				// a crawler which grants credits is sent no more URLs
+				// than it can take
+				if m.Role == protocol.RoleCrawler && !joined && version >= protocol.FlowControlVersion && m.Credits > 0 {
+					crawler.sendq.Limit(m.Credits)
+				}
+			}
+			greeted = true
+
+			if m.Role == protocol.RoleCrawler && !joined {
+				if err := e.addCrawler(crawler); err != nil {
+					e.logger.Warn("Rejected crawler", "addr", addr, logging.CrawlerID, crawler.GetId(), logging.Error, err)
+					conn.Write(&protocol.Message{Type: protocol.Error, Error: err.Error()})
+					break loop
+				}
+				joined = true
+				go e.sendURLs(crawler, done)
+				e.logger.Info("Crawler joined", "addr", addr, logging.CrawlerID, crawler.GetId())
+			}
+		case protocol.Quit:
+			e.removeCrawler(crawler)
+			quitted = !conn.Framed()
+			if joined {
+				// the queue of the crawler is closed for good
+				crawler = NewCrawler(e.id, conn)
+				joined = false
+			}
+		case protocol.URLs, protocol.Seeds:
+			source := "URL"
+			if m.Type == protocol.Seeds {
+				source = "seed"
+			} else if quitted {
+				// a legacy crawler hands back the URLs it has been sent
+				// after quitting, which are routed already
+				source = "handback"
+			}
+
+			for _, link := range m.Links {
+				e.submit(link, source, addr)
+			}
+
+			if conn.Framed() {
+				conn.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+			}
+		case protocol.Ack:
+			crawler.Ack(m.ID)
+		case protocol.Done:
+			e.router.Complete(crawler, m.Links)
+		case protocol.Credit:
+			crawler.Grant(m.Credits)
+		case protocol.Heartbeat:
+		case protocol.Error:
+			e.logger.Warn("Got an error from client", "addr", addr, logging.Error, m.Error)
+		default:
+			conn.Write(&protocol.Message{Type: protocol.Error, Error: "unknown message type " + m.Type})
 		}
-		if rawurl == "QUIT\n" {
-			e.router.Remove(crawler)
-			continue
+	}
+}
+
+// submit queues link to be distributed, unless it is invalid or out of
+// scope.
+func (e *Exchange) submit(link *protocol.Link, source string, addr string) error {
+	switch {
+	case link.URL.Scheme != "http" && link.URL.Scheme != "https":
+		e.logger.Info("Dropped invalid URL", logging.URL, link.URL.String(), "addr", addr)
+		urlsDropped.WithLabelValues(dropInvalid).Inc()
+		return protocol.InvalidLink
+	case !e.scope.Allows(link.URL):
+		e.logger.Debug("Dropped out of scope URL", logging.URL, link.URL.String(), "addr", addr)
+		urlsDropped.WithLabelValues(dropOutOfScope).Inc()
+		return OutOfScope
+	}
+
+	// seeds and URLs handed back are routed again on purpose, so they are
+	// only recorded
+	queue := e.uchan
+	if e.dedup != nil && source == "URL" {
+		queue = e.rchan
+	}
+
+	select {
+	case queue <- link:
+	case <-e.quitting:
+		urlsDropped.WithLabelValues(dropStopping).Inc()
+		return Stopping
+	}
+
+	e.logger.Debug("Got a URL", logging.URL, link.URL.String(), "source", source, "addr", addr)
+	return nil
+}
+
+// snapshotDedup snapshots the dedup filter every interval and once more
+// when quit is signaled.
+func (e *Exchange) snapshotDedup(quit chan bool) {
+	ticker := time.NewTicker(dedupSnapshotInterval)
+	defer ticker.Stop()
+
+	snapshot := func() {
+		if err := e.dedup.Snapshot(); err != nil {
+			e.logger.Error("Failed to snapshot dedup filter", logging.Error, err)
 		}
+		hits, misses := e.dedup.Stats()
+		e.logger.Info("Snapshotted dedup filter", "dropped", hits, "passed", misses)
+	}
 
-		switch parsed, err := url.Parse(rawurl[:len(rawurl)-1]); {
-		case err != nil:
-			log.Printf("Invalid URL: %s (%v)", rawurl, err)
-		case parsed.Scheme != "http" && parsed.Scheme != "https":
-			log.Printf("Invalid URL: %s", rawurl)
-		default:
-			e.uchan <- rawurl
+	for {
+		select {
+		case <-ticker.C:
+			snapshot()
+		case <-quit:
+			snapshot()
+			quit <- true
+			return
+		}
+	}
+}
+
+// sendURLs sends the URLs queued for crawler in batches as its credits
+// allow, until quit is closed or the connection fails. Framed URLs which
+// fail to be sent are outstanding, and rerouted when the crawler is removed.
+func (e *Exchange) sendURLs(crawler *Crawler, quit <-chan bool) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-crawler.sendq.ready:
+		}
 
-			log.Printf("Got a URL from %s: %s", client.RemoteAddr().String(), rawurl)
+		for {
+			links := crawler.sendq.Take(maxBatchSize)
+			if len(links) == 0 {
+				break
+			}
+			if err := crawler.Send(links); err != nil {
+				e.logger.Warn("Failed to send URLs to crawler", logging.CrawlerID, crawler.GetId(), "count", len(links), logging.Error, err)
+				return
+			}
+
+			// URLs held while the queue was full may fit now
+			select {
+			case e.room <- struct{}{}:
+			default:
+			}
 		}
 	}
 }
 
-func (e *Exchange) distributeUrl(quit chan<- bool) {
-	writer := func(conn net.Conn, body []byte) error {
-		for wrote := 0; wrote < len(body); {
-			if _wrote, err := conn.Write(body[wrote:]); err == nil {
-				wrote += _wrote
-			} else {
-				return err
+// sendHeartbeats keeps the connection with crawler alive, and closes it when
+// the crawler stops acknowledging URLs, so that they are rerouted.
+func (e *Exchange) sendHeartbeats(crawler *Crawler, quit <-chan bool) {
+	ticker := time.NewTicker(protocol.HeartbeatInterval)
+	defer ticker.Stop()
+
+	conn := crawler.GetConn()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if crawler.Overdue() {
+				e.logger.Warn("Crawler timed out acknowledging URLs", logging.CrawlerID, crawler.GetId())
+				conn.Close()
+				return
+			}
+			if err := conn.Write(&protocol.Message{Type: protocol.Heartbeat}); err != nil {
+				return
 			}
 		}
-		return nil
 	}
+}
 
-	for rawurl := range e.uchan {
-		crawler, err := e.router.Route(rawurl)
-		if err != nil {
-			log.Println(err)
-			e.uchan <- rawurl
+// route returns the crawler to send link to. A URL forwarded by another
+// exchange goes to its owner regardless of loads unless a crawler of this
+// exchange can take it, since exchanges see the loads of each other late
+// and would pass it back and forth.
+func (e *Exchange) route(link *protocol.Link, forwarded bool) (*Crawler, error) {
+	crawler, err := e.router.Route(link.URL.String())
+	if err != nil || !forwarded || crawler.GetExchangeId() == e.id {
+		return crawler, err
+	}
+	return e.router.Owner(link.URL.String())
+}
+
+func (e *Exchange) distributeUrl(quit chan<- bool) {
+	defer func() {
+		quit <- true
+	}()
+
+	resume := make(chan struct{}, 1)
+	for {
+		var link *protocol.Link
+		forwards := 0
+		select {
+		case link = <-e.uchan:
+		case link = <-e.rchan:
+			// URLs are recorded once they are routed, so the ones dropped
+			// on the way are routed when they are reported again
+			if e.dedup.Seen(link.URL.String()) {
+				urlsDropped.WithLabelValues(dropDuplicate).Inc()
+				continue
+			}
+		case forwarded := <-e.fchan:
+			link, forwards = forwarded.link, forwarded.forwards
+		case <-e.router.Added():
+			e.releaseHeld(resume)
+			continue
+		case <-e.room:
+			e.releaseHeld(resume)
+			continue
+		case <-resume:
+			e.releaseHeld(resume)
 			continue
+		case <-e.quitting:
+			return
 		}
 
-		eid := crawler.GetExchangeId()
-		if eid == e.id {
-			writer(crawler.GetConn(), []byte(rawurl))
+		e.dispatch(link, forwards)
+	}
+}
+
+// releaseHeld routes a batch of the held URLs once a crawler has joined or
+// taken URLs, and signals resume when there are more, so that new URLs are
+// not held up meanwhile. URLs for a crawler which is still not keeping up
+// are held again, and wait until it takes more.
+func (e *Exchange) releaseHeld(resume chan<- struct{}) {
+	if e.held.Len() == 0 || len(e.router.Crawlers()) == 0 {
+		return
+	}
+
+	links, err := e.held.Pop(holdBatchSize)
+	if err != nil {
+		e.logger.Error("Failed to read held URLs", logging.Error, err)
+	}
+	e.logger.Info("Routing held URLs", "count", len(links))
+
+	full := false
+	for i, link := range links {
+		switch e.dispatch(link, 0) {
+		case EmptyError:
+			// every crawler has left again, and the rest are held back
+			for _, link := range links[i+1:] {
+				e.hold(link)
+			}
+			return
+		case SendQueueFull:
+			full = true
+		}
+	}
+
+	if e.held.Len() > 0 && !full {
+		select {
+		case resume <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// routed records link as routed, so that it is dropped when reported again.
+func (e *Exchange) routed(link *protocol.Link) {
+	if e.dedup != nil {
+		e.dedup.Add(link.URL.String())
+	}
+}
+
+// hold keeps link until a crawler joins, or drops it when it cannot be held.
+func (e *Exchange) hold(link *protocol.Link) {
+	if err := e.held.Push(link); err != nil {
+		e.logger.Warn("Dropped URL", logging.URL, link.URL.String(), logging.Error, err)
+		if err == HoldQueueFull {
+			urlsDropped.WithLabelValues(dropHoldFull).Inc()
 		} else {
-			/* TODO
-			amqp.Publish(exchange), rawurl)
-			*/
+			urlsDropped.WithLabelValues(dropHoldFailed).Inc()
 		}
 	}
-	quit <- true
+}
+
+// dispatch routes link, which has been forwarded forwards times by other
+// exchanges, and queues it for a crawler of this exchange or forwards it to
+// the exchange of the crawler. It is held while no crawler is connected.
+func (e *Exchange) dispatch(link *protocol.Link, forwards int) error {
+	for {
+		crawler, err := e.route(link, forwards > 0)
+		if err == EmptyError {
+			e.hold(link)
+			return err
+		} else if err != nil {
+			e.logger.Warn("Failed to route URL", logging.URL, link.URL.String(), logging.Error, err)
+			urlsDropped.WithLabelValues(dropRouteFailed).Inc()
+			return err
+		}
+
+		eid := crawler.GetExchangeId()
+		if eid != e.id && forwards >= maxForwards {
+			e.logger.Warn("Dropped URL forwarded too many times", logging.URL, link.URL.String(), "peer", string(eid), "forwards", forwards)
+			urlsDropped.WithLabelValues(dropForwardLoop).Inc()
+			return ForwardLoop
+		} else if eid != e.id {
+			err := e.cluster.Forward(eid, link, forwards+1)
+			if err != nil {
+				e.logger.Warn("Failed to forward URL", logging.URL, link.URL.String(), "peer", string(eid), logging.Error, err)
+				urlsDropped.WithLabelValues(dropForwardFailed).Inc()
+			} else {
+				e.routed(link)
+				urlsRouted.WithLabelValues("exchange").Inc()
+			}
+			return err
+		}
+
+		if crawler.GetConn().Framed() {
+			// legacy crawlers never tell when they have finished
+			e.router.Assign(crawler, link)
+		}
+		// queuing never blocks, so a slow crawler holds up nobody
+		err = crawler.Enqueue(link)
+		if err == nil {
+			e.routed(link)
+			urlsRouted.WithLabelValues("crawler").Inc()
+			return nil
+		}
+		e.router.Complete(crawler, []*protocol.Link{link})
+		if err == SendQueueFull {
+			// the crawler grants no credits, and the URL waits for it in
+			// the hold queue instead
+			urlsOverflowed.Inc()
+			e.hold(link)
+			return err
+		}
+		// the crawler has left or been drained since it was routed to
+	}
 }
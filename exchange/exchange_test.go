@@ -0,0 +1,486 @@
+package exchange
+
+import (
+	"../protocol"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func joinExchange(t *testing.T, e *Exchange) protocol.Conn {
+	conn := dialExchange(t, e)
+	conn.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleCrawler})
+	return conn
+}
+
+// readURLs returns the next batch of URLs sent over conn.
+func readURLs(t *testing.T, conn protocol.Conn) *protocol.Message {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		m, err := conn.Read()
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		if m.Type == protocol.URLs {
+			return m
+		}
+	}
+}
+
+func TestExchangeRerouteUnacknowledged(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+
+	first := joinExchange(t, e)
+	defer first.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+
+	seeder := dialExchange(t, e)
+	defer seeder.Close()
+	seed, _ := protocol.ParseLink("http://example.com/\n")
+	seeder.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleSeeder})
+	seeder.Write(&protocol.Message{Type: protocol.Seeds, ID: 1, Links: []*protocol.Link{seed}})
+
+	m := readURLs(t, first)
+	assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+
+	second := joinExchange(t, e)
+	defer second.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 2
+	})
+
+	// the first crawler goes away without acknowledging
+	first.Close()
+
+	m = readURLs(t, second)
+	if assert.Equal(t, len(m.Links), 1) {
+		assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+	}
+	second.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+}
+
+func TestExchangeRerouteOutstanding(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+
+	first := joinExchange(t, e)
+	defer first.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+	crawler := e.router.Crawlers()[0]
+
+	seeder := dialExchange(t, e)
+	defer seeder.Close()
+	seeds := make([]*protocol.Link, 2)
+	seeds[0], _ = protocol.ParseLink("http://example.com/\n")
+	seeds[1], _ = protocol.ParseLink("http://example.org/\n")
+	seeder.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleSeeder})
+	seeder.Write(&protocol.Message{Type: protocol.Seeds, ID: 1, Links: seeds})
+
+	// queued URLs may come in one batch
+	for received := 0; received < 2; {
+		m := readURLs(t, first)
+		first.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+		received += len(m.Links)
+	}
+	waitFor(t, func() bool {
+		return e.router.Outstanding(crawler) == 2
+	})
+
+	// the first crawler finishes one of them and crashes
+	first.Write(&protocol.Message{Type: protocol.Done, Links: seeds[:1]})
+	waitFor(t, func() bool {
+		return e.router.Outstanding(crawler) == 1
+	})
+
+	second := joinExchange(t, e)
+	defer second.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 2
+	})
+	first.Close()
+
+	m := readURLs(t, second)
+	if assert.Equal(t, len(m.Links), 1) {
+		assert.Equal(t, m.Links[0].URL.String(), "http://example.org/")
+	}
+	second.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+	assert.Equal(t, e.router.Outstanding(crawler), 0)
+}
+
+func TestExchangeFrameTooLong(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+
+	raw, err := net.Dial("tcp", e.socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	go raw.Write([]byte(`{"type":"URLS","error":"` + strings.Repeat("a", protocol.MaxFrameSize) + `"}` + "\n"))
+
+	conn := protocol.NewFramedConn(raw)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	m, err := conn.Read()
+	if assert.Nil(t, err) {
+		assert.Equal(t, m.Type, protocol.Error)
+		assert.Equal(t, m.Error, protocol.FrameTooLong.Error())
+	}
+	_, err = conn.Read()
+	assert.NotNil(t, err)
+}
+
+func TestExchangeStableIdentity(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+
+	hello := &protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleCrawler, Crawler: "c1"}
+	first := dialExchange(t, e)
+	defer first.Close()
+	first.Write(hello)
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+	assert.Equal(t, e.router.Crawlers()[0].GetId(), "c1")
+	ring := e.router.Ring()
+
+	// a second session of a live crawler is turned away
+	duplicate := dialExchange(t, e)
+	defer duplicate.Close()
+	duplicate.Write(hello)
+	duplicate.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		m, err := duplicate.Read()
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		if m.Type == protocol.Error {
+			assert.Equal(t, m.Error, DuplicateCrawler.Error())
+			break
+		}
+	}
+	_, err := duplicate.Read()
+	assert.NotNil(t, err)
+	assert.Equal(t, len(e.router.Crawlers()), 1)
+
+	// and takes the same position after the first one goes away
+	first.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 0
+	})
+
+	again := dialExchange(t, e)
+	defer again.Close()
+	again.Write(hello)
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+	assert.Equal(t, e.router.Ring(), ring)
+}
+
+func TestExchangeRouteForwarded(t *testing.T) {
+	e := NewExchange("a", nil)
+	assert.Nil(t, e.SetLoadBound(0.25))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	local := &Crawler{"c1", "a", 1, protocol.NewFramedConn(server), protocol.NewOutbox(), newSendQueue(), time.Now(), 0}
+	remote := newRemoteCrawler("c2", "b", 1)
+	e.router.Add(local)
+	e.router.Add(remote)
+
+	var link *protocol.Link
+	for i := 0; ; i++ {
+		link, _ = protocol.ParseLink("http://host" + strconv.Itoa(i) + ".example.com/")
+		if c, _ := e.router.Owner(link.URL.String()); c == local {
+			break
+		}
+	}
+	for i := 0; i < 4; i++ {
+		outstanding, _ := protocol.ParseLink(link.URL.String() + strconv.Itoa(i))
+		e.router.Assign(local, outstanding)
+	}
+
+	// a URL of this exchange is passed over to the remote crawler, but one
+	// forwarded from there stays, or it would be passed back
+	c, err := e.route(link, false)
+	if assert.Nil(t, err) {
+		assert.True(t, c == remote)
+	}
+	c, err = e.route(link, true)
+	if assert.Nil(t, err) {
+		assert.True(t, c == local)
+	}
+}
+
+func TestExchangeSendQueueOverflow(t *testing.T) {
+	e := NewExchange("a", nil)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	local := &Crawler{"c1", "a", 1, protocol.NewFramedConn(server), protocol.NewOutbox(), newSendQueue(), time.Now(), 0}
+	local.sendq.max = 2
+	local.sendq.Limit(0)
+	e.router.Add(local)
+
+	// URLs beyond the queue of a crawler granting no credits are held
+	overflowed := testutil.ToFloat64(urlsOverflowed)
+	for i := 0; i < 3; i++ {
+		link, _ := protocol.ParseLink("http://example.com/" + strconv.Itoa(i))
+		if i < local.sendq.max {
+			assert.Nil(t, e.dispatch(link, 0))
+		} else {
+			assert.Equal(t, e.dispatch(link, 0), SendQueueFull)
+		}
+	}
+	assert.Equal(t, local.sendq.Len(), 2)
+	assert.Equal(t, e.router.Outstanding(local), 2)
+	assert.Equal(t, e.held.Len(), 1)
+	assert.Equal(t, testutil.ToFloat64(urlsOverflowed), overflowed+1)
+
+	// and routed once it takes more
+	local.Grant(1)
+	local.sendq.Take(maxBatchSize)
+	e.releaseHeld(make(chan struct{}, 1))
+	assert.Equal(t, local.sendq.Len(), 2)
+	assert.Equal(t, e.held.Len(), 0)
+}
+
+func TestExchangeFlowControl(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+
+	// the slow crawler can take one URL, the other one is not limited
+	slow := dialExchange(t, e)
+	defer slow.Close()
+	slow.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleCrawler, Crawler: "slow", Credits: 1})
+	fast := dialExchange(t, e)
+	defer fast.Close()
+	fast.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleCrawler, Crawler: "fast"})
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 2
+	})
+
+	seeds := make([]*protocol.Link, 0)
+	owned := make(map[string]int)
+	for i := 0; owned["slow"] < 3 || owned["fast"] < 3; i++ {
+		seed, _ := protocol.ParseLink("http://host" + strconv.Itoa(i) + ".example.com/")
+		c, _ := e.router.Route(seed.URL.String())
+		seeds = append(seeds, seed)
+		owned[c.GetId()]++
+	}
+
+	seeder := dialExchange(t, e)
+	defer seeder.Close()
+	seeder.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleSeeder})
+	seeder.Write(&protocol.Message{Type: protocol.Seeds, ID: 1, Links: seeds})
+
+	receive := func(conn protocol.Conn, n int) {
+		for received := 0; received < n; {
+			m := readURLs(t, conn)
+			conn.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+			received += len(m.Links)
+		}
+	}
+
+	receive(fast, owned["fast"])
+	receive(slow, 1)
+
+	// nothing more comes until credits are granted
+	slow.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := slow.Read()
+	assert.NotNil(t, err)
+
+	slow.Write(&protocol.Message{Type: protocol.Credit, Credits: owned["slow"]})
+	receive(slow, owned["slow"]-1)
+}
+
+func TestExchangeHoldsUnroutable(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+
+	// seeds sent before any crawler joins are acknowledged and held,
+	// rather than blocking the exchange
+	seeder := dialExchange(t, e)
+	defer seeder.Close()
+	seeder.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleSeeder})
+	for id := uint64(1); id <= 3; id++ {
+		seed, _ := protocol.ParseLink("http://example.com/" + strconv.Itoa(int(id)))
+		seeder.Write(&protocol.Message{Type: protocol.Seeds, ID: id, Links: []*protocol.Link{seed}})
+
+		seeder.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			m, err := seeder.Read()
+			if !assert.Nil(t, err) {
+				t.FailNow()
+			}
+			if m.Type == protocol.Ack {
+				assert.Equal(t, m.ID, id)
+				break
+			}
+		}
+	}
+	waitFor(t, func() bool {
+		return e.held.Len() == 3
+	})
+
+	crawler := joinExchange(t, e)
+	defer crawler.Close()
+	received := make([]string, 0)
+	for len(received) < 3 {
+		m := readURLs(t, crawler)
+		crawler.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+		for _, link := range m.Links {
+			received = append(received, link.URL.String())
+		}
+	}
+	assert.Equal(t, received, []string{"http://example.com/1", "http://example.com/2", "http://example.com/3"})
+	assert.Equal(t, e.held.Len(), 0)
+}
+
+// leavingBus removes crawler from router once a URL is forwarded over it.
+type leavingBus struct {
+	*MemoryBus
+	router  *Router
+	crawler *Crawler
+}
+
+func (b *leavingBus) Publish(topic string, body []byte) error {
+	b.router.Remove(b.crawler)
+	return b.MemoryBus.Publish(topic, body)
+}
+
+func TestExchangeReleaseHeldWhenCrawlerLeaves(t *testing.T) {
+	e := NewExchange("a", nil)
+	remote := newRemoteCrawler("c", "b", 1)
+	e.SetBus(&leavingBus{NewMemoryBus(), e.router, remote})
+
+	for _, url := range []string{"http://example.com/1", "http://example.com/2", "http://example.com/3"} {
+		link, _ := protocol.ParseLink(url)
+		assert.Nil(t, e.held.Push(link))
+	}
+	e.router.Add(remote)
+
+	// the only crawler leaves after the first URL, and the rest stay held
+	e.releaseHeld(make(chan struct{}, 1))
+	links, err := e.held.Pop(holdBatchSize)
+	assert.Nil(t, err)
+	urls := make([]string, 0)
+	for _, link := range links {
+		urls = append(urls, link.URL.String())
+	}
+	assert.Equal(t, urls, []string{"http://example.com/2", "http://example.com/3"})
+}
+
+func TestExchangeDedup(t *testing.T) {
+	e, stop := startExchangeWith(t, "a", func(e *Exchange) {
+		e.SetDedup(NewDedup(1000, 0.001))
+	})
+	defer stop()
+
+	crawler := joinExchange(t, e)
+	defer crawler.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+
+	// a URL reported twice is routed once
+	link, _ := protocol.ParseLink("http://example.com/")
+	for id := uint64(1); id <= 2; id++ {
+		crawler.Write(&protocol.Message{Type: protocol.URLs, ID: id, Links: []*protocol.Link{link}})
+	}
+	m := readURLs(t, crawler)
+	crawler.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+	waitFor(t, func() bool {
+		hits, misses := e.dedup.Stats()
+		return hits == 1 && misses == 1
+	})
+
+	// and a seed every time
+	seed, _ := protocol.ParseLink("http://example.com/")
+	seeder := dialExchange(t, e)
+	defer seeder.Close()
+	seeder.Write(&protocol.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleSeeder})
+	seeder.Write(&protocol.Message{Type: protocol.Seeds, ID: 1, Links: []*protocol.Link{seed}})
+	m = readURLs(t, crawler)
+	crawler.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+	hits, _ := e.dedup.Stats()
+	assert.Equal(t, hits, uint64(1))
+
+	crawler.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		m, err := crawler.Read()
+		if err != nil {
+			break
+		}
+		assert.NotEqual(t, m.Type, protocol.URLs)
+	}
+}
+
+func TestExchangeDedupLegacyHandback(t *testing.T) {
+	e, stop := startExchangeWith(t, "a", func(e *Exchange) {
+		e.SetLegacy(true)
+		e.SetDedup(NewDedup(1000, 0.001))
+	})
+	defer stop()
+
+	dial := func() protocol.Conn {
+		conn, err := net.Dial("tcp", e.socket.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return protocol.NewLegacyConn(conn)
+	}
+
+	first := dial()
+	defer first.Close()
+	first.Write(&protocol.Message{Type: protocol.Hello, Role: protocol.RoleCrawler})
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+
+	seeder := dial()
+	defer seeder.Close()
+	seed, _ := protocol.ParseLink("http://example.com/\n")
+	seeder.Write(&protocol.Message{Type: protocol.Seeds, Links: []*protocol.Link{seed}})
+	m := readURLs(t, first)
+	assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+
+	second := dial()
+	defer second.Close()
+	second.Write(&protocol.Message{Type: protocol.Hello, Role: protocol.RoleCrawler})
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 2
+	})
+
+	// the URL the first crawler hands back when it quits is routed again
+	first.Write(&protocol.Message{Type: protocol.Quit})
+	first.Write(&protocol.Message{Type: protocol.URLs, Links: m.Links})
+	m = readURLs(t, second)
+	if assert.Equal(t, len(m.Links), 1) {
+		assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+	}
+}
+
+func TestExchangeDedupRecordsRouted(t *testing.T) {
+	e := NewExchange("a", nil)
+	e.SetDedup(NewDedup(1000, 0.001))
+	e.SetHoldQueue(NewHoldQueue(0))
+
+	// a URL dropped on the way is routed when it is reported again
+	link, _ := protocol.ParseLink("http://example.com/")
+	assert.Equal(t, e.dispatch(link, 0), EmptyError)
+	assert.False(t, e.dedup.Seen("http://example.com/"))
+}
@@ -0,0 +1,150 @@
+package exchange
+
+import (
+	"../protocol"
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	defaultHoldSize = 100000
+	holdBatchSize   = 1000 // URLs routed from the queue at once
+)
+
+var (
+	HoldQueueFull = errors.New("Hold queue is full")
+)
+
+// HoldQueue keeps the URLs which cannot be routed while no crawler is
+// connected, or whose crawler is not keeping up, up to a limit. A queue backed by a file keeps them there
+// instead of in memory, so that they are routed after the exchange restarts.
+type HoldQueue struct {
+	max    int
+	links  []*protocol.Link // held in memory when there is no file
+	file   *os.File
+	offset int64 // where the links not popped yet start in file
+	size   int64
+	count  int // links held in file
+	sync.Mutex
+}
+
+func NewHoldQueue(max int) *HoldQueue {
+	return &HoldQueue{max: max, links: make([]*protocol.Link, 0)}
+}
+
+// OpenHoldQueue returns a queue backed by the file of path, holding the
+// URLs which were left in it.
+func OpenHoldQueue(path string, max int) (*HoldQueue, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &HoldQueue{max: max, file: file}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+		q.size += int64(len(line))
+		q.count++
+	}
+	return q, nil
+}
+
+// Push holds link, and fails when the queue is full.
+func (q *HoldQueue) Push(link *protocol.Link) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.len() >= q.max {
+		return HoldQueueFull
+	}
+
+	if q.file == nil {
+		q.links = append(q.links, link)
+		return nil
+	}
+
+	line := link.Encode()
+	if _, err := q.file.WriteAt([]byte(line), q.size); err != nil {
+		return err
+	}
+	q.size += int64(len(line))
+	q.count++
+	return nil
+}
+
+// Pop removes up to n links in the order they were held.
+func (q *HoldQueue) Pop(n int) ([]*protocol.Link, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.file == nil {
+		if n > len(q.links) {
+			n = len(q.links)
+		}
+		links := q.links[:n:n]
+		q.links = q.links[n:]
+		return links, nil
+	}
+
+	links := make([]*protocol.Link, 0, n)
+	reader := bufio.NewReader(io.NewSectionReader(q.file, q.offset, q.size-q.offset))
+	for len(links) < n && q.count > 0 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return links, err
+		}
+		q.offset += int64(len(line))
+		q.count--
+
+		link, err := protocol.ParseLink(line)
+		if err != nil {
+			continue
+		}
+		links = append(links, link)
+	}
+
+	// the file is started over once everything in it has been popped
+	if q.count == 0 {
+		q.offset, q.size = 0, 0
+		if err := q.file.Truncate(0); err != nil {
+			return links, err
+		}
+	}
+	return links, nil
+}
+
+// Len returns the number of links held.
+func (q *HoldQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.len()
+}
+
+func (q *HoldQueue) len() int {
+	if q.file == nil {
+		return len(q.links)
+	}
+	return q.count
+}
+
+// Close closes the file of the queue. Links held in memory are lost.
+func (q *HoldQueue) Close() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
@@ -0,0 +1,78 @@
+package exchange
+
+import (
+	"../protocol"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func holdLinks(t *testing.T, q *HoldQueue, n int) {
+	for i := 0; i < n; i++ {
+		link, _ := protocol.ParseLink("http://example.com/" + strconv.Itoa(i))
+		if !assert.Nil(t, q.Push(link)) {
+			t.FailNow()
+		}
+	}
+}
+
+func TestHoldQueue(t *testing.T) {
+	q := NewHoldQueue(3)
+	holdLinks(t, q, 3)
+	link, _ := protocol.ParseLink("http://example.com/full")
+	assert.Equal(t, q.Push(link), HoldQueueFull)
+	assert.Equal(t, q.Len(), 3)
+
+	links, err := q.Pop(2)
+	assert.Nil(t, err)
+	if assert.Equal(t, len(links), 2) {
+		assert.Equal(t, links[0].URL.String(), "http://example.com/0")
+		assert.Equal(t, links[1].URL.String(), "http://example.com/1")
+	}
+	links, _ = q.Pop(2)
+	assert.Equal(t, len(links), 1)
+	assert.Equal(t, q.Len(), 0)
+	assert.Nil(t, q.Close())
+}
+
+func TestHoldQueueFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "held")
+
+	q, err := OpenHoldQueue(path, 3)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	holdLinks(t, q, 3)
+	link, _ := protocol.ParseLink("http://example.com/full")
+	assert.Equal(t, q.Push(link), HoldQueueFull)
+	assert.Nil(t, q.Close())
+
+	// the links are still held after reopening
+	q, err = OpenHoldQueue(path, 3)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer q.Close()
+	assert.Equal(t, q.Len(), 3)
+
+	links, err := q.Pop(2)
+	assert.Nil(t, err)
+	if assert.Equal(t, len(links), 2) {
+		assert.Equal(t, links[0].URL.String(), "http://example.com/0")
+		assert.Equal(t, links[1].URL.String(), "http://example.com/1")
+	}
+	assert.Nil(t, q.Push(link))
+
+	links, err = q.Pop(5)
+	assert.Nil(t, err)
+	if assert.Equal(t, len(links), 2) {
+		assert.Equal(t, links[0].URL.String(), "http://example.com/2")
+		assert.Equal(t, links[1].URL.String(), "http://example.com/full")
+	}
+
+	// and the file is emptied once they are all popped
+	info, _ := os.Stat(path)
+	assert.Equal(t, info.Size(), int64(0))
+}
@@ -0,0 +1,103 @@
+package exchange
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons URLs are dropped for.
+const (
+	dropInvalid       = "invalid"
+	dropOutOfScope    = "out_of_scope"
+	dropDuplicate     = "duplicate"
+	dropHoldFull      = "hold_full"
+	dropHoldFailed    = "hold_failed"
+	dropStopping      = "stopping"
+	dropForwardFailed = "forward_failed"
+	dropForwardLoop   = "forward_loop"
+	dropRouteFailed   = "route_failed"
+)
+
+var (
+	urlsRouted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kaken_exchange_urls_routed_total",
+		Help: "URLs routed to a crawler of this exchange, or forwarded to another exchange.",
+	}, []string{"destination"})
+	urlsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kaken_exchange_urls_dropped_total",
+		Help: "URLs dropped by reason.",
+	}, []string{"reason"})
+	urlsOverflowed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kaken_exchange_urls_overflowed_total",
+		Help: "URLs held because the send queue of their crawler was full.",
+	})
+	ringChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kaken_exchange_ring_changes_total",
+		Help: "Crawlers joining and leaving the ring.",
+	}, []string{"change"})
+)
+
+func init() {
+	prometheus.MustRegister(urlsRouted, urlsDropped, urlsOverflowed, ringChanges)
+}
+
+var (
+	crawlersDesc = prometheus.NewDesc("kaken_exchange_crawlers",
+		"Crawlers in the ring by the exchange they are connected to.", []string{"exchange"}, nil)
+	heldDesc = prometheus.NewDesc("kaken_exchange_held_urls",
+		"URLs held while no crawler is connected.", nil, nil)
+	queuedDesc = prometheus.NewDesc("kaken_exchange_queued_urls",
+		"URLs routed to crawlers of this exchange and not sent yet.", nil, nil)
+	outstandingDesc = prometheus.NewDesc("kaken_exchange_outstanding_urls",
+		"URLs routed to crawlers of this exchange and not finished yet.", nil, nil)
+	dedupDesc = prometheus.NewDesc("kaken_exchange_dedup_lookups_total",
+		"URLs looked up in the dedup filter by whether they had been seen.", []string{"result"}, nil)
+	dedupRateDesc = prometheus.NewDesc("kaken_exchange_dedup_false_positive_rate",
+		"Estimated rate of new URLs dropped by the dedup filter as seen.", nil, nil)
+)
+
+type exchangeCollector struct {
+	e *Exchange
+}
+
+// Collector returns the metrics of the crawlers and queues of e, to be
+// registered by the program running it.
+func (e *Exchange) Collector() prometheus.Collector {
+	return &exchangeCollector{e}
+}
+
+func (ec *exchangeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- crawlersDesc
+	ch <- heldDesc
+	ch <- queuedDesc
+	ch <- outstandingDesc
+	ch <- dedupDesc
+	ch <- dedupRateDesc
+}
+
+func (ec *exchangeCollector) Collect(ch chan<- prometheus.Metric) {
+	e := ec.e
+
+	crawlers := make(map[exchangeid]int)
+	queued, outstanding := 0, 0
+	for _, c := range e.router.Crawlers() {
+		crawlers[c.GetExchangeId()]++
+		if c.GetExchangeId() == e.id {
+			queued += c.sendq.Len()
+			outstanding += e.router.Outstanding(c)
+		}
+	}
+	for eid, n := range crawlers {
+		ch <- prometheus.MustNewConstMetric(crawlersDesc, prometheus.GaugeValue, float64(n), string(eid))
+	}
+
+	ch <- prometheus.MustNewConstMetric(heldDesc, prometheus.GaugeValue, float64(e.held.Len()))
+	ch <- prometheus.MustNewConstMetric(queuedDesc, prometheus.GaugeValue, float64(queued))
+	ch <- prometheus.MustNewConstMetric(outstandingDesc, prometheus.GaugeValue, float64(outstanding))
+
+	if e.dedup != nil {
+		hits, misses := e.dedup.Stats()
+		ch <- prometheus.MustNewConstMetric(dedupDesc, prometheus.CounterValue, float64(hits), "hit")
+		ch <- prometheus.MustNewConstMetric(dedupDesc, prometheus.CounterValue, float64(misses), "miss")
+		ch <- prometheus.MustNewConstMetric(dedupRateDesc, prometheus.GaugeValue, e.dedup.FalsePositiveRate())
+	}
+}
@@ -0,0 +1,84 @@
+package exchange
+
+import (
+	"../protocol"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestExchangeMetrics(t *testing.T) {
+	e, stop := startExchangeWith(t, "a", func(e *Exchange) {
+		e.SetDedup(NewDedup(1000, 0.001))
+	})
+	defer stop()
+
+	routed := urlsRouted.WithLabelValues("crawler")
+	duplicate, invalid := urlsDropped.WithLabelValues(dropDuplicate), urlsDropped.WithLabelValues(dropInvalid)
+	joins, leaves := ringChanges.WithLabelValues("join"), ringChanges.WithLabelValues("leave")
+	routedBefore := testutil.ToFloat64(routed)
+	duplicateBefore, invalidBefore := testutil.ToFloat64(duplicate), testutil.ToFloat64(invalid)
+	joinsBefore, leavesBefore := testutil.ToFloat64(joins), testutil.ToFloat64(leaves)
+
+	crawler := joinExchange(t, e)
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 1
+	})
+	assert.Equal(t, joinsBefore+1, testutil.ToFloat64(joins))
+
+	link, _ := protocol.ParseLink("http://example.com/")
+	invalidLink, _ := protocol.ParseLink("ftp://example.com/")
+	crawler.Write(&protocol.Message{Type: protocol.URLs, ID: 1, Links: []*protocol.Link{link, invalidLink}})
+	crawler.Write(&protocol.Message{Type: protocol.URLs, ID: 2, Links: []*protocol.Link{link}})
+	m := readURLs(t, crawler)
+	crawler.Write(&protocol.Message{Type: protocol.Ack, ID: m.ID})
+	waitFor(t, func() bool {
+		return testutil.ToFloat64(duplicate) == duplicateBefore+1
+	})
+	assert.Equal(t, routedBefore+1, testutil.ToFloat64(routed))
+	assert.Equal(t, invalidBefore+1, testutil.ToFloat64(invalid))
+
+	expected := `
+# HELP kaken_exchange_crawlers Crawlers in the ring by the exchange they are connected to.
+# TYPE kaken_exchange_crawlers gauge
+kaken_exchange_crawlers{exchange="a"} 1
+# HELP kaken_exchange_dedup_lookups_total URLs looked up in the dedup filter by whether they had been seen.
+# TYPE kaken_exchange_dedup_lookups_total counter
+kaken_exchange_dedup_lookups_total{result="hit"} 1
+kaken_exchange_dedup_lookups_total{result="miss"} 1
+# HELP kaken_exchange_outstanding_urls URLs routed to crawlers of this exchange and not finished yet.
+# TYPE kaken_exchange_outstanding_urls gauge
+kaken_exchange_outstanding_urls 1
+`
+	assert.Nil(t, testutil.CollectAndCompare(e.Collector(), strings.NewReader(expected),
+		"kaken_exchange_crawlers", "kaken_exchange_dedup_lookups_total", "kaken_exchange_outstanding_urls"))
+
+	crawler.Close()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 0
+	})
+	assert.Equal(t, leavesBefore+1, testutil.ToFloat64(leaves))
+}
+
+// brokenHash fails to share out any key.
+type brokenHash struct{}
+
+func (brokenHash) AddWeighted(token string, weight float64) {}
+func (brokenHash) Remove(token string)                      {}
+func (brokenHash) Get(key string) (string, error)           { return "", errors.New("broken") }
+
+func TestExchangeMetricsRouteFailed(t *testing.T) {
+	e := NewExchange("a", nil)
+	e.SetRouting(HostStrategy{}, brokenHash{})
+	e.router.Add(newRemoteCrawler("c", "b", 1))
+
+	// the URL is not to blame for a failure to route it
+	routeFailed, invalid := urlsDropped.WithLabelValues(dropRouteFailed), urlsDropped.WithLabelValues(dropInvalid)
+	routeFailedBefore, invalidBefore := testutil.ToFloat64(routeFailed), testutil.ToFloat64(invalid)
+	link, _ := protocol.ParseLink("http://example.com/")
+	assert.NotNil(t, e.dispatch(link, 0))
+	assert.Equal(t, routeFailedBefore+1, testutil.ToFloat64(routeFailed))
+	assert.Equal(t, invalidBefore, testutil.ToFloat64(invalid))
+}
@@ -0,0 +1,439 @@
+package exchange
+
+import (
+	"../logging"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	peerOutboxSize = 10000
+	maxPeerFrame   = 16 << 20 // longest body of a message, in bytes
+)
+
+var (
+	UnknownPeer      = errors.New("Peer is unknown")
+	InvalidPeerFrame = errors.New("Peer frame is invalid")
+
+	peerRetryInterval     = 1 * time.Second
+	peerHandshakeDeadline = 10 * time.Second
+)
+
+type peerMessage struct {
+	topic string
+	body  []byte
+	seq   uint64 // sequence of membership messages, 0 for others
+}
+
+type peer struct {
+	addr      string     // empty for peers which dialed us
+	id        exchangeid // empty for dialed peers until they connect, unless configured
+	outbox    chan peerMessage
+	pending   *peerMessage // failed to be sent before disconnection
+	conn      net.Conn
+	connected bool
+	left      bool // left the cluster, so it is dropped once disconnected
+}
+
+// PeerBus is a Bus over direct TCP connections between exchanges, an
+// alternative to a broker. Every exchange should be peered with every other
+// one, in either direction.
+//
+// A connection starts with "HELLO <exchangeid>" from both sides followed by
+// the latest membership message, and carries messages framed as
+// "<topic> <length>\n<body>". URLs for a peer which is down are buffered
+// until it comes back or leaves the cluster, and so are the ones for a peer
+// configured with its id which has not connected yet.
+type PeerBus struct {
+	id          exchangeid
+	listener    net.Listener
+	peers       map[exchangeid]*peer
+	subscribers map[string][]chan []byte
+	snapshot    *peerMessage
+	seq         uint64
+	quit        chan struct{}
+	wg          sync.WaitGroup
+	closed      bool
+	logger      *slog.Logger
+	sync.Mutex
+}
+
+// NewPeerBus accepts peers on listener, if any, and keeps connections to the
+// peers at addrs. An address given as "<exchangeid>@<host:port>" names the
+// peer, whose URLs are buffered from the start.
+func NewPeerBus(id string, listener net.Listener, addrs []string) *PeerBus {
+	b := &PeerBus{
+		id:          exchangeid(id),
+		listener:    listener,
+		peers:       make(map[exchangeid]*peer),
+		subscribers: make(map[string][]chan []byte),
+		quit:        make(chan struct{}),
+		logger:      slog.Default().With(logging.ExchangeID, id)}
+
+	if listener != nil {
+		b.wg.Add(1)
+		go b.accept()
+	}
+
+	for _, addr := range addrs {
+		p := &peer{
+			addr:   addr,
+			outbox: make(chan peerMessage, peerOutboxSize)}
+		if i := strings.LastIndex(addr, "@"); i >= 0 {
+			p.id, p.addr = exchangeid(addr[:i]), addr[i+1:]
+			b.peers[p.id] = p
+		}
+
+		b.wg.Add(1)
+		go b.dial(p)
+	}
+
+	return b
+}
+
+func (b *PeerBus) Publish(topic string, body []byte) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return BusClosed
+	}
+
+	m := peerMessage{topic, body, 0}
+	switch {
+	case topic == membershipTopic:
+		b.seq++
+		m.seq = b.seq
+		b.snapshot = &m
+
+		for _, p := range b.peers {
+			if p.connected {
+				b.enqueue(p, m)
+			}
+		}
+	case strings.HasPrefix(topic, urlTopicPrefix):
+		eid := exchangeid(topic[len(urlTopicPrefix):])
+		if eid != b.id {
+			p, exists := b.peers[eid]
+			if !exists {
+				return UnknownPeer
+			}
+			b.enqueue(p, m)
+		}
+	default:
+		for _, p := range b.peers {
+			b.enqueue(p, m)
+		}
+	}
+
+	for _, ch := range b.subscribers[topic] {
+		ch <- body
+	}
+	return nil
+}
+
+func (b *PeerBus) Subscribe(topic string) (<-chan []byte, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return nil, BusClosed
+	}
+
+	in := make(chan []byte)
+	out := make(chan []byte)
+	go queueMessages(in, out)
+
+	b.subscribers[topic] = append(b.subscribers[topic], in)
+	return out, nil
+}
+
+func (b *PeerBus) Close() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return nil
+	}
+
+	b.closed = true
+	close(b.quit)
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	for _, p := range b.peers {
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	}
+	b.Unlock()
+
+	b.wg.Wait()
+
+	b.Lock()
+	defer b.Unlock()
+	for _, chans := range b.subscribers {
+		for _, ch := range chans {
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// Forget drops the peer eid, which left the cluster, with the URLs buffered
+// for it. A connected peer is dropped once it disconnects.
+func (b *PeerBus) Forget(eid exchangeid) {
+	b.Lock()
+	defer b.Unlock()
+
+	p, exists := b.peers[eid]
+	if !exists || p.addr != "" {
+		return
+	}
+	if p.connected {
+		p.left = true
+	} else {
+		delete(b.peers, eid)
+	}
+}
+
+func (b *PeerBus) enqueue(p *peer, m peerMessage) {
+	select {
+	case p.outbox <- m:
+	default:
+		b.logger.Warn("Dropped a message to peer because its outbox is full", "peer", p.id)
+	}
+}
+
+func (b *PeerBus) deliver(topic string, body []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return
+	}
+	for _, ch := range b.subscribers[topic] {
+		ch <- body
+	}
+}
+
+func (b *PeerBus) wait() bool {
+	select {
+	case <-b.quit:
+		return false
+	case <-time.After(peerRetryInterval):
+		return true
+	}
+}
+
+func (b *PeerBus) accept() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p := &peer{outbox: make(chan peerMessage, peerOutboxSize)}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.serve(p, conn)
+		}()
+	}
+}
+
+func (b *PeerBus) dial(p *peer) {
+	defer b.wg.Done()
+
+	for {
+		conn, err := net.Dial("tcp", p.addr)
+		if err != nil {
+			b.logger.Warn("Failed to connect to peer", "addr", p.addr, logging.Error, err)
+		} else {
+			b.serve(p, conn)
+		}
+
+		if !b.wait() {
+			return
+		}
+		b.logger.Info("Reconnecting to peer", "addr", p.addr)
+	}
+}
+
+func (b *PeerBus) serve(p *peer, conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	id, err := b.handshake(conn, reader)
+	if err != nil {
+		b.logger.Warn("Handshake with peer failed", "addr", conn.RemoteAddr().String(), logging.Error, err)
+		return
+	}
+
+	if p.addr != "" && p.id != "" && p.id != id {
+		b.logger.Warn("Peer is another exchange", "addr", p.addr, "peer", id, "expected", p.id)
+		return
+	}
+
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return
+	}
+	known, exists := b.peers[id]
+	if exists && p.addr == "" && !known.connected {
+		if known.addr == "" {
+			// it came back, so the URLs buffered for it are sent
+			p = known
+		} else {
+			// it dialed before being dialed, and takes the URLs buffered
+			// for it meanwhile
+			p.outbox = known.outbox
+		}
+	}
+	p.id = id
+	p.conn = conn
+	p.connected = true
+	p.left = false
+	if !exists || p.addr != "" || !known.connected {
+		b.peers[id] = p
+	}
+	snapshot := b.snapshot
+	b.Unlock()
+	b.logger.Info("Peered with exchange", "peer", id, "addr", conn.RemoteAddr().String())
+
+	defer func() {
+		b.Lock()
+		p.connected = false
+		p.conn = nil
+		if p.addr == "" && p.left && b.peers[id] == p {
+			delete(b.peers, id)
+		}
+		b.Unlock()
+		b.logger.Info("Lost peer", "peer", id)
+	}()
+
+	rdone := make(chan struct{})
+	go func() {
+		defer close(rdone)
+		for {
+			topic, body, err := readPeerMessage(reader)
+			if err != nil {
+				return
+			}
+			b.deliver(topic, body)
+		}
+	}()
+
+	var sent uint64
+	if snapshot != nil {
+		if err := writePeerMessage(conn, *snapshot); err != nil {
+			return
+		}
+		sent = snapshot.seq
+	}
+
+	send := func(m peerMessage) bool {
+		if m.seq != 0 && m.seq <= sent {
+			// older than the membership already sent
+			return true
+		}
+		if err := writePeerMessage(conn, m); err != nil {
+			p.pending = &m
+			return false
+		}
+		if m.seq != 0 {
+			sent = m.seq
+		}
+		return true
+	}
+
+	if m := p.pending; m != nil {
+		p.pending = nil
+		if !send(*m) {
+			conn.Close()
+			<-rdone
+			return
+		}
+	}
+
+loop:
+	for {
+		select {
+		case m := <-p.outbox:
+			if !send(m) {
+				break loop
+			}
+		case <-rdone:
+			break loop
+		case <-b.quit:
+			break loop
+		}
+	}
+
+	conn.Close()
+	<-rdone
+}
+
+func (b *PeerBus) handshake(conn net.Conn, reader *bufio.Reader) (exchangeid, error) {
+	conn.SetDeadline(time.Now().Add(peerHandshakeDeadline))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "HELLO %s\n", b.id); err != nil {
+		return "", err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "HELLO" {
+		return "", fmt.Errorf("unexpected greeting: %q", line)
+	} else if exchangeid(fields[1]) == b.id {
+		return "", errors.New("connected to itself")
+	}
+	return exchangeid(fields[1]), nil
+}
+
+func writePeerMessage(conn net.Conn, m peerMessage) error {
+	frame := append([]byte(fmt.Sprintf("%s %d\n", m.topic, len(m.body))), m.body...)
+	for wrote := 0; wrote < len(frame); {
+		if _wrote, err := conn.Write(frame[wrote:]); err == nil {
+			wrote += _wrote
+		} else {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPeerMessage(reader *bufio.Reader) (string, []byte, error) {
+	var topic string
+	var length int
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := fmt.Sscanf(line, "%s %d\n", &topic, &length); err != nil {
+		return "", nil, err
+	} else if length < 0 || length > maxPeerFrame {
+		return "", nil, InvalidPeerFrame
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return "", nil, err
+	}
+	return topic, body, nil
+}
@@ -0,0 +1,191 @@
+package exchange
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenPeers(t *testing.T, addr string) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func receive(t *testing.T, ch <-chan []byte) []byte {
+	select {
+	case body := <-ch:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	return nil
+}
+
+func isPeered(b *PeerBus, id exchangeid) func() bool {
+	return func() bool {
+		b.Lock()
+		defer b.Unlock()
+
+		p, exists := b.peers[id]
+		return exists && p.connected
+	}
+}
+
+func TestPeerBusHandshake(t *testing.T) {
+	b := NewPeerBus("b", listenPeers(t, "127.0.0.1:0"), nil)
+	defer b.Close()
+	assert.Nil(t, b.Publish(membershipTopic, []byte("b1")))
+
+	a := NewPeerBus("a", nil, []string{b.listener.Addr().String()})
+	defer a.Close()
+
+	fromB, _ := a.Subscribe(membershipTopic)
+	fromA, _ := b.Subscribe(membershipTopic)
+	waitFor(t, isPeered(a, "b"))
+	waitFor(t, isPeered(b, "a"))
+
+	// the membership of b is sent on the handshake
+	assert.Equal(t, receive(t, fromB), []byte("b1"))
+
+	assert.Nil(t, a.Publish(membershipTopic, []byte("a1")))
+	assert.Equal(t, receive(t, fromA), []byte("a1"))
+
+	// URLs can be forwarded in both directions over a single connection
+	urlsA, _ := a.Subscribe(urlTopicPrefix + "a")
+	urlsB, _ := b.Subscribe(urlTopicPrefix + "b")
+	assert.Nil(t, a.Publish(urlTopicPrefix+"b", []byte("to b")))
+	assert.Nil(t, b.Publish(urlTopicPrefix+"a", []byte("to a")))
+	assert.Equal(t, receive(t, urlsB), []byte("to b"))
+	assert.Equal(t, receive(t, urlsA), []byte("to a"))
+
+	assert.Equal(t, a.Publish(urlTopicPrefix+"c", []byte{}), UnknownPeer)
+}
+
+func TestPeerBusBuffersWhilePeerIsDown(t *testing.T) {
+	interval := peerRetryInterval
+	peerRetryInterval = 10 * time.Millisecond
+	defer func() {
+		peerRetryInterval = interval
+	}()
+
+	listener := listenPeers(t, "127.0.0.1:0")
+	addr := listener.Addr().String()
+
+	b := NewPeerBus("b", listener, nil)
+	a := NewPeerBus("a", nil, []string{addr})
+	defer a.Close()
+
+	waitFor(t, isPeered(a, "b"))
+	b.Close()
+	waitFor(t, func() bool {
+		return !isPeered(a, "b")()
+	})
+
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Nil(t, a.Publish(urlTopicPrefix+"b", []byte(body)))
+	}
+
+	b = NewPeerBus("b", listenPeers(t, addr), nil)
+	defer b.Close()
+	urls, _ := b.Subscribe(urlTopicPrefix + "b")
+
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Equal(t, receive(t, urls), []byte(body))
+	}
+}
+
+func TestPeerBusBuffersForConfiguredPeer(t *testing.T) {
+	interval := peerRetryInterval
+	peerRetryInterval = 10 * time.Millisecond
+	defer func() {
+		peerRetryInterval = interval
+	}()
+
+	listener := listenPeers(t, "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// b is down when a starts
+	a := NewPeerBus("a", nil, []string{"b@" + addr})
+	defer a.Close()
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Nil(t, a.Publish(urlTopicPrefix+"b", []byte(body)))
+	}
+	assert.Equal(t, a.Publish(urlTopicPrefix+"c", []byte{}), UnknownPeer)
+
+	b := NewPeerBus("b", listenPeers(t, addr), nil)
+	defer b.Close()
+	urls, _ := b.Subscribe(urlTopicPrefix + "b")
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Equal(t, receive(t, urls), []byte(body))
+	}
+}
+
+func TestPeerBusBuffersWhileInboundPeerIsDown(t *testing.T) {
+	interval := peerRetryInterval
+	peerRetryInterval = 10 * time.Millisecond
+	defer func() {
+		peerRetryInterval = interval
+	}()
+
+	a := NewPeerBus("a", listenPeers(t, "127.0.0.1:0"), nil)
+	defer a.Close()
+	addr := a.listener.Addr().String()
+
+	b := NewPeerBus("b", nil, []string{addr})
+	waitFor(t, isPeered(a, "b"))
+	b.Close()
+	waitFor(t, func() bool {
+		return !isPeered(a, "b")()
+	})
+
+	// b dialed a, which keeps its URLs until it comes back
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Nil(t, a.Publish(urlTopicPrefix+"b", []byte(body)))
+	}
+
+	b = NewPeerBus("b", nil, []string{addr})
+	urls, _ := b.Subscribe(urlTopicPrefix + "b")
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Equal(t, receive(t, urls), []byte(body))
+	}
+
+	// and drops them once it leaves the cluster
+	a.Forget("b")
+	b.Close()
+	waitFor(t, func() bool {
+		a.Lock()
+		defer a.Unlock()
+
+		_, exists := a.peers["b"]
+		return !exists
+	})
+	assert.Equal(t, a.Publish(urlTopicPrefix+"b", []byte("4")), UnknownPeer)
+}
+
+func TestReadPeerMessage(t *testing.T) {
+	topic, body, err := readPeerMessage(bufio.NewReader(strings.NewReader("urls.a 5\nhello")))
+	assert.Nil(t, err)
+	assert.Equal(t, topic, "urls.a")
+	assert.Equal(t, body, []byte("hello"))
+
+	for _, frame := range []string{"urls.a -1\n", "urls.a 1000000000000\n"} {
+		_, _, err := readPeerMessage(bufio.NewReader(strings.NewReader(frame)))
+		assert.Equal(t, err, InvalidPeerFrame)
+	}
+}
+
+func TestClusterForwardOverPeers(t *testing.T) {
+	busB := NewPeerBus("b", listenPeers(t, "127.0.0.1:0"), nil)
+	defer busB.Close()
+	busA := NewPeerBus("a", nil, []string{busB.listener.Addr().String()})
+	defer busA.Close()
+
+	testClusterForward(t, busA, busB)
+}
@@ -0,0 +1,66 @@
+package exchange
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+)
+
+// RendezvousHash gives each key to the token which scores highest for it.
+// Removing a token moves only the keys it had, without the memory of the
+// vnodes of a ring, but Get takes time in proportion to the tokens.
+type RendezvousHash struct {
+	weights map[string]float64
+	sync.RWMutex
+}
+
+func NewRendezvousHash() *RendezvousHash {
+	return &RendezvousHash{weights: make(map[string]float64)}
+}
+
+func (r *RendezvousHash) AddWeighted(token string, weight float64) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.weights[token] = weight
+}
+
+func (r *RendezvousHash) Remove(token string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.weights, token)
+}
+
+func (r *RendezvousHash) Get(key string) (string, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.weights) == 0 {
+		return "", EmptyError
+	}
+
+	var best string
+	bestScore := math.Inf(-1)
+	for token, weight := range r.weights {
+		score := r.score(token, key, weight)
+		if score > bestScore || (score == bestScore && token < best) {
+			best, bestScore = token, score
+		}
+	}
+	return best, nil
+}
+
+// score is -weight/ln(h) for a hash h of token and key in (0, 1), which
+// makes a token win keys in proportion to its weight.
+func (r *RendezvousHash) score(token string, key string, weight float64) float64 {
+	h := sha1.New()
+	io.WriteString(h, token)
+	io.WriteString(h, "$")
+	io.WriteString(h, key)
+
+	u := (float64(binary.BigEndian.Uint64(h.Sum(nil))>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
@@ -0,0 +1,68 @@
+package exchange
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestRendezvousHashGet(t *testing.T) {
+	r := NewRendezvousHash()
+	_, err := r.Get("http://example.com")
+	assert.Equal(t, err, EmptyError)
+
+	r.AddWeighted("node1", 1)
+	token, err := r.Get("http://example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, token, "node1")
+}
+
+func TestRendezvousHashLoadVariance(t *testing.T) {
+	r := NewRendezvousHash()
+	for i := 0; i < 10; i++ {
+		r.AddWeighted("node"+strconv.Itoa(i), 1)
+	}
+
+	values := make([]float64, 0)
+	for _, n := range loads(r, 100000) {
+		values = append(values, float64(n))
+	}
+	variation := coefficientOfVariation(values)
+	t.Logf("coefficient of variation: %.3f", variation)
+	assert.True(t, variation < 0.05)
+}
+
+func TestRendezvousHashRemove(t *testing.T) {
+	r := NewRendezvousHash()
+	for i := 0; i < 5; i++ {
+		r.AddWeighted("node"+strconv.Itoa(i), 1)
+	}
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "http://host" + strconv.Itoa(i) + ".example.com"
+		before[key], _ = r.Get(key)
+	}
+
+	// only the keys of the removed token move
+	r.Remove("node2")
+	for key, token := range before {
+		after, _ := r.Get(key)
+		if token == "node2" {
+			assert.NotEqual(t, after, "node2")
+		} else {
+			assert.Equal(t, after, token)
+		}
+	}
+}
+
+func TestRendezvousHashAddWeighted(t *testing.T) {
+	r := NewRendezvousHash()
+	r.AddWeighted("small", 1)
+	r.AddWeighted("large", 3)
+
+	counts := loads(r, 100000)
+	ratio := float64(counts["large"]) / float64(counts["small"])
+	t.Logf("large takes %.2f times as many keys as small", ratio)
+	assert.InDelta(t, ratio, 3, 0.3)
+}
@@ -1,52 +1,324 @@
 package exchange
 
 import (
+	"../protocol"
 	"errors"
-	"fmt"
 	"net/url"
 	"sync"
 )
 
 var (
-	CrawlerNotFound = errors.New("Crawler Not Found")
+	CrawlerNotFound  = errors.New("Crawler Not Found")
+	CrawlerDraining  = errors.New("Crawler is draining already")
+	DuplicateCrawler = errors.New("Crawler of the same id is connected")
+	UnboundedHash    = errors.New("Hash cannot bound loads")
 )
 
+// boundedHash is a Hash which can pass over loaded tokens.
+type boundedHash interface {
+	Hash
+	SetLoadBound(epsilon float64)
+	SetLoad(token string, load int)
+	Owner(key string) (string, error)
+}
+
 type Router struct {
-	crawlers map[string]*Crawler
-	ring     *ConsistentHash
+	crawlers    map[string]*Crawler
+	strategy    Strategy
+	hash        Hash
+	outstanding map[string]map[string]*protocol.Link // URLs assigned to each crawler
+	reported    map[string]int                       // loads of remote crawlers
+	draining    map[string]bool                      // crawlers taken off the ring but still connected
+	added       chan struct{}                        // signaled when a crawler is added
 	sync.RWMutex
 }
 
 func NewRouter() *Router {
 	r := new(Router)
 	r.crawlers = make(map[string]*Crawler)
-	r.ring = NewConsistentHash()
+	r.strategy = HostStrategy{}
+	r.hash = NewConsistentHash()
+	r.outstanding = make(map[string]map[string]*protocol.Link)
+	r.reported = make(map[string]int)
+	r.draining = make(map[string]bool)
+	r.added = make(chan struct{}, 1)
 
 	return r
 }
 
-func (r *Router) Add(c *Crawler) {
+// SetStrategy makes URLs routed by the keys of s. Every exchange of a
+// cluster should use the same strategy.
+func (r *Router) SetStrategy(s Strategy) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.strategy = s
+}
+
+// SetHash shares keys out among the crawlers with h. Every exchange of a
+// cluster should use the same hash.
+func (r *Router) SetHash(h Hash) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.hash = h
+	for id, c := range r.crawlers {
+		if r.draining[id] {
+			continue
+		}
+		h.AddWeighted(id, c.GetWeight())
+		r.updateLoad(id)
+	}
+}
+
+// SetLoadBound makes a crawler which holds (1+epsilon) times its share of
+// the outstanding URLs passed over, so that a few large hosts cannot swamp
+// it. Legacy crawlers never finish URLs, and count as idle. It fails when
+// the hash cannot bound loads.
+func (r *Router) SetLoadBound(epsilon float64) error {
+	r.Lock()
+	defer r.Unlock()
+
+	bounded, ok := r.hash.(boundedHash)
+	if !ok {
+		return UnboundedHash
+	}
+	bounded.SetLoadBound(epsilon)
+	return nil
+}
+
+// SetLoad tells the number of URLs a crawler of another exchange holds.
+func (r *Router) SetLoad(c *Crawler, load int) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.crawlers[c.GetId()] != c {
+		return
+	}
+	r.reported[c.GetId()] = load
+	r.updateLoad(c.GetId())
+}
+
+// updateLoad passes the load of the crawler id to the hash.
+func (r *Router) updateLoad(id string) {
+	bounded, ok := r.hash.(boundedHash)
+	if !ok {
+		return
+	}
+
+	if links, exists := r.outstanding[id]; exists {
+		bounded.SetLoad(id, len(links))
+	} else {
+		bounded.SetLoad(id, r.reported[id])
+	}
+}
+
+// Add puts c on the ring, replacing a crawler of the same id which is
+// connected to another exchange. It fails when one is connected to this
+// exchange, since a crawler keeps its id across sessions.
+func (r *Router) Add(c *Crawler) error {
 	r.Lock()
 	defer r.Unlock()
 
+	known, exists := r.crawlers[c.GetId()]
+	if exists && known != c && known.GetConn() != nil {
+		return DuplicateCrawler
+	}
+	if !exists {
+		ringChanges.WithLabelValues("join").Inc()
+	}
+
 	r.crawlers[c.GetId()] = c
-	r.ring.Add(c.GetId())
+	r.hash.AddWeighted(c.GetId(), c.GetWeight())
+	delete(r.reported, c.GetId())
+	r.updateLoad(c.GetId())
+
+	select {
+	case r.added <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Added is signaled after crawlers are added.
+func (r *Router) Added() <-chan struct{} {
+	return r.added
 }
 
-func (r *Router) Remove(c *Crawler) {
+// Remove takes c out of the ring, and returns the URLs it has not finished
+// so that they can be routed to the new owners. Nothing is done when c has
+// been replaced by another crawler of the same id.
+func (r *Router) Remove(c *Crawler) []*protocol.Link {
 	r.Lock()
 	defer r.Unlock()
 
-	r.ring.Remove(c.GetId())
+	if r.crawlers[c.GetId()] != c {
+		return nil
+	}
+
+	if !r.draining[c.GetId()] {
+		r.hash.Remove(c.GetId())
+		ringChanges.WithLabelValues("leave").Inc()
+	}
 	delete(r.crawlers, c.GetId())
+	delete(r.draining, c.GetId())
+	delete(r.reported, c.GetId())
+
+	links := make([]*protocol.Link, 0, len(r.outstanding[c.GetId()]))
+	for _, link := range r.outstanding[c.GetId()] {
+		links = append(links, link)
+	}
+	delete(r.outstanding, c.GetId())
+	return links
+}
+
+// Drain takes c off the ring, so that it is routed no more URLs, but keeps
+// track of the URLs it has not finished until it is removed.
+func (r *Router) Drain(c *Crawler) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.crawlers[c.GetId()] != c {
+		return CrawlerNotFound
+	} else if r.draining[c.GetId()] {
+		return CrawlerDraining
+	}
+
+	r.hash.Remove(c.GetId())
+	r.draining[c.GetId()] = true
+	ringChanges.WithLabelValues("leave").Inc()
+	return nil
 }
 
-func (r *Router) Route(rawurl string) (c *Crawler, err error) {
+// Draining reports whether c has been drained.
+func (r *Router) Draining(c *Crawler) bool {
 	r.RLock()
 	defer r.RUnlock()
 
-	parsed, _ := url.Parse(rawurl)
-	id, err := r.ring.Get(fmt.Sprintf("%s://%s", parsed.Scheme, parsed.Host))
+	return r.crawlers[c.GetId()] == c && r.draining[c.GetId()]
+}
+
+// Assign records that link has been routed to c, unless c has been removed
+// or drained.
+func (r *Router) Assign(c *Crawler, link *protocol.Link) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.crawlers[c.GetId()] != c || r.draining[c.GetId()] {
+		return
+	}
+
+	links, exists := r.outstanding[c.GetId()]
+	if !exists {
+		links = make(map[string]*protocol.Link)
+		r.outstanding[c.GetId()] = links
+	}
+	links[link.URL.String()] = link
+	r.updateLoad(c.GetId())
+}
+
+// Complete forgets links which c has finished with.
+func (r *Router) Complete(c *Crawler, links []*protocol.Link) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, link := range links {
+		delete(r.outstanding[c.GetId()], link.URL.String())
+	}
+	r.updateLoad(c.GetId())
+}
+
+// Outstanding returns the number of URLs c has not finished.
+func (r *Router) Outstanding(c *Crawler) int {
+	r.RLock()
+	defer r.RUnlock()
+
+	return len(r.outstanding[c.GetId()])
+}
+
+// Members returns the ids of the crawlers connected to the exchange eid
+// which are on the ring.
+func (r *Router) Members(eid exchangeid) []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	ids := make([]string, 0)
+	for id, c := range r.crawlers {
+		if c.GetExchangeId() == eid && !r.draining[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Get returns the crawler id.
+func (r *Router) Get(id string) (*Crawler, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	c, exists := r.crawlers[id]
+	if !exists {
+		return nil, CrawlerNotFound
+	}
+	return c, nil
+}
+
+// Crawlers returns every crawler in the cluster.
+func (r *Router) Crawlers() []*Crawler {
+	r.RLock()
+	defer r.RUnlock()
+
+	crawlers := make([]*Crawler, 0, len(r.crawlers))
+	for _, c := range r.crawlers {
+		crawlers = append(crawlers, c)
+	}
+	return crawlers
+}
+
+// Ring returns the points of the hash ring in order, or nil when the hash
+// is not a ring.
+func (r *Router) Ring() []RingPoint {
+	r.RLock()
+	defer r.RUnlock()
+
+	if ring, ok := r.hash.(*ConsistentHash); ok {
+		return ring.Points()
+	}
+	return nil
+}
+
+// Route returns the crawler which takes rawurl, within the load bound if
+// one is set.
+func (r *Router) Route(rawurl string) (*Crawler, error) {
+	return r.route(rawurl, true)
+}
+
+// Owner returns the crawler which takes rawurl regardless of loads.
+func (r *Router) Owner(rawurl string) (*Crawler, error) {
+	return r.route(rawurl, false)
+}
+
+func (r *Router) route(rawurl string, bounded bool) (c *Crawler, err error) {
+	parsed, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+
+	// the key may take a lookup, so it is made without the lock
+	r.RLock()
+	strategy := r.strategy
+	r.RUnlock()
+	key := strategy.Key(parsed)
+
+	r.RLock()
+	defer r.RUnlock()
+
+	var id string
+	if h, ok := r.hash.(boundedHash); ok && !bounded {
+		id, err = h.Owner(key)
+	} else {
+		id, err = r.hash.Get(key)
+	}
 	if err != nil {
 		c = nil
 		return
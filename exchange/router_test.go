@@ -0,0 +1,161 @@
+package exchange
+
+import (
+	"../protocol"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRouterDuplicateCrawler(t *testing.T) {
+	r := NewRouter()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	local := &Crawler{"c1", "a", 1, protocol.NewFramedConn(server), protocol.NewOutbox(), newSendQueue(), time.Now(), 0}
+	assert.Nil(t, r.Add(local))
+	assert.Nil(t, r.Add(local))
+
+	duplicate := &Crawler{"c1", "a", 1, protocol.NewFramedConn(client), protocol.NewOutbox(), newSendQueue(), time.Now(), 0}
+	assert.Equal(t, r.Add(duplicate), DuplicateCrawler)
+	assert.Equal(t, r.Add(newRemoteCrawler("c1", "b", 1)), DuplicateCrawler)
+
+	// removing the rejected one leaves the live one
+	r.Remove(duplicate)
+	c, err := r.Route("http://example.com/")
+	if assert.Nil(t, err) {
+		assert.True(t, c == local)
+	}
+
+	r.Remove(local)
+	_, err = r.Route("http://example.com/")
+	assert.NotNil(t, err)
+
+	remote := newRemoteCrawler("c1", "b", 1)
+	assert.Nil(t, r.Add(remote))
+	assert.Nil(t, r.Add(local))
+	r.Remove(remote)
+	c, err = r.Route("http://example.com/")
+	if assert.Nil(t, err) {
+		assert.True(t, c == local)
+	}
+}
+
+func TestRouterStrategy(t *testing.T) {
+	r := NewRouter()
+	r.SetStrategy(DomainStrategy{})
+	for _, id := range []string{"c1", "c2", "c3", "c4"} {
+		assert.Nil(t, r.Add(newRemoteCrawler(id, "a", 1)))
+	}
+
+	// the hash is swapped with the crawlers in place
+	r.SetHash(NewRendezvousHash())
+	assert.Nil(t, r.Ring())
+
+	first, err := r.Route("http://www.example.co.uk/")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	for _, rawurl := range []string{"https://shop.example.co.uk/cart", "http://EXAMPLE.co.uk:8080/"} {
+		c, err := r.Route(rawurl)
+		if assert.Nil(t, err) {
+			assert.Equal(t, c.GetId(), first.GetId())
+		}
+	}
+
+	_, err = r.Route("http://%zz/")
+	assert.NotNil(t, err)
+}
+
+func TestRouterLoadBound(t *testing.T) {
+	r := NewRouter()
+	r.SetHash(NewRendezvousHash())
+	assert.Equal(t, r.SetLoadBound(0.25), UnboundedHash)
+
+	r.SetHash(NewConsistentHash())
+	assert.Nil(t, r.SetLoadBound(0.25))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	local := &Crawler{"c1", "a", 1, protocol.NewFramedConn(server), protocol.NewOutbox(), newSendQueue(), time.Now(), 0}
+	assert.Nil(t, r.Add(local))
+	remote := newRemoteCrawler("c2", "b", 1)
+	assert.Nil(t, r.Add(remote))
+
+	// find a host owned by the local crawler
+	var rawurl string
+	for i := 0; ; i++ {
+		rawurl = "http://host" + strconv.Itoa(i) + ".example.com/"
+		if c, _ := r.Owner(rawurl); c == local {
+			break
+		}
+	}
+
+	links := make([]*protocol.Link, 0)
+	for i := 0; i < 4; i++ {
+		link, _ := protocol.ParseLink(rawurl + strconv.Itoa(i))
+		links = append(links, link)
+		r.Assign(local, link)
+	}
+	c, err := r.Route(rawurl)
+	if assert.Nil(t, err) {
+		assert.True(t, c == remote)
+	}
+
+	// a loaded remote crawler is passed over as well
+	r.SetLoad(remote, 8)
+	c, _ = r.Route(rawurl)
+	assert.True(t, c == local)
+
+	r.SetLoad(remote, 0)
+	r.Complete(local, links)
+	c, _ = r.Route(rawurl)
+	assert.True(t, c == local)
+	c, _ = r.Owner(rawurl)
+	assert.True(t, c == local)
+}
+
+func TestRouterDrain(t *testing.T) {
+	r := NewRouter()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	local := &Crawler{"c1", "a", 1, protocol.NewFramedConn(server), protocol.NewOutbox(), newSendQueue(), time.Now(), 0}
+	assert.Nil(t, r.Add(local))
+	remote := newRemoteCrawler("c2", "b", 1)
+	assert.Nil(t, r.Add(remote))
+
+	link, _ := protocol.ParseLink("http://example.com/")
+	r.Assign(local, link)
+
+	assert.Nil(t, r.Drain(local))
+	assert.Equal(t, r.Drain(local), CrawlerDraining)
+	assert.Equal(t, r.Drain(newRemoteCrawler("c3", "b", 1)), CrawlerNotFound)
+	assert.True(t, r.Draining(local))
+
+	// a drained crawler is routed nothing and not announced, but keeps the
+	// URLs it has not finished
+	for i := 0; i < 100; i++ {
+		c, err := r.Route("http://host" + strconv.Itoa(i) + ".example.com/")
+		if assert.Nil(t, err) {
+			assert.True(t, c == remote)
+		}
+	}
+	assert.Equal(t, r.Members("a"), []string{})
+	assert.Equal(t, len(r.Crawlers()), 2)
+	another, _ := protocol.ParseLink("http://example.org/")
+	r.Assign(local, another)
+	assert.Equal(t, r.Outstanding(local), 1)
+
+	assert.Equal(t, r.Remove(local), []*protocol.Link{link})
+	assert.False(t, r.Draining(local))
+	assert.Equal(t, len(r.Crawlers()), 1)
+}
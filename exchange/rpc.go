@@ -0,0 +1,284 @@
+package exchange
+
+import (
+	"../protocol"
+	"../rpc"
+	"context"
+	"google.golang.org/grpc"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"net"
+	urlparse "net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The exchange is served over gRPC as the service kaken.Exchange of
+// rpc/exchange.proto, whose messages are converted from the ones of the
+// framed protocol and of the admin API.
+
+type rpcServer struct {
+	rpc.UnimplementedExchangeServer
+	e *Exchange
+}
+
+// RegisterService serves the exchange over s. s must be stopped before
+// the exchange.
+func (e *Exchange) RegisterService(s grpc.ServiceRegistrar) {
+	rpc.RegisterExchangeServer(s, &rpcServer{e: e})
+}
+
+func (s *rpcServer) Crawl(stream rpc.Exchange_CrawlServer) error {
+	conn := &streamConn{stream: stream, done: make(chan struct{})}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.e.serve(conn)
+	}()
+
+	// returning ends the stream, which lets serve out of Read
+	select {
+	case <-served:
+	case <-conn.done:
+	}
+	return nil
+}
+
+func (s *rpcServer) SubmitURLs(ctx context.Context, req *rpc.SubmitURLsRequest) (*rpc.SubmitURLsResponse, error) {
+	addr := "unknown"
+	if p, ok := grpcpeer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+
+	resp := &rpc.SubmitURLsResponse{}
+	links := make([]*protocol.Link, 0, len(req.Urls))
+	for _, l := range req.Urls {
+		if link, err := linkFromRPC(l); err == nil {
+			links = append(links, link)
+		} else {
+			resp.Rejected = append(resp.Rejected, &rpc.Rejection{Url: l.Url, Error: err.Error()})
+		}
+	}
+
+	submitted := s.e.submitSeeds(links, addr)
+	resp.Accepted = int32(submitted.Accepted)
+	for _, r := range submitted.Rejected {
+		resp.Rejected = append(resp.Rejected, &rpc.Rejection{Url: r.URL, Error: r.Error})
+	}
+	return resp, nil
+}
+
+func (s *rpcServer) ListCrawlers(ctx context.Context, req *rpc.ListCrawlersRequest) (*rpc.ListCrawlersResponse, error) {
+	resp := &rpc.ListCrawlersResponse{}
+	for _, info := range s.e.crawlerInfos() {
+		crawler := &rpc.CrawlerInfo{
+			Id:          info.ID,
+			Exchange:    info.Exchange,
+			Weight:      info.Weight,
+			Addr:        info.Addr,
+			Sent:        info.Sent,
+			Queued:      int32(info.Queued),
+			Outstanding: int32(info.Outstanding),
+			Draining:    info.Draining}
+		if info.Since != nil {
+			crawler.Since = timestamppb.New(*info.Since)
+		}
+		resp.Crawlers = append(resp.Crawlers, crawler)
+	}
+	return resp, nil
+}
+
+// submitSeeds queues links as seeds from addr.
+func (e *Exchange) submitSeeds(links []*protocol.Link, addr string) *SubmitURLsResponse {
+	resp := &SubmitURLsResponse{}
+	for _, link := range links {
+		if link == nil {
+			continue
+		}
+
+		if err := e.submit(link, "seed", addr); err == nil {
+			resp.Accepted++
+		} else {
+			resp.Rejected = append(resp.Rejected, Rejection{link.URL.String(), err.Error()})
+		}
+	}
+	return resp
+}
+
+// crawlerInfos describes every crawler in the cluster in order of id.
+func (e *Exchange) crawlerInfos() []CrawlerInfo {
+	crawlers := e.router.Crawlers()
+	sort.Slice(crawlers, func(i, j int) bool {
+		return crawlers[i].GetId() < crawlers[j].GetId()
+	})
+
+	infos := make([]CrawlerInfo, len(crawlers))
+	for i, c := range crawlers {
+		infos[i] = CrawlerInfo{ID: c.GetId(), Exchange: string(c.GetExchangeId()), Weight: c.GetWeight()}
+		if c.GetExchangeId() != e.id {
+			continue
+		}
+
+		since := c.GetSince()
+		infos[i].Addr = c.GetConn().RemoteAddr().String()
+		infos[i].Since = &since
+		infos[i].Sent = c.GetSent()
+		infos[i].Queued = c.sendq.Len()
+		infos[i].Outstanding = e.router.Outstanding(c)
+		infos[i].Draining = e.router.Draining(c)
+	}
+	return infos
+}
+
+func (s *rpcServer) GetRing(ctx context.Context, req *rpc.GetRingRequest) (*rpc.GetRingResponse, error) {
+	resp := &rpc.GetRingResponse{}
+	for _, point := range s.e.router.Ring() {
+		resp.Points = append(resp.Points, &rpc.RingPoint{Key: point.Key, Token: point.Token})
+	}
+	return resp, nil
+}
+
+// linkFromRPC returns the link l describes, which is checked like a link
+// decoded from JSON.
+func linkFromRPC(l *rpc.Link) (*protocol.Link, error) {
+	url, err := urlparse.Parse(l.Url)
+	if err != nil {
+		return nil, err
+	} else if l.Depth < 0 || l.Hops < 0 {
+		return nil, protocol.InvalidLink
+	} else if !protocol.ValidScope(l.Scope) {
+		return nil, protocol.InvalidScope
+	}
+
+	link := protocol.NewSeed(url)
+	link.Depth = int(l.Depth)
+	link.Hops = int(l.Hops)
+	link.Referrer = l.Referrer
+	if l.Seed != "" {
+		link.Seed = l.Seed
+	}
+	link.Priority = int(l.Priority)
+	link.Scope = l.Scope
+	return link, nil
+}
+
+func linkToRPC(link *protocol.Link) *rpc.Link {
+	return &rpc.Link{
+		Url:      link.URL.String(),
+		Depth:    int32(link.Depth),
+		Hops:     int32(link.Hops),
+		Referrer: link.Referrer,
+		Seed:     link.Seed,
+		Priority: int32(link.Priority),
+		Scope:    link.Scope}
+}
+
+// messageFromRPC returns the message m describes, or InvalidMessage when it
+// has no type or an invalid link.
+func messageFromRPC(m *rpc.Message) (*protocol.Message, error) {
+	message := &protocol.Message{
+		Type:    m.Type,
+		Version: int(m.Version),
+		Role:    m.Role,
+		Crawler: m.Crawler,
+		Weight:  m.Weight,
+		Credits: int(m.Credits),
+		ID:      m.Id,
+		Error:   m.Error}
+	for _, l := range m.Urls {
+		link, err := linkFromRPC(l)
+		if err != nil {
+			return nil, protocol.InvalidMessage
+		}
+		message.Links = append(message.Links, link)
+	}
+
+	if err := message.Validate(); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func messageToRPC(m *protocol.Message) *rpc.Message {
+	message := &rpc.Message{
+		Type:    m.Type,
+		Version: int32(m.Version),
+		Role:    m.Role,
+		Crawler: m.Crawler,
+		Weight:  m.Weight,
+		Credits: int32(m.Credits),
+		Id:      m.ID,
+		Error:   m.Error}
+	for _, link := range m.Links {
+		message.Urls = append(message.Urls, linkToRPC(link))
+	}
+	return message
+}
+
+type rpcAddr string
+
+func (a rpcAddr) Network() string {
+	return "grpc"
+}
+
+func (a rpcAddr) String() string {
+	return string(a)
+}
+
+// streamConn is a protocol.Conn over a Crawl stream. Idle streams are
+// watched by the keepalive of gRPC, so read deadlines are ignored.
+type streamConn struct {
+	stream rpc.Exchange_CrawlServer
+	done   chan struct{} // closed by Close
+	sync.Mutex
+}
+
+func (c *streamConn) Read() (*protocol.Message, error) {
+	m, err := c.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return messageFromRPC(m)
+}
+
+func (c *streamConn) Write(m *protocol.Message) error {
+	c.Lock()
+	defer c.Unlock()
+
+	select {
+	case <-c.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	return c.stream.Send(messageToRPC(m))
+}
+
+func (c *streamConn) Framed() bool {
+	return true
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	if p, ok := grpcpeer.FromContext(c.stream.Context()); ok {
+		return p.Addr
+	}
+	return rpcAddr("unknown")
+}
+
+// Close makes further writes fail and ends the stream.
+func (c *streamConn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	return nil
+}
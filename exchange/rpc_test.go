@@ -0,0 +1,121 @@
+package exchange
+
+import (
+	"../protocol"
+	"../rpc"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"testing"
+	"time"
+)
+
+func startRPC(t *testing.T, e *Exchange) (rpc.ExchangeClient, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	e.RegisterService(server)
+	go server.Serve(listener)
+
+	client, err := grpc.NewClient(listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rpc.NewExchangeClient(client), func() {
+		client.Close()
+		server.Stop()
+	}
+}
+
+func TestRPC(t *testing.T) {
+	e, stop := startExchange(t, "a", nil)
+	defer stop()
+	client, stopRPC := startRPC(t, e)
+	defer stopRPC()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Crawl(ctx)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Nil(t, stream.Send(&rpc.Message{Type: protocol.Hello, Version: protocol.Version, Role: protocol.RoleCrawler}))
+
+	m, err := stream.Recv()
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, m.Type, protocol.Hello)
+	assert.Equal(t, m.Version, int32(protocol.Version))
+	// an invalid link is rejected instead of crashing the exchange
+	assert.Nil(t, stream.Send(&rpc.Message{Type: protocol.URLs, Id: 1, Urls: []*rpc.Link{{Url: "http://example.com/", Depth: -1}}}))
+	for {
+		m, err := stream.Recv()
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		if m.Type == protocol.Error {
+			assert.Equal(t, m.Error, protocol.InvalidMessage.Error())
+			break
+		}
+	}
+
+	var crawlers *rpc.ListCrawlersResponse
+	waitFor(t, func() bool {
+		crawlers, err = client.ListCrawlers(ctx, &rpc.ListCrawlersRequest{})
+		return err == nil && len(crawlers.Crawlers) == 1
+	})
+	assert.Equal(t, crawlers.Crawlers[0].Exchange, "a")
+	assert.NotNil(t, crawlers.Crawlers[0].Since)
+
+	ring, err := client.GetRing(ctx, &rpc.GetRingRequest{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(ring.Points), defaultVnodes)
+		for _, point := range ring.Points {
+			assert.Equal(t, point.Token, crawlers.Crawlers[0].Id)
+		}
+	}
+
+	req := &rpc.SubmitURLsRequest{Urls: []*rpc.Link{
+		{Url: "http://example.com/"},
+		{Url: "ftp://example.com/"},
+		{Url: "http://example.org/", Scope: "galaxy"}}}
+	submitted, err := client.SubmitURLs(ctx, req)
+	if assert.Nil(t, err) {
+		assert.Equal(t, submitted.Accepted, int32(1))
+		if assert.Equal(t, len(submitted.Rejected), 2) {
+			assert.Equal(t, submitted.Rejected[0].Url, "http://example.org/")
+			assert.Equal(t, submitted.Rejected[1].Url, "ftp://example.com/")
+		}
+	}
+
+	for {
+		m, err := stream.Recv()
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		if m.Type != protocol.URLs {
+			continue
+		}
+
+		if assert.Equal(t, len(m.Urls), 1) {
+			assert.Equal(t, m.Urls[0].Url, "http://example.com/")
+			assert.Equal(t, m.Urls[0].Seed, "http://example.com/")
+		}
+		stream.Send(&rpc.Message{Type: protocol.Ack, Id: m.Id})
+		break
+	}
+
+	stream.CloseSend()
+	waitFor(t, func() bool {
+		return len(e.router.Crawlers()) == 0
+	})
+}
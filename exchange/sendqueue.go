@@ -0,0 +1,135 @@
+package exchange
+
+import (
+	"../protocol"
+	"errors"
+	"sync"
+)
+
+const sendQueueSize = 10000 // URLs queued for a crawler at most
+
+var (
+	SendQueueFull   = errors.New("Send queue is full")
+	SendQueueClosed = errors.New("Send queue was closed")
+)
+
+// sendQueue holds the URLs routed to a crawler until they are sent, so that
+// a slow crawler never holds up routing to the others. Once the crawler
+// grants credits, only as many URLs are taken as it has granted, and the
+// queue fills up while it grants none.
+type sendQueue struct {
+	links   []*protocol.Link
+	max     int
+	limited bool // whether credits are counted
+	credits int
+	closed  bool
+	ready   chan struct{} // signaled when links may be taken
+	sync.Mutex
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		links: make([]*protocol.Link, 0),
+		max:   sendQueueSize,
+		ready: make(chan struct{}, 1)}
+}
+
+// Limit makes the queue hand out no more links than credits and those
+// granted later.
+func (q *sendQueue) Limit(credits int) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.limited = true
+	q.credits = credits
+	q.signal()
+}
+
+// Grant allows n more links to be taken.
+func (q *sendQueue) Grant(n int) {
+	q.Lock()
+	defer q.Unlock()
+
+	if n > 0 {
+		q.credits += n
+		q.signal()
+	}
+}
+
+// Push appends link, and fails when the queue is full or has been closed.
+func (q *sendQueue) Push(link *protocol.Link) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return SendQueueClosed
+	} else if len(q.links) >= q.max {
+		return SendQueueFull
+	}
+	q.links = append(q.links, link)
+	q.signal()
+	return nil
+}
+
+// Take removes up to max links which may be sent now.
+func (q *sendQueue) Take(max int) []*protocol.Link {
+	q.Lock()
+	defer q.Unlock()
+
+	n := len(q.links)
+	if n > max {
+		n = max
+	}
+	if q.limited && n > q.credits {
+		n = q.credits
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	links := q.links[:n:n]
+	q.links = q.links[n:]
+	if q.limited {
+		q.credits -= n
+	}
+	return links
+}
+
+// Len returns the number of links waiting to be sent.
+func (q *sendQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.links)
+}
+
+// Credits returns the number of links which may be sent, or -1 when they
+// are not limited.
+func (q *sendQueue) Credits() int {
+	q.Lock()
+	defer q.Unlock()
+
+	if !q.limited {
+		return -1
+	}
+	return q.credits
+}
+
+// Close makes further pushes fail, and returns the links which were not
+// taken.
+func (q *sendQueue) Close() []*protocol.Link {
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	links := q.links
+	q.links = make([]*protocol.Link, 0)
+	return links
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,61 @@
+package exchange
+
+import (
+	"../protocol"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue()
+	for i := 0; i < 5; i++ {
+		link, _ := protocol.ParseLink("http://example.com/" + strconv.Itoa(i))
+		assert.Nil(t, q.Push(link))
+	}
+
+	// links are not limited until the crawler grants credits
+	assert.Equal(t, q.Credits(), -1)
+	assert.Equal(t, len(q.Take(2)), 2)
+
+	q.Limit(1)
+	links := q.Take(10)
+	if assert.Equal(t, len(links), 1) {
+		assert.Equal(t, links[0].URL.String(), "http://example.com/2")
+	}
+	assert.Equal(t, len(q.Take(10)), 0)
+	assert.Equal(t, q.Len(), 2)
+
+	q.Grant(5)
+	assert.Equal(t, len(q.Take(10)), 2)
+	assert.Equal(t, q.Credits(), 3)
+
+	link, _ := protocol.ParseLink("http://example.com/5")
+	q.Push(link)
+	assert.Equal(t, len(q.Close()), 1)
+	assert.Equal(t, q.Push(link), SendQueueClosed)
+	assert.Equal(t, q.Len(), 0)
+}
+
+func TestSendQueueFull(t *testing.T) {
+	q := newSendQueue()
+	q.max = 2
+	q.Limit(0)
+
+	// a crawler which grants no credits fills its queue up
+	for i := 0; i < 3; i++ {
+		link, _ := protocol.ParseLink("http://example.com/" + strconv.Itoa(i))
+		if i < q.max {
+			assert.Nil(t, q.Push(link))
+		} else {
+			assert.Equal(t, q.Push(link), SendQueueFull)
+		}
+	}
+	assert.Equal(t, len(q.Take(10)), 0)
+	assert.Equal(t, q.Len(), 2)
+
+	q.Grant(1)
+	assert.Equal(t, len(q.Take(10)), 1)
+	link, _ := protocol.ParseLink("http://example.com/3")
+	assert.Nil(t, q.Push(link))
+}
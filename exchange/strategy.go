@@ -0,0 +1,169 @@
+package exchange
+
+import (
+	"code.google.com/p/go.net/publicsuffix"
+	"context"
+	"errors"
+	"net"
+	urlparse "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of strategies and hashes to choose from in configuration.
+const (
+	RouteByHost   = "host"
+	RouteByDomain = "domain"
+	RouteByIP     = "ip"
+
+	HashRing       = "ring"
+	HashRendezvous = "rendezvous"
+)
+
+const (
+	ipCacheSize = 100000
+	ipLookups   = 32 // at once
+)
+
+var (
+	UnknownStrategy = errors.New("Routing strategy is unknown")
+	UnknownHash     = errors.New("Hash is unknown")
+
+	ipLookupTimeout = 2 * time.Second
+	ipCacheTTL      = 10 * time.Minute
+	ipFailureTTL    = 1 * time.Minute // before a host which failed is looked up again
+)
+
+// Strategy decides what URLs are routed by. URLs of the same key are
+// crawled by the same crawler, which keeps its politeness and caches.
+type Strategy interface {
+	Key(url *urlparse.URL) string
+}
+
+// Hash shares keys out among crawlers in proportion to their weights.
+type Hash interface {
+	AddWeighted(token string, weight float64)
+	Remove(token string)
+	Get(key string) (string, error)
+}
+
+// NewStrategy returns the strategy of name.
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case RouteByHost:
+		return HostStrategy{}, nil
+	case RouteByDomain:
+		return DomainStrategy{}, nil
+	case RouteByIP:
+		return NewIPStrategy(), nil
+	}
+	return nil, UnknownStrategy
+}
+
+// NewHash returns the hash of name. vnodes is the number of points a
+// crawler of weight 1 takes on a ring.
+func NewHash(name string, vnodes int) (Hash, error) {
+	switch name {
+	case HashRing:
+		ring := NewConsistentHash()
+		ring.SetVnodes(vnodes)
+		return ring, nil
+	case HashRendezvous:
+		return NewRendezvousHash(), nil
+	}
+	return nil, UnknownHash
+}
+
+// HostStrategy routes URLs by host name, regardless of scheme and port.
+type HostStrategy struct{}
+
+func (HostStrategy) Key(url *urlparse.URL) string {
+	return strings.ToLower(url.Hostname())
+}
+
+// DomainStrategy routes URLs by registered domain, the public suffix and
+// one label before it, so that the subdomains of a site go together.
+type DomainStrategy struct{}
+
+func (DomainStrategy) Key(url *urlparse.URL) string {
+	host := HostStrategy{}.Key(url)
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+type ipCacheEntry struct {
+	ip      string // the host itself when it failed to resolve
+	expires time.Time
+}
+
+// IPStrategy routes URLs by the address their host resolves to, so that
+// hosts served by the same machine go together. Hosts are resolved in the
+// background, so that a slow resolver holds up no routing, and URLs of a
+// host are routed by host name until it is resolved or when it cannot be.
+type IPStrategy struct {
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, error)
+	cache   map[string]ipCacheEntry
+	pending map[string]bool // hosts being looked up
+	sync.Mutex
+}
+
+func NewIPStrategy() *IPStrategy {
+	return &IPStrategy{
+		lookup:  net.DefaultResolver.LookupIPAddr,
+		cache:   make(map[string]ipCacheEntry),
+		pending: make(map[string]bool)}
+}
+
+func (s *IPStrategy) Key(url *urlparse.URL) string {
+	host := HostStrategy{}.Key(url)
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if entry, exists := s.cache[host]; exists && time.Now().Before(entry.expires) {
+		return entry.ip
+	}
+	if !s.pending[host] && len(s.pending) < ipLookups {
+		s.pending[host] = true
+		go s.resolve(host)
+	}
+	return host
+}
+
+// resolve looks up host and caches its lowest address, since resolvers
+// shuffle them.
+func (s *IPStrategy) resolve(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ipLookupTimeout)
+	defer cancel()
+
+	entry := ipCacheEntry{host, time.Now().Add(ipFailureTTL)}
+	if addrs, err := s.lookup(ctx, host); err == nil && len(addrs) > 0 {
+		ips := make([]string, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP.String()
+		}
+		sort.Strings(ips)
+		entry = ipCacheEntry{ips[0], time.Now().Add(ipCacheTTL)}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.pending, host)
+	if len(s.cache) >= ipCacheSize {
+		s.cache = make(map[string]ipCacheEntry)
+	}
+	s.cache[host] = entry
+}
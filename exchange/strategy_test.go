@@ -0,0 +1,108 @@
+package exchange
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func strategyKey(s Strategy, rawurl string) string {
+	parsed, _ := url.Parse(rawurl)
+	return s.Key(parsed)
+}
+
+func TestHostStrategy(t *testing.T) {
+	s := HostStrategy{}
+	assert.Equal(t, strategyKey(s, "http://example.com/a"), "example.com")
+	assert.Equal(t, strategyKey(s, "https://Example.COM:8443/b"), "example.com")
+	assert.NotEqual(t, strategyKey(s, "http://www.example.com/"), strategyKey(s, "http://example.com/"))
+}
+
+func TestDomainStrategy(t *testing.T) {
+	s := DomainStrategy{}
+	assert.Equal(t, strategyKey(s, "http://a.example.co.uk/"), "example.co.uk")
+	assert.Equal(t, strategyKey(s, "https://b.example.co.uk/"), "example.co.uk")
+	assert.Equal(t, strategyKey(s, "http://www.example.com/"), "example.com")
+	assert.NotEqual(t, strategyKey(s, "http://a.example.com/"), strategyKey(s, "http://a.example.org/"))
+
+	// hosts without a registered domain are routed by host
+	assert.Equal(t, strategyKey(s, "http://192.168.0.1:8080/"), "192.168.0.1")
+	assert.Equal(t, strategyKey(s, "http://localhost/"), "localhost")
+}
+
+// resolvedKey returns the key of rawurl once s has looked up its host.
+func resolvedKey(t *testing.T, s *IPStrategy, rawurl string) string {
+	parsed, _ := url.Parse(rawurl)
+	waitFor(t, func() bool {
+		s.Lock()
+		defer s.Unlock()
+
+		_, cached := s.cache[parsed.Hostname()]
+		return cached
+	})
+	return s.Key(parsed)
+}
+
+func TestIPStrategy(t *testing.T) {
+	var lookups atomic.Int32
+	s := NewIPStrategy()
+	s.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups.Add(1)
+		switch host {
+		case "a.example.com", "b.example.net":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("10.0.0.1")}}, nil
+		case "c.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.3")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	// hosts are routed by name until they are resolved
+	assert.Equal(t, strategyKey(s, "http://a.example.com/"), "a.example.com")
+	assert.Equal(t, resolvedKey(t, s, "http://a.example.com/"), "10.0.0.1")
+	strategyKey(s, "http://b.example.net/")
+	assert.Equal(t, resolvedKey(t, s, "http://b.example.net/"), "10.0.0.1")
+	strategyKey(s, "http://c.example.com/")
+	assert.Equal(t, resolvedKey(t, s, "http://c.example.com/"), "10.0.0.3")
+	strategyKey(s, "http://unknown.example.com/")
+	assert.Equal(t, resolvedKey(t, s, "http://unknown.example.com/"), "unknown.example.com")
+	assert.Equal(t, strategyKey(s, "http://10.0.0.9/"), "10.0.0.9")
+	assert.Equal(t, lookups.Load(), int32(4))
+
+	// resolved hosts are cached, failed ones are looked up again a while later
+	assert.Equal(t, strategyKey(s, "https://a.example.com/x"), "10.0.0.1")
+	strategyKey(s, "http://unknown.example.com/")
+	assert.Equal(t, lookups.Load(), int32(4))
+
+	s.Lock()
+	for host, entry := range s.cache {
+		entry.expires = time.Now()
+		s.cache[host] = entry
+	}
+	s.Unlock()
+	strategyKey(s, "http://unknown.example.com/")
+	waitFor(t, func() bool {
+		return lookups.Load() == 5
+	})
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{RouteByHost, RouteByDomain, RouteByIP} {
+		_, err := NewStrategy(name)
+		assert.Nil(t, err)
+	}
+	_, err := NewStrategy("path")
+	assert.Equal(t, err, UnknownStrategy)
+
+	for _, name := range []string{HashRing, HashRendezvous} {
+		_, err := NewHash(name, defaultVnodes)
+		assert.Nil(t, err)
+	}
+	_, err = NewHash("modulo", defaultVnodes)
+	assert.Equal(t, err, UnknownHash)
+}
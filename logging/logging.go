@@ -0,0 +1,70 @@
+// Package logging sets up the structured logs of the programs.
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+var (
+	InvalidLevel  = errors.New("Log level is invalid")
+	InvalidFormat = errors.New("Log format is invalid")
+)
+
+// Fields which are logged under the same keys everywhere.
+const (
+	URL        = "url"
+	Host       = "host"
+	CrawlerID  = "crawler_id"
+	ExchangeID = "exchange_id"
+	Status     = "status"
+	Duration   = "duration" // in seconds
+	Error      = "error"
+	ErrorKind  = "error_kind"
+)
+
+// ParseLevel returns the level named debug, info, warn or error.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, InvalidLevel
+}
+
+// NewHandler returns a handler writing records of level and above to w, in
+// the format text or json.
+func NewHandler(w io.Writer, level string, format string) (slog.Handler, error) {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.NewTextHandler(w, options), nil
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	}
+	return nil, InvalidFormat
+}
+
+// Setup makes the handler of level and format the default of slog, which
+// the log package writes through as well.
+func Setup(w io.Writer, level string, format string) error {
+	h, err := NewHandler(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("debug")
+	assert.Nil(t, err)
+	assert.Equal(t, slog.LevelDebug, level)
+
+	level, err = ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, slog.LevelWarn, level)
+
+	_, err = ParseLevel("verbose")
+	assert.Equal(t, InvalidLevel, err)
+}
+
+func TestNewHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, "info", "json")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	logger := slog.New(h)
+	logger.Debug("Hidden")
+	logger.Info("Fetched", URL, "http://example.com/", Status, 200)
+
+	var record map[string]interface{}
+	if !assert.Nil(t, json.Unmarshal(buf.Bytes(), &record)) {
+		t.FailNow()
+	}
+	assert.Equal(t, "Fetched", record["msg"])
+	assert.Equal(t, "http://example.com/", record[URL])
+	assert.Equal(t, float64(200), record[Status])
+
+	buf.Reset()
+	h, err = NewHandler(&buf, "debug", "text")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	slog.New(h).Debug("Shown", Host, "example.com")
+	assert.True(t, strings.Contains(buf.String(), "host=example.com"))
+
+	_, err = NewHandler(&buf, "info", "xml")
+	assert.Equal(t, InvalidFormat, err)
+}
@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conn exchanges messages over a connection. Write may be called from
+// several goroutines at once, Read from only one.
+type Conn interface {
+	Read() (*Message, error)
+	Write(m *Message) error
+	// Framed reports whether the connection speaks the framed protocol,
+	// which has acknowledgements and heartbeats.
+	Framed() bool
+	SetReadDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+func writeAll(conn net.Conn, body []byte) error {
+	for wrote := 0; wrote < len(body); {
+		if _wrote, err := conn.Write(body[wrote:]); err == nil {
+			wrote += _wrote
+		} else {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLine reads up to and including the next newline, or fails with
+// FrameTooLong once the line is longer than MaxFrameSize.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxFrameSize {
+			return nil, FrameTooLong
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// framedConn carries a message per line encoded in JSON.
+type framedConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	sync.Mutex
+}
+
+func NewFramedConn(conn net.Conn) Conn {
+	return &framedConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn)}
+}
+
+// Read returns the next message. A line which is not a message is skipped
+// with InvalidMessage, and a line cut by the end of the connection is
+// io.ErrUnexpectedEOF. After FrameTooLong the connection cannot be read
+// any more.
+func (c *framedConn) Read() (*Message, error) {
+	line, err := readLine(c.reader)
+	if err == io.EOF && len(line) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := new(Message)
+	if err := json.Unmarshal(line, m); err != nil {
+		return nil, InvalidMessage
+	} else if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *framedConn) Write(m *Message) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return writeAll(c.conn, append(body, '\n'))
+}
+
+func (c *framedConn) Framed() bool {
+	return true
+}
+
+func (c *framedConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *framedConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *framedConn) Close() error {
+	return c.conn.Close()
+}
+
+// legacyConn speaks the line protocol, where each line is a link, JOIN,
+// QUIT or a link prefixed with SEED. Messages which have no counterpart in
+// it are not sent.
+type legacyConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	sync.Mutex
+}
+
+func NewLegacyConn(conn net.Conn) Conn {
+	return &legacyConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn)}
+}
+
+func (c *legacyConn) Read() (*Message, error) {
+	body, err := readLine(c.reader)
+	if err == io.EOF && len(body) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	line := string(body)
+
+	if strings.HasSuffix(line, "\r\n") {
+		line = line[:len(line)-2] + "\n"
+	}
+
+	switch {
+	case line == JoinLine:
+		return &Message{Type: Hello, Role: RoleCrawler}, nil
+	case line == QuitLine:
+		return &Message{Type: Quit}, nil
+	case strings.HasPrefix(line, SeedPrefix):
+		link, err := ParseLink(line[len(SeedPrefix):])
+		if err != nil {
+			return nil, InvalidMessage
+		}
+		return &Message{Type: Seeds, Links: []*Link{link}}, nil
+	}
+
+	link, err := ParseLink(line)
+	if err != nil {
+		return nil, InvalidMessage
+	}
+	return &Message{Type: URLs, Links: []*Link{link}}, nil
+}
+
+func (c *legacyConn) Write(m *Message) error {
+	var body string
+	switch m.Type {
+	case Hello:
+		if m.Role == RoleCrawler {
+			body = JoinLine
+		}
+	case Quit:
+		body = QuitLine
+	case URLs:
+		for _, link := range m.Links {
+			body += link.Encode()
+		}
+	case Seeds:
+		for _, link := range m.Links {
+			body += SeedPrefix + link.Encode()
+		}
+	}
+
+	if body == "" {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return writeAll(c.conn, []byte(body))
+}
+
+func (c *legacyConn) Framed() bool {
+	return false
+}
+
+func (c *legacyConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *legacyConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *legacyConn) Close() error {
+	return c.conn.Close()
+}
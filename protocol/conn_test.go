@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFramedConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	seedURL, _ := url.Parse("http://example.com/")
+	childURL, _ := url.Parse("http://example.org/a")
+	seed := NewSeed(seedURL)
+	seed.Scope = ScopeDomain
+	seed.Priority = 3
+	child := seed.Child(childURL)
+
+	go NewFramedConn(client).Write(&Message{Type: URLs, ID: 7, Links: []*Link{seed, child}})
+
+	m, err := NewFramedConn(server).Read()
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, m.Type, URLs)
+	assert.Equal(t, m.ID, uint64(7))
+	if assert.Equal(t, len(m.Links), 2) {
+		assert.Equal(t, m.Links[0].Encode(), seed.Encode())
+		assert.Equal(t, m.Links[1].Encode(), child.Encode())
+	}
+}
+
+func TestFramedConnInvalidMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("http://example.com/\n"))
+		client.Write([]byte(`{"type":"URLS","urls":[{"url":"http://example.com/","depth":-1}]}` + "\n"))
+		client.Write([]byte(`{"type":"URLS","urls":[{"url":"http://example.com/"},null]}` + "\n"))
+		client.Write([]byte(`{"type":"QUIT"}` + "\n"))
+		client.Write([]byte(`{"type":"QU`))
+		client.Close()
+	}()
+
+	conn := NewFramedConn(server)
+
+	_, err := conn.Read()
+	assert.Equal(t, err, InvalidMessage)
+	_, err = conn.Read()
+	assert.Equal(t, err, InvalidMessage)
+	// a null link would crash whoever reads the message
+	_, err = conn.Read()
+	assert.Equal(t, err, InvalidMessage)
+
+	m, err := conn.Read()
+	if assert.Nil(t, err) {
+		assert.Equal(t, m.Type, Quit)
+	}
+
+	_, err = conn.Read()
+	assert.Equal(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestFramedConnFrameTooLong(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte(`{"type":"HEARTBEAT"}` + "\n"))
+		client.Write([]byte(`{"type":"URLS","error":"` + strings.Repeat("a", MaxFrameSize) + `"}` + "\n"))
+	}()
+
+	conn := NewFramedConn(server)
+	m, err := conn.Read()
+	if assert.Nil(t, err) {
+		assert.Equal(t, m.Type, Heartbeat)
+	}
+	_, err = conn.Read()
+	assert.Equal(t, err, FrameTooLong)
+}
+
+func TestLegacyConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	seedURL, _ := url.Parse("http://example.com/")
+	seed := NewSeed(seedURL)
+
+	go func() {
+		conn := NewLegacyConn(client)
+		conn.Write(&Message{Type: Hello, Version: Version, Role: RoleCrawler})
+		conn.Write(&Message{Type: Heartbeat})
+		conn.Write(&Message{Type: URLs, Links: []*Link{seed}})
+		conn.Write(&Message{Type: Seeds, Links: []*Link{seed}})
+		conn.Write(&Message{Type: Quit})
+		client.Close()
+	}()
+
+	conn := NewLegacyConn(server)
+	for _, expected := range []string{Hello, URLs, Seeds, Quit} {
+		m, err := conn.Read()
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, m.Type, expected)
+		if expected == URLs || expected == Seeds {
+			if assert.Equal(t, len(m.Links), 1) {
+				assert.Equal(t, m.Links[0].URL.String(), "http://example.com/")
+			}
+		}
+	}
+
+	_, err := conn.Read()
+	assert.Equal(t, err, io.EOF)
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	_, ok := NegotiateVersion(0)
+	assert.False(t, ok)
+
+	version, ok := NegotiateVersion(1)
+	assert.True(t, ok)
+	assert.Equal(t, version, 1)
+
+	version, ok = NegotiateVersion(Version + 1)
+	assert.True(t, ok)
+	assert.Equal(t, version, Version)
+}
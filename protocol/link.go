@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"errors"
+	urlparse "net/url"
+	"strconv"
+	"strings"
+)
+
+// Lines other than links exchanged between crawlers and the exchange.
+const (
+	JoinLine   = "JOIN\n" // a crawler is ready to receive URLs
+	QuitLine   = "QUIT\n" // a crawler is leaving
+	SeedPrefix = "SEED "  // followed by a link to start crawling from
+)
+
+// Scopes which a seed can restrict its descendants to.
+const (
+	ScopeAny    = ""
+	ScopeHost   = "host"   // the seed's host
+	ScopeDomain = "domain" // the seed's host and its subdomains
+	ScopePrefix = "prefix" // URLs under the seed's directory
+)
+
+var (
+	InvalidLink  = errors.New("Link is invalid format")
+	InvalidScope = errors.New("Scope is unknown")
+)
+
+// Link is a URL waiting to be crawled together with where it came from.
+// Depth counts links followed from the seed, Hops counts consecutive links
+// followed away from the seed's host. Priority and Scope are inherited from
+// the seed.
+type Link struct {
+	URL      *urlparse.URL
+	Depth    int
+	Hops     int
+	Referrer string
+	Seed     string
+	Priority int
+	Scope    string
+}
+
+func NewSeed(url *urlparse.URL) *Link {
+	return &Link{
+		URL:      url,
+		Depth:    0,
+		Hops:     0,
+		Referrer: "",
+		Seed:     url.String(),
+		Priority: 0,
+		Scope:    ScopeAny}
+}
+
+// Child returns a link to url discovered on the page of l.
+func (l *Link) Child(url *urlparse.URL) *Link {
+	child := &Link{
+		URL:      url,
+		Depth:    l.Depth + 1,
+		Hops:     0,
+		Referrer: l.URL.String(),
+		Seed:     l.Seed,
+		Priority: l.Priority,
+		Scope:    l.Scope}
+
+	if seed, err := urlparse.Parse(l.Seed); err != nil || seed.Host != url.Host {
+		child.Hops = l.Hops + 1
+	}
+
+	return child
+}
+
+// InSeedScope reports whether l stays within the scope of its seed.
+func (l *Link) InSeedScope() bool {
+	if l.Scope == ScopeAny {
+		return true
+	}
+
+	seed, err := urlparse.Parse(l.Seed)
+	if err != nil {
+		return false
+	}
+
+	switch l.Scope {
+	case ScopeHost:
+		return l.URL.Host == seed.Host
+	case ScopeDomain:
+		domain := strings.TrimPrefix(strings.ToLower(seed.Hostname()), "www.")
+		host := strings.ToLower(l.URL.Hostname())
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	case ScopePrefix:
+		prefix := l.Seed
+		if i := strings.LastIndex(seed.Path, "/"); i >= 0 {
+			prefix = seed.Scheme + "://" + seed.Host + seed.Path[:i+1]
+		}
+		return strings.HasPrefix(l.URL.String(), prefix)
+	}
+	return false
+}
+
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeAny, ScopeHost, ScopeDomain, ScopePrefix:
+		return true
+	}
+	return false
+}
+
+// Encode returns l as a line of the wire protocol. Fields are separated by
+// tabs and the URL comes first, so a bare URL line is a valid seed.
+func (l *Link) Encode() string {
+	fields := []string{
+		l.URL.String(),
+		strconv.Itoa(l.Depth),
+		strconv.Itoa(l.Hops),
+		l.Referrer,
+		l.Seed,
+		strconv.Itoa(l.Priority),
+		l.Scope}
+
+	return strings.Join(fields, "\t") + "\n"
+}
+
+// ParseLink decodes a line produced by Encode. A trailing newline is optional.
+func ParseLink(line string) (*Link, error) {
+	line = strings.TrimRight(line, "\r\n")
+	fields := strings.Split(line, "\t")
+
+	url, err := urlparse.Parse(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	link := NewSeed(url)
+	if len(fields) == 1 {
+		return link, nil
+	} else if len(fields) != 5 && len(fields) != 7 {
+		return nil, InvalidLink
+	}
+
+	if link.Depth, err = strconv.Atoi(fields[1]); err != nil || link.Depth < 0 {
+		return nil, InvalidLink
+	}
+	if link.Hops, err = strconv.Atoi(fields[2]); err != nil || link.Hops < 0 {
+		return nil, InvalidLink
+	}
+	link.Referrer = fields[3]
+	if fields[4] != "" {
+		link.Seed = fields[4]
+	}
+
+	if len(fields) == 7 {
+		if link.Priority, err = strconv.Atoi(fields[5]); err != nil {
+			return nil, InvalidLink
+		}
+		if link.Scope = fields[6]; !ValidScope(link.Scope) {
+			return nil, InvalidScope
+		}
+	}
+
+	return link, nil
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func TestParseLinkBareURL(t *testing.T) {
+	link, err := ParseLink("http://example.com/\n")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, link.URL.String(), "http://example.com/")
+	assert.Equal(t, link.Depth, 0)
+	assert.Equal(t, link.Hops, 0)
+	assert.Equal(t, link.Referrer, "")
+	assert.Equal(t, link.Seed, "http://example.com/")
+}
+
+func TestLinkEncode(t *testing.T) {
+	seedURL, _ := url.Parse("http://example.com/")
+	childURL, _ := url.Parse("http://example.org/a")
+
+	child := NewSeed(seedURL).Child(childURL)
+	got, err := ParseLink(child.Encode())
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, got.URL.String(), "http://example.org/a")
+	assert.Equal(t, got.Depth, 1)
+	assert.Equal(t, got.Hops, 1)
+	assert.Equal(t, got.Referrer, "http://example.com/")
+	assert.Equal(t, got.Seed, "http://example.com/")
+
+	_, err = ParseLink("http://example.com/\tx\t0\t\t\n")
+	assert.Equal(t, err, InvalidLink)
+}
+
+func TestLinkChildHops(t *testing.T) {
+	seedURL, _ := url.Parse("http://example.com/")
+	offURL, _ := url.Parse("http://example.org/")
+	backURL, _ := url.Parse("http://example.com/b")
+
+	off := NewSeed(seedURL).Child(offURL)
+	assert.Equal(t, off.Hops, 1)
+	assert.Equal(t, off.Child(offURL).Hops, 2)
+	assert.Equal(t, off.Child(backURL).Hops, 0)
+	assert.Equal(t, off.Child(backURL).Depth, 2)
+}
+
+func TestLinkInSeedScope(t *testing.T) {
+	seedURL, _ := url.Parse("http://www.example.com/docs/index.html")
+	seed := NewSeed(seedURL)
+
+	cases := []struct {
+		scope  string
+		rawurl string
+		in     bool
+	}{
+		{ScopeAny, "http://example.org/", true},
+		{ScopeHost, "http://www.example.com/about", true},
+		{ScopeHost, "http://blog.example.com/", false},
+		{ScopeDomain, "http://blog.example.com/", true},
+		{ScopeDomain, "http://example.org/", false},
+		{ScopePrefix, "http://www.example.com/docs/a/b", true},
+		{ScopePrefix, "http://www.example.com/about", false}}
+
+	for _, c := range cases {
+		seed.Scope = c.scope
+		u, _ := url.Parse(c.rawurl)
+		assert.Equal(t, seed.Child(u).InSeedScope(), c.in, c.scope+" "+c.rawurl)
+	}
+}
+
+func TestLinkEncodePriorityAndScope(t *testing.T) {
+	seedURL, _ := url.Parse("http://example.com/")
+	seed := NewSeed(seedURL)
+	seed.Priority = 5
+	seed.Scope = ScopeDomain
+
+	got, err := ParseLink(seed.Encode())
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, got.Priority, 5)
+	assert.Equal(t, got.Scope, ScopeDomain)
+
+	_, err = ParseLink("http://example.com/\t0\t0\t\t\t0\tplanet\n")
+	assert.Equal(t, err, InvalidScope)
+}
@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	urlparse "net/url"
+	"time"
+)
+
+// Version is the latest version of the framed protocol. Version 0 stands for
+// the legacy line protocol, and version 2 adds flow control by credits.
+const Version = 2
+
+// FlowControlVersion is the first version which has credits.
+const FlowControlVersion = 2
+
+// Types of messages.
+const (
+	Hello     = "HELLO"     // opens a session and negotiates the version
+	URLs      = "URLS"      // a batch of links to crawl
+	Seeds     = "SEEDS"     // a batch of links to start crawling from
+	Ack       = "ACK"       // acknowledges the batch of ID
+	Done      = "DONE"      // links the crawler has finished with
+	Credit    = "CREDIT"    // the crawler can take Credits more links
+	Quit      = "QUIT"      // the sender is leaving
+	Heartbeat = "HEARTBEAT" // keeps an idle connection alive
+	Error     = "ERROR"     // the peer did something wrong
+)
+
+// Roles of a client saying HELLO to the exchange.
+const (
+	RoleCrawler  = "crawler"
+	RoleSeeder   = "seeder"
+	RoleExchange = "exchange"
+)
+
+// MaxFrameSize is the longest line read from a connection, in bytes.
+const MaxFrameSize = 16 << 20
+
+var (
+	InvalidMessage = errors.New("Message is invalid format")
+	FrameTooLong   = errors.New("Frame is too long")
+
+	// Each side sends a heartbeat every interval, and gives up a
+	// connection which has been silent for three intervals.
+	HeartbeatInterval = 15 * time.Second
+)
+
+type Message struct {
+	Type    string  `json:"type"`
+	Version int     `json:"version,omitempty"`
+	Role    string  `json:"role,omitempty"`
+	Crawler string  `json:"crawler,omitempty"` // identity kept across sessions
+	Weight  float64 `json:"weight,omitempty"`  // capacity relative to a crawler of 1
+	Credits int     `json:"credits,omitempty"` // links the crawler can take
+	ID      uint64  `json:"id,omitempty"`
+	Links   []*Link `json:"urls,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Validate returns InvalidMessage unless m has a type and all of its links,
+// since a null in "urls" decodes to a nil link.
+func (m *Message) Validate() error {
+	if m.Type == "" {
+		return InvalidMessage
+	}
+	for _, link := range m.Links {
+		if link == nil {
+			return InvalidMessage
+		}
+	}
+	return nil
+}
+
+// NegotiateVersion returns the version to talk with a peer which supports up
+// to version, or false when there is none.
+func NegotiateVersion(version int) (int, bool) {
+	if version < 1 {
+		return 0, false
+	} else if version > Version {
+		return Version, true
+	}
+	return version, true
+}
+
+type jsonLink struct {
+	URL      string `json:"url"`
+	Depth    int    `json:"depth"`
+	Hops     int    `json:"hops"`
+	Referrer string `json:"referrer,omitempty"`
+	Seed     string `json:"seed,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+func (l *Link) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonLink{
+		URL:      l.URL.String(),
+		Depth:    l.Depth,
+		Hops:     l.Hops,
+		Referrer: l.Referrer,
+		Seed:     l.Seed,
+		Priority: l.Priority,
+		Scope:    l.Scope})
+}
+
+func (l *Link) UnmarshalJSON(data []byte) error {
+	var j jsonLink
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	url, err := urlparse.Parse(j.URL)
+	if err != nil {
+		return err
+	} else if j.Depth < 0 || j.Hops < 0 {
+		return InvalidLink
+	} else if !ValidScope(j.Scope) {
+		return InvalidScope
+	}
+
+	*l = *NewSeed(url)
+	l.Depth = j.Depth
+	l.Hops = j.Hops
+	l.Referrer = j.Referrer
+	if j.Seed != "" {
+		l.Seed = j.Seed
+	}
+	l.Priority = j.Priority
+	l.Scope = j.Scope
+	return nil
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A batch which has not been acknowledged in AckTimeout is given up along
+// with its connection.
+var AckTimeout = 3 * HeartbeatInterval
+
+type outboxBatch struct {
+	links []*Link
+	sent  time.Time
+}
+
+// Outbox keeps the batches of links sent over a connection until the
+// receiver acknowledges them, so that they can be sent again elsewhere when
+// the connection is lost.
+type Outbox struct {
+	batches map[uint64]outboxBatch
+	lastID  uint64
+	sync.Mutex
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{batches: make(map[uint64]outboxBatch)}
+}
+
+// Add keeps links and returns the ID to send them with.
+func (o *Outbox) Add(links []*Link) uint64 {
+	o.Lock()
+	defer o.Unlock()
+
+	o.lastID++
+	o.batches[o.lastID] = outboxBatch{links, time.Now()}
+	return o.lastID
+}
+
+// Ack forgets the batch of id, and reports whether it was kept.
+func (o *Outbox) Ack(id uint64) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	_, exists := o.batches[id]
+	delete(o.batches, id)
+	return exists
+}
+
+// Len returns the number of links which have not been acknowledged.
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+
+	n := 0
+	for _, b := range o.batches {
+		n += len(b.links)
+	}
+	return n
+}
+
+// Overdue reports whether a batch has waited for its acknowledgement longer
+// than timeout.
+func (o *Outbox) Overdue(timeout time.Duration) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	for _, b := range o.batches {
+		if time.Since(b.sent) > timeout {
+			return true
+		}
+	}
+	return false
+}
+
+// Drain forgets every batch and returns their links in the order they were
+// added.
+func (o *Outbox) Drain() []*Link {
+	o.Lock()
+	defer o.Unlock()
+
+	ids := make([]uint64, 0, len(o.batches))
+	for id := range o.batches {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	links := make([]*Link, 0)
+	for _, id := range ids {
+		links = append(links, o.batches[id].links...)
+	}
+	o.batches = make(map[uint64]outboxBatch)
+	return links
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	o := NewOutbox()
+
+	links := make([]*Link, 3)
+	for i, rawurl := range []string{"http://a.com/", "http://b.com/", "http://c.com/"} {
+		u, _ := url.Parse(rawurl)
+		links[i] = NewSeed(u)
+	}
+
+	first := o.Add(links[:1])
+	second := o.Add(links[1:])
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, o.Len(), 3)
+
+	assert.True(t, o.Ack(second))
+	assert.False(t, o.Ack(second))
+	assert.Equal(t, o.Len(), 1)
+
+	o.Add(links[2:])
+	assert.Equal(t, o.Drain(), []*Link{links[0], links[2]})
+	assert.Equal(t, o.Len(), 0)
+	assert.False(t, o.Ack(first))
+}
+
+func TestOutboxOverdue(t *testing.T) {
+	o := NewOutbox()
+	assert.False(t, o.Overdue(0))
+
+	id := o.Add([]*Link{})
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, o.Overdue(time.Second))
+	assert.True(t, o.Overdue(time.Millisecond))
+
+	o.Ack(id)
+	assert.False(t, o.Overdue(time.Millisecond))
+}
@@ -0,0 +1,238 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             v3.5.1-go
+// source: exchange.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Exchange_Crawl_FullMethodName        = "/kaken.Exchange/Crawl"
+	Exchange_SubmitURLs_FullMethodName   = "/kaken.Exchange/SubmitURLs"
+	Exchange_ListCrawlers_FullMethodName = "/kaken.Exchange/ListCrawlers"
+	Exchange_GetRing_FullMethodName      = "/kaken.Exchange/GetRing"
+)
+
+// ExchangeClient is the client API for Exchange service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Exchange is the gRPC service of the exchange.
+type ExchangeClient interface {
+	// Crawl carries the same messages as the framed protocol over TCP.
+	Crawl(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Message, Message], error)
+	// SubmitURLs queues links as seeds.
+	SubmitURLs(ctx context.Context, in *SubmitURLsRequest, opts ...grpc.CallOption) (*SubmitURLsResponse, error)
+	ListCrawlers(ctx context.Context, in *ListCrawlersRequest, opts ...grpc.CallOption) (*ListCrawlersResponse, error)
+	GetRing(ctx context.Context, in *GetRingRequest, opts ...grpc.CallOption) (*GetRingResponse, error)
+}
+
+type exchangeClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewExchangeClient(cc grpc.ClientConnInterface) ExchangeClient {
+	return &exchangeClient{cc}
+}
+
+func (c *exchangeClient) Crawl(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Message, Message], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Exchange_ServiceDesc.Streams[0], Exchange_Crawl_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Message, Message]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Exchange_CrawlClient = grpc.BidiStreamingClient[Message, Message]
+
+func (c *exchangeClient) SubmitURLs(ctx context.Context, in *SubmitURLsRequest, opts ...grpc.CallOption) (*SubmitURLsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SubmitURLsResponse)
+	err := c.cc.Invoke(ctx, Exchange_SubmitURLs_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *exchangeClient) ListCrawlers(ctx context.Context, in *ListCrawlersRequest, opts ...grpc.CallOption) (*ListCrawlersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListCrawlersResponse)
+	err := c.cc.Invoke(ctx, Exchange_ListCrawlers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *exchangeClient) GetRing(ctx context.Context, in *GetRingRequest, opts ...grpc.CallOption) (*GetRingResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetRingResponse)
+	err := c.cc.Invoke(ctx, Exchange_GetRing_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExchangeServer is the server API for Exchange service.
+// All implementations must embed UnimplementedExchangeServer
+// for forward compatibility.
+//
+// Exchange is the gRPC service of the exchange.
+type ExchangeServer interface {
+	// Crawl carries the same messages as the framed protocol over TCP.
+	Crawl(grpc.BidiStreamingServer[Message, Message]) error
+	// SubmitURLs queues links as seeds.
+	SubmitURLs(context.Context, *SubmitURLsRequest) (*SubmitURLsResponse, error)
+	ListCrawlers(context.Context, *ListCrawlersRequest) (*ListCrawlersResponse, error)
+	GetRing(context.Context, *GetRingRequest) (*GetRingResponse, error)
+	mustEmbedUnimplementedExchangeServer()
+}
+
+// UnimplementedExchangeServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedExchangeServer struct{}
+
+func (UnimplementedExchangeServer) Crawl(grpc.BidiStreamingServer[Message, Message]) error {
+	return status.Error(codes.Unimplemented, "method Crawl not implemented")
+}
+func (UnimplementedExchangeServer) SubmitURLs(context.Context, *SubmitURLsRequest) (*SubmitURLsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method SubmitURLs not implemented")
+}
+func (UnimplementedExchangeServer) ListCrawlers(context.Context, *ListCrawlersRequest) (*ListCrawlersResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListCrawlers not implemented")
+}
+func (UnimplementedExchangeServer) GetRing(context.Context, *GetRingRequest) (*GetRingResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetRing not implemented")
+}
+func (UnimplementedExchangeServer) mustEmbedUnimplementedExchangeServer() {}
+func (UnimplementedExchangeServer) testEmbeddedByValue()                  {}
+
+// UnsafeExchangeServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ExchangeServer will
+// result in compilation errors.
+type UnsafeExchangeServer interface {
+	mustEmbedUnimplementedExchangeServer()
+}
+
+func RegisterExchangeServer(s grpc.ServiceRegistrar, srv ExchangeServer) {
+	// If the following call panics, it indicates UnimplementedExchangeServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Exchange_ServiceDesc, srv)
+}
+
+func _Exchange_Crawl_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ExchangeServer).Crawl(&grpc.GenericServerStream[Message, Message]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Exchange_CrawlServer = grpc.BidiStreamingServer[Message, Message]
+
+func _Exchange_SubmitURLs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitURLsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExchangeServer).SubmitURLs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Exchange_SubmitURLs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExchangeServer).SubmitURLs(ctx, req.(*SubmitURLsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Exchange_ListCrawlers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCrawlersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExchangeServer).ListCrawlers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Exchange_ListCrawlers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExchangeServer).ListCrawlers(ctx, req.(*ListCrawlersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Exchange_GetRing_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExchangeServer).GetRing(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Exchange_GetRing_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExchangeServer).GetRing(ctx, req.(*GetRingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Exchange_ServiceDesc is the grpc.ServiceDesc for Exchange service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Exchange_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kaken.Exchange",
+	HandlerType: (*ExchangeServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitURLs",
+			Handler:    _Exchange_SubmitURLs_Handler,
+		},
+		{
+			MethodName: "ListCrawlers",
+			Handler:    _Exchange_ListCrawlers_Handler,
+		},
+		{
+			MethodName: "GetRing",
+			Handler:    _Exchange_GetRing_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Crawl",
+			Handler:       _Exchange_Crawl_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "exchange.proto",
+}
@@ -0,0 +1,233 @@
+package scope
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	urlparse "net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the on-disk form of a scope, a JSON object such as
+//
+//	{
+//	  "domains":  ["example.com"],
+//	  "prefixes": ["http://example.org/docs/"],
+//	  "surts":    ["http://(net,example,"],
+//	  "include":  ["^https?://[^/]+/blog/"],
+//	  "exclude":  ["\\.(jpg|png|gif)$"]
+//	}
+//
+// A URL is in scope when it matches any of domains, prefixes, surts or
+// include (or when none of them is given) and matches none of exclude.
+type Config struct {
+	Domains  []string `json:"domains"`
+	Prefixes []string `json:"prefixes"`
+	SURTs    []string `json:"surts"`
+	Include  []string `json:"include"`
+	Exclude  []string `json:"exclude"`
+}
+
+type Rules struct {
+	domains  []string
+	prefixes []string
+	surts    []string
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+}
+
+func NewRules(config Config) (*Rules, error) {
+	r := &Rules{
+		domains:  make([]string, 0, len(config.Domains)),
+		prefixes: config.Prefixes,
+		surts:    make([]string, 0, len(config.SURTs)),
+		include:  make([]*regexp.Regexp, 0, len(config.Include)),
+		exclude:  make([]*regexp.Regexp, 0, len(config.Exclude))}
+
+	for _, domain := range config.Domains {
+		domain = strings.TrimPrefix(strings.ToLower(domain), "*")
+		r.domains = append(r.domains, strings.Trim(domain, "."))
+	}
+
+	for _, surt := range config.SURTs {
+		r.surts = append(r.surts, strings.ToLower(surt))
+	}
+
+	for _, expr := range config.Include {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		r.include = append(r.include, re)
+	}
+
+	for _, expr := range config.Exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		r.exclude = append(r.exclude, re)
+	}
+
+	return r, nil
+}
+
+func (r *Rules) Allows(url *urlparse.URL) bool {
+	rawurl := url.String()
+
+	for _, re := range r.exclude {
+		if re.MatchString(rawurl) {
+			return false
+		}
+	}
+
+	if len(r.domains)+len(r.prefixes)+len(r.surts)+len(r.include) == 0 {
+		return true
+	}
+
+	host := strings.ToLower(url.Hostname())
+	for _, domain := range r.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(rawurl, prefix) {
+			return true
+		}
+	}
+
+	if len(r.surts) > 0 {
+		surt := SURT(url)
+		for _, prefix := range r.surts {
+			if strings.HasPrefix(surt, prefix) {
+				return true
+			}
+		}
+	}
+
+	for _, re := range r.include {
+		if re.MatchString(rawurl) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SURT returns url in Sort-friendly URI Reordering Transform form, e.g.
+// http://www.example.com/a becomes http://(com,example,www,)/a.
+func SURT(url *urlparse.URL) string {
+	labels := strings.Split(strings.ToLower(url.Hostname()), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	host := strings.Join(labels, ",") + ","
+	if port := url.Port(); port != "" {
+		host += ":" + port
+	}
+
+	surt := strings.ToLower(url.Scheme) + "://(" + host + ")" + url.EscapedPath()
+	if url.RawQuery != "" {
+		surt += "?" + url.RawQuery
+	}
+	return surt
+}
+
+// Scope is a set of Rules loaded from a file, which can be reloaded while
+// the crawl is running.
+type Scope struct {
+	path    string
+	rules   *Rules
+	modTime time.Time
+	sync.RWMutex
+}
+
+func Load(path string) (*Scope, error) {
+	s := &Scope{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Allows reports whether url is in scope. A nil Scope allows everything.
+func (s *Scope) Allows(url *urlparse.URL) bool {
+	if s == nil {
+		return true
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.rules.Allows(url)
+}
+
+// Reload reads the file again if it has been modified since the last load.
+// The current rules are kept when the new file is invalid.
+func (s *Scope) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.RLock()
+	modified := !info.ModTime().Equal(s.modTime)
+	s.RUnlock()
+
+	if !modified {
+		return nil
+	}
+	return s.load()
+}
+
+// Watch reloads the file every interval until quit is signaled.
+func (s *Scope) Watch(interval time.Duration, quit <-chan bool) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(interval):
+			if err := s.Reload(); err != nil {
+				slog.Warn("Failed to reload scope", "path", s.path, "error", err)
+			}
+		}
+	}
+}
+
+func (s *Scope) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var config Config
+	if err := json.Unmarshal(body, &config); err != nil {
+		return err
+	}
+
+	rules, err := NewRules(config)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.rules = rules
+	s.modTime = info.ModTime()
+	slog.Info("Loaded scope", "path", s.path)
+	return nil
+}
@@ -0,0 +1,101 @@
+package scope
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, rawurl string) *url.URL {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestRulesAllows(t *testing.T) {
+	rules, err := NewRules(Config{
+		Domains:  []string{"*.example.com"},
+		Prefixes: []string{"http://example.org/docs/"},
+		SURTs:    []string{"http://(net,example,"},
+		Include:  []string{"^https?://[^/]+/blog/"},
+		Exclude:  []string{`\.jpg$`}})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	allowed := []string{
+		"http://example.com/",
+		"https://www.example.com:8080/a",
+		"http://example.org/docs/index.html",
+		"http://www.example.net/",
+		"http://another.test/blog/1"}
+	for _, rawurl := range allowed {
+		assert.True(t, rules.Allows(mustParse(t, rawurl)), rawurl)
+	}
+
+	denied := []string{
+		"http://badexample.com/",
+		"http://example.org/",
+		"http://example.com/a.jpg",
+		"http://another.test/"}
+	for _, rawurl := range denied {
+		assert.False(t, rules.Allows(mustParse(t, rawurl)), rawurl)
+	}
+}
+
+func TestRulesAllowsWithoutPositiveRules(t *testing.T) {
+	rules, err := NewRules(Config{Exclude: []string{"logout"}})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	assert.True(t, rules.Allows(mustParse(t, "http://example.com/")))
+	assert.False(t, rules.Allows(mustParse(t, "http://example.com/logout")))
+
+	_, err = NewRules(Config{Include: []string{"("}})
+	assert.NotNil(t, err)
+}
+
+func TestSURT(t *testing.T) {
+	assert.Equal(t, SURT(mustParse(t, "http://www.Example.com/a?b=c")), "http://(com,example,www,)/a?b=c")
+	assert.Equal(t, SURT(mustParse(t, "https://example.com:8443/")), "https://(com,example,:8443)/")
+}
+
+func TestScopeReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scope")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "scope.json")
+	if !assert.Nil(t, ioutil.WriteFile(path, []byte(`{"domains": ["example.com"]}`), 0644)) {
+		t.FailNow()
+	}
+
+	s, err := Load(path)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, s.Allows(mustParse(t, "http://example.com/")))
+	assert.False(t, s.Allows(mustParse(t, "http://example.org/")))
+
+	if !assert.Nil(t, ioutil.WriteFile(path, []byte(`{"domains": ["example.org"]}`), 0644)) {
+		t.FailNow()
+	}
+	later := time.Now().Add(1 * time.Minute)
+	os.Chtimes(path, later, later)
+
+	assert.Nil(t, s.Reload())
+	assert.False(t, s.Allows(mustParse(t, "http://example.com/")))
+	assert.True(t, s.Allows(mustParse(t, "http://example.org/")))
+
+	var nilScope *Scope
+	assert.True(t, nilScope.Allows(mustParse(t, "http://example.com/")))
+}